@@ -82,6 +82,8 @@ func main() {
 
 		if initializeIDE {
 			ide.SYSTEM_INITIALIZED = true
+			// stop the IDE server along with the processes it started when the pod is stopped
+			common.HandleShutdownSignals(log)
 			cmd := fmt.Sprintf("cd /bin/openvscode-server-v1.98.2-linux-x64 && ./bin/openvscode-server --connection-token %s --host 0.0.0.0 --port 8080 --enable-remote-auto-shutdown --install-extension /bin/runpod-build-0.0.6.vsix", os.Getenv("IDE_CONNECTION_STRING"))
 			err = common.RunCommand(cmd, true, log)
 			if err != nil {
@@ -126,6 +128,9 @@ func main() {
 			testbeds.RunTests(log)
 		}()
 
+		// stop the handler and deliver the last reports and logs when the pod is stopped
+		common.HandleShutdownSignals(log)
+
 		for {
 			time.Sleep(time.Duration(1) * time.Second)
 			aiApiStatus, err := http.Get("http://localhost:80/ping")
@@ -146,5 +151,12 @@ func main() {
 		}
 		fmt.Println("Running command", modifiedCommand)
 		common.RunCommand(modifiedCommand, false, log)
+
+		// the handler stopped before the tests could finish
+		code := 0
+		if common.LocalReporting() {
+			code = 1
+		}
+		common.Exit(code, log)
 	}
 }
@@ -0,0 +1,225 @@
+package common
+
+import (
+	"encoding/json"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// jobFinishGrace is how long after a job finished a line without job id can still belong to it,
+	// the handler often prints after returning its output
+	jobFinishGrace = 250 * time.Millisecond
+	// jobWindowRetention is how long a finished job stays a candidate, the events reach attributeEvent
+	// after they were captured, tracebacks up to tracebackIdle later
+	jobWindowRetention = time.Minute
+	// maxFinishedJobs is how many finished jobs are remembered with their logs for the reports, the oldest
+	// are forgotten first
+	maxFinishedJobs = 10000
+)
+
+// sdkTextLine matches the lines of the runpod SDK logger outside of runpod, "LEVEL  | job id | message"
+var sdkTextLine = regexp.MustCompile(`^(TRACE|DEBUG|INFO|WARN|WARNING|ERROR)\s*\|\s*([^\s|]+)\s*\|\s?(.*)$`)
+
+// jobWindow is when a job ran on the worker, FinishedAt is zero while it is running
+type jobWindow struct {
+	ID         string
+	TestNumber int
+	StartedAt  time.Time
+	FinishedAt time.Time
+}
+
+var (
+	jobWindowsMutex = &sync.RWMutex{}
+	// jobs are the jobs the worker took with the test they were submitted for, up to maxFinishedJobs finished ones
+	jobs = make(map[string]*jobWindow)
+	// runningJobs are the jobs the worker is running
+	runningJobs = make(map[string]*jobWindow)
+	// recentJobs are the jobs finished within jobWindowRetention in the order they finished, the candidates of
+	// the time window along with runningJobs
+	recentJobs = make([]*jobWindow, 0)
+	// finishedJobs are the ids of the finished jobs that are remembered, in the order they finished
+	finishedJobs = make([]string, 0)
+	// discardedTests are the tests whose jobs are forgotten once they left the time window, without job logs
+	discardedTests = make(map[int]bool)
+)
+
+// DiscardJobLogs stops keeping the logs of each job of the test, their lines only count for the test. The jobs are
+// forgotten as soon as no line can be attributed to them anymore, for the many short jobs of a load test.
+func DiscardJobLogs(testNumber int) {
+	jobWindowsMutex.Lock()
+	defer jobWindowsMutex.Unlock()
+	discardedTests[testNumber] = true
+}
+
+// keepsJobLogs tells whether the logs of the jobs of the test are kept
+func keepsJobLogs(testNumber int) bool {
+	jobWindowsMutex.RLock()
+	defer jobWindowsMutex.RUnlock()
+	return !discardedTests[testNumber]
+}
+
+// JobStarted records that the worker took the job, its logs are attributed to testNumber
+func JobStarted(jobID string, testNumber int, startedAt time.Time) {
+	jobWindowsMutex.Lock()
+	defer jobWindowsMutex.Unlock()
+
+	window := &jobWindow{ID: jobID, TestNumber: testNumber, StartedAt: startedAt}
+	jobs[jobID] = window
+	runningJobs[jobID] = window
+	requestResourceSample()
+}
+
+// JobFinished records that the job reached a final status, and forgets the jobs that are too old to be kept
+func JobFinished(jobID string, finishedAt time.Time) {
+	forgotten := make([]string, 0)
+	defer func() {
+		for _, id := range forgotten {
+			forgetJobLogs(id)
+		}
+	}()
+
+	jobWindowsMutex.Lock()
+	defer jobWindowsMutex.Unlock()
+	requestResourceSample()
+
+	window, running := runningJobs[jobID]
+	if !running {
+		return
+	}
+	delete(runningJobs, jobID)
+	window.FinishedAt = finishedAt
+	recentJobs = append(recentJobs, window)
+
+	for len(recentJobs) > 0 && finishedAt.Sub(recentJobs[0].FinishedAt) > jobWindowRetention {
+		if discardedTests[recentJobs[0].TestNumber] {
+			delete(jobs, recentJobs[0].ID)
+		}
+		recentJobs = recentJobs[1:]
+	}
+
+	if !discardedTests[window.TestNumber] {
+		finishedJobs = append(finishedJobs, jobID)
+		for len(finishedJobs) > maxFinishedJobs {
+			delete(jobs, finishedJobs[0])
+			forgotten = append(forgotten, finishedJobs[0])
+			finishedJobs = finishedJobs[1:]
+		}
+	}
+}
+
+// findJobWindow returns when the job ran, FinishedAt is zero while it is running
+func findJobWindow(jobID string) (jobWindow, bool) {
+	jobWindowsMutex.RLock()
+	defer jobWindowsMutex.RUnlock()
+
+	window, exists := jobs[jobID]
+	if !exists {
+		return jobWindow{}, false
+	}
+	return *window, true
+}
+
+// attributeEvent sets the job and the test of an event. The job id printed by the runpod SDK wins, otherwise
+// the event goes to the only job running when it was captured. Events printed while no job or several jobs were
+// running are not attributed to a job and belong to test 0.
+func attributeEvent(event *LogEvent) {
+	if event.Stream != StreamSystem {
+		parseSDKLine(event)
+	}
+
+	jobWindowsMutex.RLock()
+	defer jobWindowsMutex.RUnlock()
+
+	if event.JobID != "" {
+		event.TestNumber = 0
+		if window, exists := jobs[event.JobID]; exists {
+			event.TestNumber = window.TestNumber
+		}
+		return
+	}
+
+	var match *jobWindow
+	candidates := 0
+	consider := func(window *jobWindow) {
+		if event.Time.Before(window.StartedAt) || (!window.FinishedAt.IsZero() && event.Time.After(window.FinishedAt.Add(jobFinishGrace))) {
+			return
+		}
+		match = window
+		candidates++
+	}
+	for _, window := range runningJobs {
+		consider(window)
+		if candidates > 1 {
+			break
+		}
+	}
+	// the jobs that finished before the event minus the grace cannot match, recentJobs is in the order they finished
+	for i := len(recentJobs) - 1; i >= 0 && candidates <= 1; i-- {
+		if event.Time.After(recentJobs[i].FinishedAt.Add(jobFinishGrace)) {
+			break
+		}
+		consider(recentJobs[i])
+	}
+
+	event.TestNumber = 0
+	if candidates == 1 {
+		event.JobID = match.ID
+		event.TestNumber = match.TestNumber
+	}
+}
+
+// parseSDKLine reads the job id, level and message of a line printed by the runpod SDK logger. On runpod it
+// prints JSON, {"requestId": ..., "message": ..., "level": ...}, and text with the job id between pipes elsewhere.
+func parseSDKLine(event *LogEvent) {
+	text := event.Message
+
+	if strings.HasPrefix(text, "{") && strings.Contains(text, `"requestId"`) {
+		var line struct {
+			RequestID *string `json:"requestId"`
+			Message   *string `json:"message"`
+			Level     string  `json:"level"`
+		}
+		if err := json.Unmarshal([]byte(text), &line); err != nil || line.Message == nil {
+			return
+		}
+		event.Message = *line.Message
+		if line.Level != "" {
+			event.Level = sdkLevel(line.Level)
+		}
+		if line.RequestID != nil {
+			event.JobID = *line.RequestID
+		}
+		return
+	}
+
+	match := sdkTextLine.FindStringSubmatch(text)
+	if match == nil {
+		return
+	}
+	jobWindowsMutex.RLock()
+	_, known := jobs[match[2]]
+	jobWindowsMutex.RUnlock()
+	// a message with a pipe in it looks the same as a job id, only the jobs the worker took count
+	if !known {
+		return
+	}
+	event.JobID = match[2]
+	event.Level = sdkLevel(match[1])
+	event.Message = match[3]
+}
+
+func sdkLevel(level string) string {
+	switch strings.ToUpper(level) {
+	case "TRACE", "DEBUG":
+		return "debug"
+	case "WARN", "WARNING":
+		return "warn"
+	case "ERROR":
+		return "error"
+	default:
+		return "info"
+	}
+}
@@ -0,0 +1,146 @@
+package common
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// useJobWindows starts the test without any job taken by the worker and restores the jobs of the process after it
+func useJobWindows(t *testing.T) {
+	t.Helper()
+	jobWindowsMutex.Lock()
+	previousJobs, previousRunning, previousRecent, previousFinished, previousDiscarded := jobs, runningJobs, recentJobs, finishedJobs, discardedTests
+	jobs = make(map[string]*jobWindow)
+	runningJobs = make(map[string]*jobWindow)
+	recentJobs = make([]*jobWindow, 0)
+	finishedJobs = make([]string, 0)
+	discardedTests = make(map[int]bool)
+	jobWindowsMutex.Unlock()
+
+	t.Cleanup(func() {
+		jobWindowsMutex.Lock()
+		defer jobWindowsMutex.Unlock()
+		jobs, runningJobs, recentJobs, finishedJobs, discardedTests = previousJobs, previousRunning, previousRecent, previousFinished, previousDiscarded
+	})
+}
+
+func TestParseSDKLine(t *testing.T) {
+	useJobWindows(t)
+	JobStarted("job-1", 1, time.Now())
+
+	tests := []struct {
+		name    string
+		message string
+		level   string
+		jobID   string
+		want    string
+	}{
+		{name: "plain line", message: "loading the model", level: "info", want: "loading the model"},
+		{name: "JSON line", message: `{"requestId": "job-1", "message": "step 1", "level": "WARNING"}`, level: "warn", jobID: "job-1", want: "step 1"},
+		{name: "JSON line of an unknown job", message: `{"requestId": "job-9", "message": "step 1", "level": "ERROR"}`, level: "error", jobID: "job-9", want: "step 1"},
+		{name: "JSON line without a job", message: `{"requestId": null, "message": "worker started", "level": "DEBUG"}`, level: "debug", want: "worker started"},
+		{name: "JSON line without a level", message: `{"requestId": "job-1", "message": "step 2"}`, level: "info", jobID: "job-1", want: "step 2"},
+		{name: "JSON line without a message", message: `{"requestId": "job-1", "level": "ERROR"}`, level: "info", want: `{"requestId": "job-1", "level": "ERROR"}`},
+		{name: "invalid JSON line", message: `{"requestId": "job-1", `, level: "info", want: `{"requestId": "job-1", `},
+		{name: "text line", message: "ERROR  | job-1 | Traceback follows", level: "error", jobID: "job-1", want: "Traceback follows"},
+		{name: "text line with a pipe in the message", message: "DEBUG | job-1 | a | b", level: "debug", jobID: "job-1", want: "a | b"},
+		{name: "text line of an unknown job", message: "INFO | a | b", level: "info", want: "INFO | a | b"},
+		{name: "text line with an unknown level", message: "NOTICE | job-1 | hello", level: "info", want: "NOTICE | job-1 | hello"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			event := LogEvent{Stream: StreamStdout, Level: "info", Message: test.message}
+			parseSDKLine(&event)
+			if event.Message != test.want || event.Level != test.level || event.JobID != test.jobID {
+				t.Fatalf("got message %q, level %q, job %q, want %q, %q, %q", event.Message, event.Level, event.JobID, test.want, test.level, test.jobID)
+			}
+		})
+	}
+}
+
+func TestAttributeEvent(t *testing.T) {
+	start := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	at := func(seconds float64) time.Time {
+		return start.Add(time.Duration(seconds * float64(time.Second)))
+	}
+
+	// job-1 runs from 0s to 10s for test 1, job-2 from 20s to 30s for test 2 and job-3 from 25s on for test 3
+	setup := func(t *testing.T) {
+		useJobWindows(t)
+		JobStarted("job-1", 1, at(0))
+		JobFinished("job-1", at(10))
+		JobStarted("job-2", 2, at(20))
+		JobStarted("job-3", 3, at(25))
+		JobFinished("job-2", at(30))
+	}
+
+	tests := []struct {
+		name       string
+		event      LogEvent
+		jobID      string
+		testNumber int
+	}{
+		{name: "before any job", event: LogEvent{Stream: StreamStdout, Message: "booting", Time: at(-1)}},
+		{name: "only running job", event: LogEvent{Stream: StreamStdout, Message: "step", Time: at(5)}, jobID: "job-1", testNumber: 1},
+		{name: "within the grace after the job finished", event: LogEvent{Stream: StreamStderr, Message: "done", Time: at(10.2)}, jobID: "job-1", testNumber: 1},
+		{name: "after the grace", event: LogEvent{Stream: StreamStdout, Message: "idle", Time: at(11)}},
+		{name: "two jobs running", event: LogEvent{Stream: StreamStdout, Message: "step", Time: at(26)}},
+		{name: "one job left running", event: LogEvent{Stream: StreamStdout, Message: "step", Time: at(31)}, jobID: "job-3", testNumber: 3},
+		{name: "SDK job id wins over the time", event: LogEvent{Stream: StreamStdout, Message: "INFO | job-2 | step", Time: at(5)}, jobID: "job-2", testNumber: 2},
+		{name: "SDK JSON line of an unknown job", event: LogEvent{Stream: StreamStdout, Message: `{"requestId": "job-9", "message": "step"}`, Time: at(5)}, jobID: "job-9"},
+		{name: "system events are not parsed", event: LogEvent{Stream: StreamSystem, Message: "INFO | job-2 | step", Time: at(5)}, jobID: "job-1", testNumber: 1},
+		{name: "test number is reset", event: LogEvent{Stream: StreamStdout, Message: "idle", Time: at(15), TestNumber: 7}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			setup(t)
+			event := test.event
+			attributeEvent(&event)
+			if event.JobID != test.jobID || event.TestNumber != test.testNumber {
+				t.Fatalf("attributed to job %q of test %d, want job %q of test %d", event.JobID, event.TestNumber, test.jobID, test.testNumber)
+			}
+		})
+	}
+}
+
+func TestJobFinishedForgetsOldJobs(t *testing.T) {
+	useJobWindows(t)
+	start := time.Now()
+
+	DiscardJobLogs(2)
+	for i := 0; i < maxFinishedJobs+5; i++ {
+		id := fmt.Sprintf("kept-%d", i)
+		JobStarted(id, 1, start)
+		JobFinished(id, start.Add(time.Duration(i)*time.Millisecond))
+	}
+	JobStarted("load-1", 2, start)
+	JobFinished("load-1", start)
+	// a job that never started is ignored
+	JobFinished("unknown", start)
+
+	if _, found := findJobWindow("kept-0"); found {
+		t.Error("the oldest finished job is still remembered")
+	}
+	if _, found := findJobWindow(fmt.Sprintf("kept-%d", maxFinishedJobs+4)); !found {
+		t.Error("the last finished job is forgotten")
+	}
+	if _, found := findJobWindow("load-1"); !found {
+		t.Error("a discarded job is forgotten while lines can still be attributed to it")
+	}
+	if len(finishedJobs) != maxFinishedJobs {
+		t.Errorf("%d finished jobs remembered, want %d", len(finishedJobs), maxFinishedJobs)
+	}
+	if keepsJobLogs(2) || !keepsJobLogs(1) {
+		t.Error("the logs of the wrong test are discarded")
+	}
+
+	// once the window passed, the next finished job forgets the discarded one
+	JobStarted("late", 1, start)
+	JobFinished("late", start.Add(jobWindowRetention+time.Minute))
+	if _, found := findJobWindow("load-1"); found {
+		t.Error("a discarded job is remembered after its window passed")
+	}
+}
@@ -0,0 +1,260 @@
+package common
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	defaultMaxLogLineLength = 16 * 1024
+	defaultTruncationMarker = " [truncated]"
+	// redactLookahead is how much of a line past the length limit is still read, so a secret cut by the limit
+	// is masked whole instead of leaking its start
+	redactLookahead = 4 * 1024
+	// tracebackIdle is how long a traceback waits for a chained exception before it is sent
+	tracebackIdle = 500 * time.Millisecond
+	// maxTracebackLines bounds a traceback event, the lines after it start a new event
+	maxTracebackLines = 1000
+	// outputWaitDelay is how long Wait keeps reading the output of a command that exited, processes it started
+	// in the background can keep the output open forever
+	outputWaitDelay = 5 * time.Second
+
+	tracebackHeader = "Traceback (most recent call last):"
+)
+
+// Streams of a log event, system is for the messages of the server about the command itself
+const (
+	StreamStdout = "stdout"
+	StreamStderr = "stderr"
+	StreamSystem = "system"
+)
+
+// chainedExceptionMarkers are printed by Python between the tracebacks of chained exceptions
+var chainedExceptionMarkers = []string{
+	"During handling of the above exception, another exception occurred:",
+	"The above exception was the direct cause of the following exception:",
+}
+
+// LogEvent is a line, or a whole traceback, printed by a command along with when it was captured.
+// JobID and TestNumber are set by attributeEvent.
+type LogEvent struct {
+	Stream     string
+	Level      string
+	Message    string
+	JobID      string
+	TestNumber int
+	Time       time.Time
+}
+
+// newLogEvent stamps the event with the current time and masks the secrets in the message,
+// before it is printed or sent to any sink
+func newLogEvent(stream string, level string, message string) LogEvent {
+	message, _ = Redact(message)
+	return LogEvent{
+		Stream:  stream,
+		Level:   level,
+		Message: message,
+		Time:    time.Now().UTC(),
+	}
+}
+
+// captureOutput reads the output of a command line by line and sends the lines to logBuffer, a Python traceback
+// is sent as a single error event. The events are also kept in tail when it is set. It returns once reader is closed.
+func captureOutput(stream string, reader io.Reader, logBuffer chan<- LogEvent, tail *logTail) {
+	lines := make(chan LogEvent, 64)
+	grouped := make(chan struct{})
+	go func() {
+		groupTracebacks(lines, logBuffer, tail)
+		close(grouped)
+	}()
+
+	readLines(stream, reader, lines)
+	close(lines)
+	<-grouped
+}
+
+// readLines splits the output in lines of at most RUNPOD_LOG_MAX_LINE_LENGTH bytes, longer lines are cut and end
+// with RUNPOD_LOG_TRUNCATION_MARKER. The secrets of a long line are masked before it is cut.
+func readLines(stream string, reader io.Reader, lines chan<- LogEvent) {
+	maxLength := envInt("RUNPOD_LOG_MAX_LINE_LENGTH", defaultMaxLogLineLength)
+	marker := os.Getenv("RUNPOD_LOG_TRUNCATION_MARKER")
+	if marker == "" {
+		marker = defaultTruncationMarker
+	}
+
+	level, prefix := "info", "INFO: "
+	if stream == StreamStderr {
+		level, prefix = "error", "ERROR: "
+	}
+
+	buffered := bufio.NewReaderSize(reader, maxLength)
+	for {
+		line, isPrefix, err := buffered.ReadLine()
+		if err != nil {
+			if err != io.EOF {
+				lines <- newLogEvent(StreamSystem, "error", fmt.Sprintf("Failed to read %s: %s", stream, err.Error()))
+			}
+			return
+		}
+
+		if !isPrefix {
+			event := newLogEvent(stream, level, strings.TrimSuffix(string(line), "\r"))
+			fmt.Println(prefix, event.Message)
+			lines <- event
+			continue
+		}
+
+		// the secrets are masked in the whole line before it is cut, the rest of the line past the lookahead is dropped
+		full := append([]byte(nil), line...)
+		dropped := false
+		for isPrefix && err == nil {
+			line, isPrefix, err = buffered.ReadLine()
+			kept := min(len(line), max(maxLength+redactLookahead-len(full), 0))
+			full = append(full, line[:kept]...)
+			dropped = dropped || kept < len(line)
+		}
+		text, _ := Redact(strings.TrimSuffix(string(full), "\r"))
+		if len(text) > maxLength || dropped {
+			text = string(trimPartialRune([]byte(text[:min(len(text), maxLength)]))) + marker
+		}
+		event := newLogEvent(stream, level, text)
+		fmt.Println(prefix, event.Message)
+		lines <- event
+	}
+}
+
+// trimPartialRune removes a UTF-8 character cut in the middle at the end of line
+func trimPartialRune(line []byte) []byte {
+	for i := len(line) - 1; i >= 0 && i >= len(line)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(line[i]) {
+			if !utf8.FullRune(line[i:]) {
+				return line[:i]
+			}
+			break
+		}
+	}
+	return line
+}
+
+// groupTracebacks forwards the lines to logBuffer, joining the lines of a Python traceback, including the
+// chained exceptions, into one error event with the time of its first line
+func groupTracebacks(lines <-chan LogEvent, logBuffer chan<- LogEvent, tail *logTail) {
+	const (
+		outside = iota
+		inFrames
+		afterException
+		chaining
+	)
+
+	state := outside
+	var group []string
+	var first LogEvent
+
+	idle := time.NewTimer(tracebackIdle)
+	idle.Stop()
+	resetIdle := func() {
+		if !idle.Stop() {
+			select {
+			case <-idle.C:
+			default:
+			}
+		}
+		idle.Reset(tracebackIdle)
+	}
+
+	// ForwardLogs never waits on the sinks, so waiting for it does not hold up the command for long
+	send := func(event LogEvent) {
+		if tail != nil {
+			tail.add(event.Message)
+		}
+		logBuffer <- event
+	}
+	flush := func() {
+		if group == nil {
+			return
+		}
+		event := first
+		event.Level = "error"
+		event.Message = strings.TrimRight(strings.Join(group, "\n"), "\n")
+		send(event)
+		group = nil
+		state = outside
+	}
+
+	var handle func(line LogEvent)
+	handle = func(line LogEvent) {
+		text := line.Message
+		indented := strings.HasPrefix(text, " ") || strings.HasPrefix(text, "\t")
+
+		switch state {
+		case outside:
+			if text == tracebackHeader {
+				group = []string{text}
+				first = line
+				state = inFrames
+				resetIdle()
+				return
+			}
+			send(line)
+			return
+		case inFrames:
+			if !indented && text != "" {
+				state = afterException
+			}
+		case afterException:
+			if text == "" || isChainedExceptionMarker(text) {
+				state = chaining
+			} else {
+				flush()
+				handle(line)
+				return
+			}
+		case chaining:
+			if text == tracebackHeader {
+				state = inFrames
+			} else if text != "" && !isChainedExceptionMarker(text) {
+				flush()
+				handle(line)
+				return
+			}
+		}
+
+		group = append(group, text)
+		if len(group) >= maxTracebackLines {
+			flush()
+			return
+		}
+		resetIdle()
+	}
+
+	for {
+		select {
+		case line, ok := <-lines:
+			if !ok {
+				flush()
+				return
+			}
+			if line.Stream == StreamSystem {
+				send(line)
+				continue
+			}
+			handle(line)
+		case <-idle.C:
+			flush()
+		}
+	}
+}
+
+func isChainedExceptionMarker(text string) bool {
+	for _, marker := range chainedExceptionMarkers {
+		if text == marker {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,316 @@
+package common
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// capturedEvent is the part of a LogEvent the capture tests compare
+type capturedEvent struct {
+	Stream  string
+	Level   string
+	Message string
+}
+
+func collectEvents(events <-chan LogEvent) []capturedEvent {
+	collected := make([]capturedEvent, 0)
+	for event := range events {
+		collected = append(collected, capturedEvent{Stream: event.Stream, Level: event.Level, Message: event.Message})
+	}
+	return collected
+}
+
+func TestGroupTracebacks(t *testing.T) {
+	stderr := func(text string) LogEvent {
+		return LogEvent{Stream: StreamStderr, Level: "error", Message: text}
+	}
+	traceback := []string{
+		tracebackHeader,
+		`  File "handler.py", line 10, in handler`,
+		`    raise ValueError("bad input")`,
+		`ValueError: bad input`,
+	}
+	chained := []string{
+		tracebackHeader,
+		`  File "handler.py", line 4, in load`,
+		`    return cache["model"]`,
+		`KeyError: 'model'`,
+		``,
+		chainedExceptionMarkers[0],
+		``,
+		tracebackHeader,
+		`  File "handler.py", line 10, in handler`,
+		`    model = load()`,
+		`RuntimeError: no model`,
+	}
+	long := []string{tracebackHeader}
+	for i := 0; i < maxTracebackLines+1; i++ {
+		long = append(long, fmt.Sprintf(`  File "handler.py", line %d, in handler`, i))
+	}
+
+	tests := []struct {
+		name  string
+		lines []LogEvent
+		want  []capturedEvent
+	}{
+		{
+			name:  "lines without traceback",
+			lines: []LogEvent{stderr("loading"), stderr("ready")},
+			want: []capturedEvent{
+				{Stream: StreamStderr, Level: "error", Message: "loading"},
+				{Stream: StreamStderr, Level: "error", Message: "ready"},
+			},
+		},
+		{
+			name:  "plain traceback",
+			lines: append(append([]LogEvent{stderr("before")}, events(stderr, traceback)...), stderr("after")),
+			want: []capturedEvent{
+				{Stream: StreamStderr, Level: "error", Message: "before"},
+				{Stream: StreamStderr, Level: "error", Message: strings.Join(traceback, "\n")},
+				{Stream: StreamStderr, Level: "error", Message: "after"},
+			},
+		},
+		{
+			name:  "traceback at the end of the output",
+			lines: events(stderr, traceback),
+			want: []capturedEvent{
+				{Stream: StreamStderr, Level: "error", Message: strings.Join(traceback, "\n")},
+			},
+		},
+		{
+			name:  "chained exceptions",
+			lines: append(events(stderr, chained), stderr("next job")),
+			want: []capturedEvent{
+				{Stream: StreamStderr, Level: "error", Message: strings.Join(chained, "\n")},
+				{Stream: StreamStderr, Level: "error", Message: "next job"},
+			},
+		},
+		{
+			name: "chained exception marker after the blank line is trimmed",
+			lines: append(events(stderr, traceback), stderr(""), stderr(chainedExceptionMarkers[1]), stderr(""),
+				stderr(tracebackHeader), stderr(`  File "handler.py", line 12, in handler`), stderr("TypeError: wrapped")),
+			want: []capturedEvent{
+				{Stream: StreamStderr, Level: "error", Message: strings.Join(append(append([]string{}, traceback...), "", chainedExceptionMarkers[1], "",
+					tracebackHeader, `  File "handler.py", line 12, in handler`, "TypeError: wrapped"), "\n")},
+			},
+		},
+		{
+			name: "system events interleaved with a traceback go through right away",
+			lines: []LogEvent{
+				stderr(traceback[0]), stderr(traceback[1]),
+				{Stream: StreamSystem, Level: "info", Message: "Running command: python handler.py"},
+				stderr(traceback[2]), stderr(traceback[3]),
+			},
+			want: []capturedEvent{
+				{Stream: StreamSystem, Level: "info", Message: "Running command: python handler.py"},
+				{Stream: StreamStderr, Level: "error", Message: strings.Join(traceback, "\n")},
+			},
+		},
+		{
+			name:  "output interleaved after the exception line ends the traceback",
+			lines: append(events(stderr, traceback), stderr("INFO | job-1 | Finished"), stderr(tracebackHeader), stderr("  File \"x.py\""), stderr("OSError: disk")),
+			want: []capturedEvent{
+				{Stream: StreamStderr, Level: "error", Message: strings.Join(traceback, "\n")},
+				{Stream: StreamStderr, Level: "error", Message: "INFO | job-1 | Finished"},
+				{Stream: StreamStderr, Level: "error", Message: tracebackHeader + "\n  File \"x.py\"\nOSError: disk"},
+			},
+		},
+		{
+			name:  "traceback over the line limit is split",
+			lines: events(stderr, long),
+			want: []capturedEvent{
+				{Stream: StreamStderr, Level: "error", Message: strings.Join(long[:maxTracebackLines], "\n")},
+				{Stream: StreamStderr, Level: "error", Message: long[maxTracebackLines]},
+				{Stream: StreamStderr, Level: "error", Message: long[maxTracebackLines+1]},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			lines := make(chan LogEvent, len(test.lines))
+			for _, line := range test.lines {
+				lines <- line
+			}
+			close(lines)
+
+			logBuffer := make(chan LogEvent, len(test.lines)+1)
+			tail := &logTail{}
+			groupTracebacks(lines, logBuffer, tail)
+			close(logBuffer)
+
+			got := collectEvents(logBuffer)
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("groupTracebacks() sent\n%q\nwant\n%q", got, test.want)
+			}
+			if last := tail.snapshot(); len(got) > 0 && last[len(last)-1] != got[len(got)-1].Message {
+				t.Errorf("the tail ends with %q, want the last event", last[len(last)-1])
+			}
+		})
+	}
+}
+
+func events(event func(string) LogEvent, lines []string) []LogEvent {
+	converted := make([]LogEvent, 0, len(lines))
+	for _, line := range lines {
+		converted = append(converted, event(line))
+	}
+	return converted
+}
+
+func TestGroupTracebacksKeepsTheTimeOfTheFirstLine(t *testing.T) {
+	started := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	lines := make(chan LogEvent, 3)
+	lines <- LogEvent{Stream: StreamStderr, Message: tracebackHeader, Time: started}
+	lines <- LogEvent{Stream: StreamStderr, Message: "  File \"handler.py\"", Time: started.Add(time.Second)}
+	lines <- LogEvent{Stream: StreamStderr, Message: "ValueError: bad", Time: started.Add(2 * time.Second)}
+
+	logBuffer := make(chan LogEvent, 1)
+	done := make(chan struct{})
+	go func() {
+		groupTracebacks(lines, logBuffer, nil)
+		close(done)
+	}()
+
+	// the traceback is sent once no chained exception followed it for tracebackIdle, without closing lines
+	select {
+	case event := <-logBuffer:
+		if !event.Time.Equal(started) || event.Level != "error" {
+			t.Errorf("traceback event at %s with level %s, want %s and error", event.Time, event.Level, started)
+		}
+	case <-time.After(10 * tracebackIdle):
+		t.Fatal("the traceback was not sent after tracebackIdle")
+	}
+	close(lines)
+	<-done
+}
+
+func TestReadLines(t *testing.T) {
+	tests := []struct {
+		name      string
+		stream    string
+		maxLength string
+		output    string
+		want      []capturedEvent
+	}{
+		{
+			name:   "stdout lines",
+			stream: StreamStdout,
+			output: "first\nsecond\n",
+			want: []capturedEvent{
+				{Stream: StreamStdout, Level: "info", Message: "first"},
+				{Stream: StreamStdout, Level: "info", Message: "second"},
+			},
+		},
+		{
+			name:   "stderr lines are errors, CRLF and a missing last newline are handled",
+			stream: StreamStderr,
+			output: "first\r\n\nlast",
+			want: []capturedEvent{
+				{Stream: StreamStderr, Level: "error", Message: "first"},
+				{Stream: StreamStderr, Level: "error", Message: ""},
+				{Stream: StreamStderr, Level: "error", Message: "last"},
+			},
+		},
+		{
+			name:      "over-long line is cut and the rest dropped",
+			stream:    StreamStdout,
+			maxLength: "16",
+			output:    strings.Repeat("a", 16) + strings.Repeat("b", 40) + "\nnext\n",
+			want: []capturedEvent{
+				{Stream: StreamStdout, Level: "info", Message: strings.Repeat("a", 16) + defaultTruncationMarker},
+				{Stream: StreamStdout, Level: "info", Message: "next"},
+			},
+		},
+		{
+			name:      "line of exactly the limit is not cut",
+			stream:    StreamStdout,
+			maxLength: "16",
+			output:    strings.Repeat("a", 16) + "\nnext\n",
+			want: []capturedEvent{
+				{Stream: StreamStdout, Level: "info", Message: strings.Repeat("a", 16)},
+				{Stream: StreamStdout, Level: "info", Message: "next"},
+			},
+		},
+		{
+			name:      "secret cut by the limit is masked whole",
+			stream:    StreamStdout,
+			maxLength: "32",
+			output:    "calling with hf_" + strings.Repeat("x", 40) + " and more\n",
+			want: []capturedEvent{
+				{Stream: StreamStdout, Level: "info", Message: "calling with " + RedactedMarker + " and more"},
+			},
+		},
+		{
+			name:      "secret past the limit is masked before the cut",
+			stream:    StreamStdout,
+			maxLength: "16",
+			output:    "token hf_" + strings.Repeat("x", 40) + " trailing text\n",
+			want: []capturedEvent{
+				{Stream: StreamStdout, Level: "info", Message: "token " + RedactedMarker + defaultTruncationMarker},
+			},
+		},
+		{
+			name:      "multi-byte rune cut at the limit is dropped",
+			stream:    StreamStdout,
+			maxLength: "16",
+			output:    strings.Repeat("a", 15) + "é" + strings.Repeat("b", 20) + "\n",
+			want: []capturedEvent{
+				{Stream: StreamStdout, Level: "info", Message: strings.Repeat("a", 15) + defaultTruncationMarker},
+			},
+		},
+		{
+			name:      "multi-byte rune that fits is kept",
+			stream:    StreamStdout,
+			maxLength: "16",
+			output:    strings.Repeat("a", 14) + "é" + strings.Repeat("b", 20) + "\n",
+			want: []capturedEvent{
+				{Stream: StreamStdout, Level: "info", Message: strings.Repeat("a", 14) + "é" + defaultTruncationMarker},
+			},
+		},
+		{
+			name:      "four-byte rune cut after its second byte",
+			stream:    StreamStdout,
+			maxLength: "16",
+			output:    strings.Repeat("a", 14) + "😀" + "\n",
+			want: []capturedEvent{
+				{Stream: StreamStdout, Level: "info", Message: strings.Repeat("a", 14) + defaultTruncationMarker},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("RUNPOD_LOG_MAX_LINE_LENGTH", test.maxLength)
+			t.Setenv("RUNPOD_LOG_TRUNCATION_MARKER", "")
+
+			lines := make(chan LogEvent, 16)
+			readLines(test.stream, strings.NewReader(test.output), lines)
+			close(lines)
+
+			if got := collectEvents(lines); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("readLines() sent\n%q\nwant\n%q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestTrimPartialRune(t *testing.T) {
+	tests := []struct {
+		line string
+		want string
+	}{
+		{line: "", want: ""},
+		{line: "ascii", want: "ascii"},
+		{line: "é", want: "é"},
+		{line: "a" + "é"[:1], want: "a"},
+		{line: "a" + "😀"[:3], want: "a"},
+		{line: "a😀", want: "a😀"},
+	}
+	for _, test := range tests {
+		if got := string(trimPartialRune([]byte(test.line))); got != test.want {
+			t.Errorf("trimPartialRune(%q) = %q, want %q", test.line, got, test.want)
+		}
+	}
+}
@@ -1,170 +1,185 @@
 package common
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
+	"sync"
+	"syscall"
 	"time"
 
 	"go.uber.org/zap"
 )
 
+// RunCommand runs the command until it exits, the handler is supervised and restarted according to
+// RUNPOD_RESTART_POLICY. The run is reported as failed once the command is not started again.
 func RunCommand(command string, ide bool, log *zap.Logger) error {
 	// Create a buffered channel for logs
-	logBuffer := make(chan string, 1024)
+	logBuffer := make(chan LogEvent, 1024)
 	defer close(logBuffer)
+	go ForwardLogs(logBuffer, log)
 
-	logBuffer <- fmt.Sprintf("Running command: %s", command)
-
-	log.Info("Running command", zap.String("command", command))
-	// Split the command string into command and arguments
-	cmd := exec.Command("sh", "-c", command)
-	cmd.Env = append(os.Environ(), "RUNPOD_LOG_LEVEL=INFO")
+	var err error
+	var exit *ProcessExit
+	reason := ""
 	if ide {
-		cmd.Env = append(cmd.Env, "PASSWORD=runpod")
-		cmd.Env = append(cmd.Env, "AI_API_REDIS_ADDR=127.0.0.1:6379")
-		cmd.Env = append(cmd.Env, "AGENT_REDIS_ADDR=127.0.0.1:6379")
-		cmd.Env = append(cmd.Env, "AI_API_REDIS_PASS=")
-		cmd.Env = append(cmd.Env, "HOST_ACCESS_TOKEN=test")
-		cmd.Env = append(cmd.Env, "ENV=local")
+		exit, err = runProcess(command, ide, logBuffer, nil, log)
 	} else {
-		cmd.Env = append(cmd.Env, "RUNPOD_ENDPOINT_BASE_URL=http://0.0.0.0:80/v2/IDE")
-		cmd.Env = append(cmd.Env, "RUNPOD_WEBHOOK_GET_JOB=http://0.0.0.0:80/v2/IDE/job-take/$RUNPOD_POD_ID")
-		cmd.Env = append(cmd.Env, "RUNPOD_WEBHOOK_POST_OUTPUT=http://0.0.0.0:80/v2/IDE/job-done/$RUNPOD_POD_ID/$ID?gpu=$RUNPOD_GPU_TYPE_ID")
-		cmd.Env = append(cmd.Env, "AI_API_REDIS_ADDR=127.0.0.1:6379")
-		cmd.Env = append(cmd.Env, "AGENT_REDIS_ADDR=127.0.0.1:6379")
-		cmd.Env = append(cmd.Env, "AI_API_REDIS_PASS=")
-		cmd.Env = append(cmd.Env, "HOST_ACCESS_TOKEN=test")
-		cmd.Env = append(cmd.Env, "ENV=local")
-	}
-
-	// Create pipes for stdout and stderr
-	stdout, err := cmd.StdoutPipe()
-	if err != nil {
-		logBuffer <- fmt.Sprintf("Failed to create stdout pipe: %s", err.Error())
-		log.Error("Failed to create stdout pipe", zap.Error(err))
-		return err
-	}
-	stderr, err := cmd.StderrPipe()
-	if err != nil {
-		logBuffer <- fmt.Sprintf("Failed to create stderr pipe: %s", err.Error())
-		log.Error("Failed to create stderr pipe", zap.Error(err))
-		return err
+		reason, exit, err = superviseCommand(command, logBuffer, log)
 	}
 
-	err = cmd.Start()
-	if err != nil {
-		logBuffer <- fmt.Sprintf("Failed to start command: %s", err.Error())
+	var startErr *commandStartError
+	if errors.As(err, &startErr) {
 		errorMsg := fmt.Sprintf("Failed to start command: %s", err.Error())
-		SendResultsToGraphQL("FAILED", &errorMsg, log, []Result{
+		CommandFailed(errorMsg, []Result{
 			{
 				ID:     0,
 				Name:   "initialization",
 				Error:  err.Error(),
 				Status: "ERROR",
 			},
-		})
+		}, log)
 		fmt.Println("Failed to start command: ", err.Error())
 		log.Error("Failed to start command", zap.Error(err))
 		return err
 	}
 
-	go SendLogsToTinyBird(logBuffer, log)
-
-	// Start goroutines to continuously read from pipes
-	go func() {
-		buf := make([]byte, 1024)
-		notAdded := true
-		for {
-			n, err := stdout.Read(buf)
-			if n > 0 {
-				// log.Info("Command stdout", zap.ByteString("output", buf[:n]))
-				fmt.Println("INFO: ", string(buf[:n]))
-
-				// Add log to buffer channel
-				select {
-				case logBuffer <- string(buf[:n]):
-					// Log added to buffer
-				default:
-					// Channel full, log discarded
-					log.Warn("Log buffer full, discarding log")
-				}
-
-			}
-			if err != nil {
-				if notAdded {
-					logBuffer <- fmt.Sprintf("Failed to read stdout: %s", err.Error())
-					notAdded = false
-				}
-				time.Sleep(time.Duration(1) * time.Second)
-				continue
-			}
+	if err != nil {
+		closed := err.Error()
+		if isExitError(err) {
+			closed = exit.Summary()
 		}
-	}()
-
-	go func() {
-		buf := make([]byte, 1024)
-		notAdded := true
-		for {
-			n, err := stderr.Read(buf)
-			if n > 0 {
-				fmt.Println("ERROR: ", string(buf[:n]))
-
-				// Add log to buffer channel
-				select {
-				case logBuffer <- fmt.Sprintf("#ERROR: %s", string(buf[:n])):
-					// Log added to buffer
-				default:
-					// Channel full, log discarded
-					log.Warn("Log buffer full, discarding log")
-				}
-
-			}
-			if err != nil {
-				if notAdded {
-					logBuffer <- fmt.Sprintf("Failed to read stderrr: %s", err.Error())
-					notAdded = false
-				}
-				time.Sleep(time.Duration(1) * time.Second)
-				continue
-			}
+		errorMsg := fmt.Sprintf("Command closed: %s", closed)
+		if reason != "" {
+			errorMsg = fmt.Sprintf("Command closed: %s, %s", closed, reason)
 		}
-	}()
-
-	if err := cmd.Wait(); err != nil {
-		errorMsg := fmt.Sprintf("Command closed: %s", err.Error())
 		fmt.Println("Command closed: ", errorMsg)
-		SendResultsToGraphQL("FAILED", &errorMsg, log, []Result{
+		CommandFailed(errorMsg, []Result{
 			{
 				ID:     0,
 				Name:   "initialization",
-				Error:  err.Error(),
+				Error:  closed,
 				Status: "ERROR",
+				Exit:   exit,
 			},
-		})
+		}, log)
 		return nil
 	}
 
 	errorMsg := "Command closed. Please view the logs for more information."
-	SendResultsToGraphQL("FAILED", &errorMsg, log,
+	if reason != "" {
+		errorMsg = fmt.Sprintf("Command closed, %s. Please view the logs for more information.", reason)
+	}
+	CommandFailed(errorMsg,
 		[]Result{
 			{
 				ID:     0,
 				Name:   "initialization",
 				Error:  errorMsg,
 				Status: "ERROR",
+				Exit:   exit,
 			},
 		},
+		log,
 	)
 
 	return nil
 }
 
+// runProcess starts the command and waits for it to exit while its output goes to logBuffer, and to tail when it
+// is set. It returns how the command ended and the error of the exit, or a commandStartError when the command
+// could not be started.
+func runProcess(command string, ide bool, logBuffer chan<- LogEvent, tail *logTail, log *zap.Logger) (*ProcessExit, error) {
+	logBuffer <- newLogEvent(StreamSystem, "info", fmt.Sprintf("Running command: %s", command))
+
+	log.Info("Running command", zap.String("command", command))
+	// Split the command string into command and arguments
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Env = append(os.Environ(), "RUNPOD_LOG_LEVEL=INFO")
+	if ide {
+		cmd.Env = append(cmd.Env, "PASSWORD=runpod")
+		cmd.Env = append(cmd.Env, "AI_API_REDIS_ADDR=127.0.0.1:6379")
+		cmd.Env = append(cmd.Env, "AGENT_REDIS_ADDR=127.0.0.1:6379")
+		cmd.Env = append(cmd.Env, "AI_API_REDIS_PASS=")
+		cmd.Env = append(cmd.Env, "HOST_ACCESS_TOKEN=test")
+		cmd.Env = append(cmd.Env, "ENV=local")
+	} else {
+		cmd.Env = append(cmd.Env, "RUNPOD_ENDPOINT_BASE_URL=http://0.0.0.0:80/v2/IDE")
+		cmd.Env = append(cmd.Env, "RUNPOD_WEBHOOK_GET_JOB=http://0.0.0.0:80/v2/IDE/job-take/$RUNPOD_POD_ID?gpu=$RUNPOD_GPU_TYPE_ID")
+		cmd.Env = append(cmd.Env, "RUNPOD_WEBHOOK_POST_OUTPUT=http://0.0.0.0:80/v2/IDE/job-done/$RUNPOD_POD_ID/$ID?gpu=$RUNPOD_GPU_TYPE_ID")
+		cmd.Env = append(cmd.Env, "RUNPOD_WEBHOOK_POST_STREAM=http://0.0.0.0:80/v2/IDE/job-stream/$RUNPOD_POD_ID/$ID?gpu=$RUNPOD_GPU_TYPE_ID")
+		cmd.Env = append(cmd.Env, "AI_API_REDIS_ADDR=127.0.0.1:6379")
+		cmd.Env = append(cmd.Env, "AGENT_REDIS_ADDR=127.0.0.1:6379")
+		cmd.Env = append(cmd.Env, "AI_API_REDIS_PASS=")
+		cmd.Env = append(cmd.Env, "HOST_ACCESS_TOKEN=test")
+		cmd.Env = append(cmd.Env, "ENV=local")
+	}
+	// run the command in its own process group so stopCommands also stops the processes it started
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	// Unlike StdoutPipe, Wait copies everything the command printed to these pipes before returning,
+	// so the last lines before a crash are not lost
+	stdout, stdoutWriter := io.Pipe()
+	stderr, stderrWriter := io.Pipe()
+	cmd.Stdout = stdoutWriter
+	cmd.Stderr = stderrWriter
+	cmd.WaitDelay = outputWaitDelay
+
+	oomKills, _ := cgroupOOMKills()
+	started := time.Now()
+	tracked, err := startCommand(cmd)
+	if err != nil {
+		if isCommandStopping() {
+			select {}
+		}
+		logBuffer <- newLogEvent(StreamSystem, "error", fmt.Sprintf("Failed to start command: %s", err.Error()))
+		return nil, &commandStartError{err: err}
+	}
+
+	// Read the output line by line until the command exits
+	var readers sync.WaitGroup
+	readers.Add(2)
+	go func() {
+		defer readers.Done()
+		captureOutput(StreamStdout, stdout, logBuffer, tail)
+	}()
+	go func() {
+		defer readers.Done()
+		captureOutput(StreamStderr, stderr, logBuffer, tail)
+	}()
+
+	stopSampling := func() {}
+	if !ide {
+		stopSampling = startResourceSampling(cmd.Process.Pid)
+	}
+
+	err = cmd.Wait()
+	exit := newProcessExit(cmd.ProcessState, started, time.Now(), oomKills)
+	stopSampling()
+	stdoutWriter.Close()
+	stderrWriter.Close()
+	readers.Wait()
+	tracked.finished()
+	if isCommandStopping() {
+		// the command was stopped on purpose, stopCommands' caller is exiting
+		select {}
+	}
+
+	message := fmt.Sprintf("Command %s after %s, peak RSS %s, CPU time %s", exit.Summary(), time.Duration(exit.WallTime)*time.Millisecond,
+		formatBytes(exit.PeakRSS), time.Duration(exit.UserCPUTime+exit.SystemCPUTime)*time.Millisecond)
+	logBuffer <- newLogEvent(StreamSystem, "info", message)
+	log.Info("Command exited", zap.Int("exitCode", exit.ExitCode), zap.String("signal", exit.Signal), zap.Bool("oomKilled", exit.OOMKilled),
+		zap.Int64("peakRss", exit.PeakRSS), zap.Int64("wallTime", exit.WallTime))
+	return exit, err
+}
+
 func RunAiApiCommand(command string, ide bool, log *zap.Logger) error {
 	// Create a buffered channel for logs
-	logBuffer := make(chan string, 1024)
+	logBuffer := make(chan LogEvent, 1024)
 	defer close(logBuffer)
-	logBuffer <- fmt.Sprintf("Running command: %s", command)
+	logBuffer <- newLogEvent(StreamSystem, "info", fmt.Sprintf("Running command: %s", command))
 
 	log.Info("Running command", zap.String("command", command))
 	// Split the command string into command and arguments
@@ -179,104 +194,70 @@ func RunAiApiCommand(command string, ide bool, log *zap.Logger) error {
 		cmd.Env = append(cmd.Env, "ENV=local")
 	} else {
 		cmd.Env = append(cmd.Env, "RUNPOD_ENDPOINT_BASE_URL=http://0.0.0.0:80/v2/IDE")
-		cmd.Env = append(cmd.Env, "RUNPOD_WEBHOOK_GET_JOB=http://0.0.0.0:80/v2/IDE/job-take/$RUNPOD_POD_ID")
+		cmd.Env = append(cmd.Env, "RUNPOD_WEBHOOK_GET_JOB=http://0.0.0.0:80/v2/IDE/job-take/$RUNPOD_POD_ID?gpu=$RUNPOD_GPU_TYPE_ID")
 		cmd.Env = append(cmd.Env, "RUNPOD_WEBHOOK_POST_OUTPUT=http://0.0.0.0:80/v2/IDE/job-done/$RUNPOD_POD_ID/$ID?gpu=$RUNPOD_GPU_TYPE_ID")
+		cmd.Env = append(cmd.Env, "RUNPOD_WEBHOOK_POST_STREAM=http://0.0.0.0:80/v2/IDE/job-stream/$RUNPOD_POD_ID/$ID?gpu=$RUNPOD_GPU_TYPE_ID")
 		cmd.Env = append(cmd.Env, "AI_API_REDIS_ADDR=127.0.0.1:6379")
 		cmd.Env = append(cmd.Env, "AGENT_REDIS_ADDR=127.0.0.1:6379")
 		cmd.Env = append(cmd.Env, "AI_API_REDIS_PASS=")
 		cmd.Env = append(cmd.Env, "HOST_ACCESS_TOKEN=test")
 		cmd.Env = append(cmd.Env, "ENV=local")
 	}
+	// run the command in its own process group so stopCommands also stops the processes it started
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
 
-	// Create pipes for stdout and stderr
-	stdout, err := cmd.StdoutPipe()
-	if err != nil {
-		logBuffer <- fmt.Sprintf("Failed to create stdout pipe: %s", err.Error())
-		log.Error("Failed to create stdout pipe", zap.Error(err))
-		return err
-	}
-	stderr, err := cmd.StderrPipe()
-	if err != nil {
-		logBuffer <- fmt.Sprintf("Failed to create stderr pipe: %s", err.Error())
-		log.Error("Failed to create stderr pipe", zap.Error(err))
-		return err
-	}
+	// Unlike StdoutPipe, Wait copies everything the command printed to these pipes before returning,
+	// so the last lines before a crash are not lost
+	stdout, stdoutWriter := io.Pipe()
+	stderr, stderrWriter := io.Pipe()
+	cmd.Stdout = stdoutWriter
+	cmd.Stderr = stderrWriter
+	cmd.WaitDelay = outputWaitDelay
 
-	err = cmd.Start()
+	tracked, err := startCommand(cmd)
 	if err != nil {
-		logBuffer <- fmt.Sprintf("Failed to start command: %s", err.Error())
+		if isCommandStopping() {
+			select {}
+		}
+		logBuffer <- newLogEvent(StreamSystem, "error", fmt.Sprintf("Failed to start command: %s", err.Error()))
 		errorMsg := fmt.Sprintf("Failed to start command: %s", err.Error())
-		SendResultsToGraphQL("FAILED", &errorMsg, log, []Result{})
+		CommandFailed(errorMsg, []Result{}, log)
 		fmt.Println("Failed to start command: ", err.Error())
 		log.Error("Failed to start command", zap.Error(err))
 		return err
 	}
+	go ForwardLogs(logBuffer, log)
 
-	go SendLogsToTinyBird(logBuffer, log)
-
-	// Start goroutines to continuously read from pipes
+	// Read the output line by line until the command exits
+	var readers sync.WaitGroup
+	readers.Add(2)
 	go func() {
-		buf := make([]byte, 1024)
-		notAdded := true
-		for {
-			n, err := stdout.Read(buf)
-			if n > 0 {
-				// log.Info("Command stdout", zap.ByteString("output", buf[:n]))
-				fmt.Println("INFO: ", string(buf[:n]))
-
-				// Add log to buffer channel
-				select {
-				case logBuffer <- string(buf[:n]):
-					// Log added to buffer
-				default:
-					// Channel full, log discarded
-					log.Warn("Log buffer full, discarding log")
-				}
-
-			}
-			if err != nil {
-				if notAdded {
-					logBuffer <- fmt.Sprintf("Failed to read stdout: %s", err.Error())
-					notAdded = false
-				}
-				time.Sleep(time.Duration(1) * time.Second)
-				continue
-			}
-		}
+		defer readers.Done()
+		captureOutput(StreamStdout, stdout, logBuffer, nil)
 	}()
-
 	go func() {
-		buf := make([]byte, 1024)
-		for {
-			n, err := stderr.Read(buf)
-			if n > 0 {
-				fmt.Println("ERROR: ", string(buf[:n]))
-
-				// Add log to buffer channel
-				select {
-				case logBuffer <- fmt.Sprintf("#ERROR: %s", string(buf[:n])):
-					// Log added to buffer
-				default:
-					// Channel full, log discarded
-					log.Warn("Log buffer full, discarding log")
-				}
-
-			}
-			if err != nil {
-				break
-			}
-		}
+		defer readers.Done()
+		captureOutput(StreamStderr, stderr, logBuffer, nil)
 	}()
 
-	if err := cmd.Wait(); err != nil {
+	err = cmd.Wait()
+	stdoutWriter.Close()
+	stderrWriter.Close()
+	readers.Wait()
+	tracked.finished()
+	if isCommandStopping() {
+		// the command was stopped on purpose, stopCommands' caller is exiting
+		select {}
+	}
+	if err != nil {
 		errorMsg := fmt.Sprintf("Command closed: %s", err.Error())
 		fmt.Println("Command closed: ", errorMsg)
-		SendResultsToGraphQL("FAILED", &errorMsg, log, []Result{})
+		CommandFailed(errorMsg, []Result{}, log)
 		return nil
 	}
 
 	errorMsg := "Command closed. Please view the logs for more information."
-	SendResultsToGraphQL("FAILED", &errorMsg, log, []Result{})
+	CommandFailed(errorMsg, []Result{}, log)
 
 	return nil
 }
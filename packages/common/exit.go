@@ -0,0 +1,162 @@
+package common
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// newProcessExit reads how the command ended and what it used from its state once Wait returned.
+// oomKillsBefore is the count of the cgroup OOM kills when the command started. The count is for the whole cgroup,
+// so the command is only reported as OOM killed when it also died by SIGKILL, the signal the OOM killer sends.
+func newProcessExit(state *os.ProcessState, started time.Time, exited time.Time, oomKillsBefore int64) *ProcessExit {
+	exit := &ProcessExit{
+		ExitCode: -1,
+		WallTime: exited.Sub(started).Milliseconds(),
+	}
+	if state == nil {
+		return exit
+	}
+
+	exit.ExitCode = state.ExitCode()
+	exit.UserCPUTime = state.UserTime().Milliseconds()
+	exit.SystemCPUTime = state.SystemTime().Milliseconds()
+	if status, ok := state.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		exit.Signal = signalName(status.Signal())
+	} else if exit.ExitCode > 128 && exit.ExitCode <= 128+64 {
+		// sh -c exits with 128 plus the signal when the last command of a compound command was killed
+		exit.Signal = signalName(syscall.Signal(exit.ExitCode - 128))
+	}
+	if usage, ok := state.SysUsage().(*syscall.Rusage); ok {
+		// Linux reports the max RSS in kilobytes
+		exit.PeakRSS = usage.Maxrss * 1024
+	}
+	if oomKills, found := cgroupOOMKills(); found && oomKills > oomKillsBefore && exit.Signal == "SIGKILL" {
+		exit.OOMKilled = true
+	}
+	return exit
+}
+
+func signalName(sig syscall.Signal) string {
+	if name := unix.SignalName(sig); name != "" {
+		return name
+	}
+	return sig.String()
+}
+
+// Summary tells in a few words how the command ended, the OOM killer first since the handler often shows up
+// as killed by SIGKILL or exiting with 137 then
+func (e *ProcessExit) Summary() string {
+	switch {
+	case e.OOMKilled:
+		return fmt.Sprintf("killed by the OOM killer, peak RSS %s", formatBytes(e.PeakRSS))
+	case e.Signal != "":
+		return fmt.Sprintf("killed by %s", e.Signal)
+	default:
+		return fmt.Sprintf("exited with code %d", e.ExitCode)
+	}
+}
+
+// Details lists the exit status and the resources of the command, one per line
+func (e *ProcessExit) Details() string {
+	lines := []string{fmt.Sprintf("Exit code: %d", e.ExitCode)}
+	if e.Signal != "" {
+		lines = append(lines, fmt.Sprintf("Signal: %s", e.Signal))
+	}
+	lines = append(lines,
+		fmt.Sprintf("OOM killed: %t", e.OOMKilled),
+		fmt.Sprintf("Peak RSS: %s", formatBytes(e.PeakRSS)),
+		fmt.Sprintf("CPU time: %s user, %s system", time.Duration(e.UserCPUTime)*time.Millisecond, time.Duration(e.SystemCPUTime)*time.Millisecond),
+		fmt.Sprintf("Wall time: %s", time.Duration(e.WallTime)*time.Millisecond),
+	)
+	return strings.Join(lines, "\n")
+}
+
+func formatBytes(bytes int64) string {
+	const unit = 1024
+	if bytes < unit {
+		return fmt.Sprintf("%d B", bytes)
+	}
+	value, suffix := float64(bytes)/unit, "KiB"
+	for _, next := range []string{"MiB", "GiB", "TiB"} {
+		if value < unit {
+			break
+		}
+		value, suffix = value/unit, next
+	}
+	return fmt.Sprintf("%.1f %s", value, suffix)
+}
+
+// cgroupFiles lists where the file of the cgroup of the server may be, the handler runs in the same one.
+// The cgroup v2 files come first, then the files of the v1 controller when it is set.
+func cgroupFiles(name string, v1Controller string) []string {
+	files := make([]string, 0)
+	v1Files := make([]string, 0)
+
+	content, _ := os.ReadFile("/proc/self/cgroup")
+	for _, line := range strings.Split(strings.TrimSpace(string(content)), "\n") {
+		// hierarchy-ID:controller-list:cgroup-path
+		parts := strings.SplitN(line, ":", 3)
+		if len(parts) != 3 {
+			continue
+		}
+		path := strings.TrimSuffix(parts[2], "/")
+		if parts[0] == "0" && parts[1] == "" && path != "" {
+			files = append(files, "/sys/fs/cgroup"+path+"/"+name, "/sys/fs/cgroup/unified"+path+"/"+name)
+		}
+		for _, controller := range strings.Split(parts[1], ",") {
+			if v1Controller != "" && controller == v1Controller && path != "" {
+				v1Files = append(v1Files, "/sys/fs/cgroup/"+v1Controller+path+"/"+name)
+			}
+		}
+	}
+
+	// inside a cgroup namespace the cgroup of the container is mounted as the root
+	files = append(files, "/sys/fs/cgroup/"+name, "/sys/fs/cgroup/unified/"+name)
+	if v1Controller != "" {
+		files = append(files, v1Files...)
+		files = append(files, "/sys/fs/cgroup/"+v1Controller+"/"+name)
+	}
+	return files
+}
+
+// cgroupOOMKills returns how many processes the OOM killer killed in the cgroup, and false when no cgroup file
+// has the count
+func cgroupOOMKills() (int64, bool) {
+	for _, path := range cgroupFiles("memory.events", "") {
+		if count, found := readOOMKillCount(path); found {
+			return count, true
+		}
+	}
+	for _, path := range cgroupFiles("memory.oom_control", "memory") {
+		if count, found := readOOMKillCount(path); found {
+			return count, true
+		}
+	}
+	return 0, false
+}
+
+// readOOMKillCount reads the oom_kill line of memory.events or memory.oom_control
+func readOOMKillCount(path string) (int64, bool) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, false
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && fields[0] == "oom_kill" {
+			count, err := strconv.ParseInt(fields[1], 10, 64)
+			return count, err == nil
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,245 @@
+package common
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// HTMLReporter writes the results as a single static HTML page that can be attached to a pull request
+type HTMLReporter struct {
+	Path string
+}
+
+type htmlReport struct {
+	Status      string
+	ErrorReason string
+	GeneratedAt string
+	Total       int
+	Passed      int
+	Failed      int
+	TotalTime   string
+	DroppedLogs int64
+	Memory      string
+	Restarts    []Restart
+	Tests       []htmlTest
+}
+
+type htmlTest struct {
+	Result
+	Message     string
+	Details     string
+	InputJSON   string
+	OutputJSON  string
+	Process     string
+	Resources   string
+	PeakRSS     int64
+	PeakRSSText string
+	Mismatches  []Mismatch
+	Logs        []string
+}
+
+func (r *HTMLReporter) Name() string {
+	return "html"
+}
+
+// Report renders a summary, a sortable table of the results and, for every test, its input, output,
+// error, the mismatches with what the test expected and the handler logs captured while it was running.
+func (r *HTMLReporter) Report(status string, errorReason *string, results []Result, log *zap.Logger) error {
+	if !IsFinalRunStatus(status) {
+		return nil
+	}
+
+	report := htmlReport{
+		Status:      status,
+		GeneratedAt: time.Now().UTC().Format(time.RFC3339),
+		Total:       len(results),
+		DroppedLogs: DroppedLogLines(),
+		Memory:      MemoryWarning(results),
+		Restarts:    HandlerRestarts(),
+		Tests:       make([]htmlTest, 0, len(results)),
+	}
+	if errorReason != nil {
+		report.ErrorReason = *errorReason
+	}
+
+	var totalTime int64
+	for _, result := range results {
+		test := htmlTest{
+			Result:     result,
+			InputJSON:  prettyJSON(result.Input),
+			OutputJSON: prettyJSON(result.Output),
+			Logs:       result.Logs,
+		}
+		if result.Exit != nil {
+			test.Process = result.Exit.Details()
+		}
+		if result.Resources != nil {
+			test.Resources = result.Resources.Details()
+			test.PeakRSS = int64(result.Resources.RSS.Max)
+			test.PeakRSSText = formatBytes(test.PeakRSS)
+		}
+		if result.Load != nil {
+			test.OutputJSON = prettyJSON(result.Load)
+		}
+		if result.Status == "COMPLETED" {
+			report.Passed++
+		} else {
+			report.Failed++
+			test.Message, test.Details = describeResultError(result.Error)
+			if failure, ok := result.Error.(Failure); ok {
+				test.Mismatches = failure.Mismatches
+				test.Details = ""
+			}
+		}
+		totalTime += result.ExecutionTime
+		report.Tests = append(report.Tests, test)
+	}
+	report.TotalTime = fmt.Sprintf("%.3fs", float64(totalTime)/1000)
+
+	page, err := template.New("report").Funcs(template.FuncMap{
+		"json": prettyJSON,
+	}).Parse(htmlReportTemplate)
+	if err != nil {
+		return fmt.Errorf("failed to parse the HTML template: %w", err)
+	}
+
+	if dir := filepath.Dir(r.Path); dir != "" {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return fmt.Errorf("failed to create %s: %w", dir, err)
+		}
+	}
+	file, err := os.Create(r.Path)
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %w", r.Path, err)
+	}
+	defer file.Close()
+
+	if err := page.Execute(file, report); err != nil {
+		return fmt.Errorf("failed to render %s: %w", r.Path, err)
+	}
+
+	log.Info("Results written to HTML file", zap.String("path", r.Path))
+	return nil
+}
+
+// prettyJSON indents the value for display, the template takes care of escaping it
+func prettyJSON(value interface{}) string {
+	if value == nil {
+		return ""
+	}
+
+	var buffer bytes.Buffer
+	encoder := json.NewEncoder(&buffer)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(value); err != nil {
+		return fmt.Sprintf("%v", value)
+	}
+	return strings.TrimSuffix(buffer.String(), "\n")
+}
+
+const htmlReportTemplate = `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>Test report</title>
+<style>
+body { font-family: -apple-system, "Segoe UI", Helvetica, Arial, sans-serif; margin: 2rem; color: #1f2328; }
+h1 { margin-bottom: 0.25rem; }
+.meta { color: #59636e; margin-bottom: 1.5rem; }
+.summary { display: flex; gap: 1rem; margin-bottom: 1.5rem; }
+.summary div { border: 1px solid #d1d9e0; border-radius: 6px; padding: 0.75rem 1.25rem; }
+.summary strong { display: block; font-size: 1.5rem; }
+table { border-collapse: collapse; width: 100%; }
+th, td { border-bottom: 1px solid #d1d9e0; padding: 0.5rem; text-align: left; vertical-align: top; }
+th { background: #f6f8fa; }
+#results > thead th { cursor: pointer; user-select: none; }
+#results > thead th::after { content: " \2195"; color: #8c959f; }
+.COMPLETED { color: #1a7f37; font-weight: 600; }
+.FAILED, .ERROR { color: #d1242f; font-weight: 600; }
+pre { background: #f6f8fa; padding: 0.5rem; overflow-x: auto; max-height: 30rem; white-space: pre-wrap; word-break: break-word; }
+h4 { margin: 0.75rem 0 0.25rem; }
+</style>
+</head>
+<body>
+<h1>Test report</h1>
+<div class="meta">Status <span class="{{if eq .Status "PASSED"}}COMPLETED{{else}}FAILED{{end}}">{{.Status}}</span> &middot; generated {{.GeneratedAt}}{{if .ErrorReason}} &middot; {{.ErrorReason}}{{end}}{{if .DroppedLogs}} &middot; {{.DroppedLogs}} handler log lines were dropped{{end}}</div>
+{{if .Memory}}<div class="meta FAILED">{{.Memory}}</div>{{end}}
+<div class="summary">
+<div><strong>{{.Total}}</strong>tests</div>
+<div><strong class="COMPLETED">{{.Passed}}</strong>passed</div>
+<div><strong class="FAILED">{{.Failed}}</strong>failed</div>
+<div><strong>{{.TotalTime}}</strong>total time</div>
+</div>
+{{if .Restarts}}<h2>Handler restarts</h2>
+<table>
+<tr><th>#</th><th>Exit code</th><th>Started</th><th>Exited</th><th>Backoff (ms)</th><th>Last logs</th></tr>
+{{range .Restarts}}<tr>
+<td>{{.Attempt}}</td>
+<td class="{{if .ExitCode}}FAILED{{else}}COMPLETED{{end}}">{{.ExitCode}}{{if .Error}}<br><small>{{.Error}}</small>{{end}}</td>
+<td>{{.Started.Format "15:04:05.000"}}</td>
+<td>{{.Exited.Format "15:04:05.000"}}</td>
+<td>{{.Backoff}}</td>
+<td>{{if .LastLogs}}<details><summary>Show</summary><pre>{{range .LastLogs}}{{.}}
+{{end}}</pre></details>{{end}}</td>
+</tr>
+{{end}}</table>
+<h2>Tests</h2>
+{{end}}<table id="results">
+<thead>
+<tr><th data-type="number">#</th><th>Name</th><th>Status</th><th data-type="number">Time (ms)</th><th data-type="number">Queue delay (ms)</th><th data-type="number">Peak RSS</th><th>Details</th></tr>
+</thead>
+<tbody>
+{{range .Tests}}<tr>
+<td data-value="{{.ID}}">{{.ID}}</td>
+<td data-value="{{.Name}}">{{.Name}}{{if .Source}}<br><small>{{.Source}}</small>{{end}}{{if .Redacted}}<br><small>secrets redacted</small>{{end}}</td>
+<td data-value="{{.Status}}" class="{{.Status}}">{{.Status}}</td>
+<td data-value="{{.ExecutionTime}}">{{.ExecutionTime}}</td>
+<td data-value="{{.DelayTime}}">{{.DelayTime}}</td>
+<td data-value="{{.PeakRSS}}">{{.PeakRSSText}}</td>
+<td><details{{if ne .Status "COMPLETED"}} open{{end}}>
+<summary>{{if .Message}}{{.Message}}{{else}}Show{{end}}</summary>
+{{if .InputJSON}}<h4>Input</h4><pre>{{.InputJSON}}</pre>{{end}}
+{{if .OutputJSON}}<h4>Output</h4><pre>{{.OutputJSON}}</pre>{{end}}
+{{if .Details}}<h4>Error</h4><pre>{{.Details}}</pre>{{end}}
+{{if .Process}}<h4>Process</h4><pre>{{.Process}}</pre>{{end}}
+{{if .Resources}}<h4>Resources</h4><pre>{{.Resources}}</pre>{{end}}
+{{if .Mismatches}}<h4>Differences</h4>
+<table>
+<tr><th>Path</th><th>Expected</th><th>Actual</th><th>Message</th></tr>
+{{range .Mismatches}}<tr><td><code>{{.Path}}</code></td><td><pre>{{json .Expected}}</pre></td><td><pre>{{json .Actual}}</pre></td><td>{{.Message}}</td></tr>
+{{end}}</table>{{end}}
+{{if .Logs}}<h4>Logs</h4><pre>{{range .Logs}}{{.}}
+{{end}}</pre>{{end}}
+</details></td>
+</tr>
+{{end}}</tbody>
+</table>
+<script>
+document.querySelectorAll("#results > thead th").forEach(function (header, column) {
+  var ascending = true;
+  header.addEventListener("click", function () {
+    var body = document.querySelector("#results > tbody");
+    var rows = Array.prototype.slice.call(body.rows);
+    var numeric = header.dataset.type === "number";
+    rows.sort(function (a, b) {
+      var x = a.cells[column].dataset.value || "", y = b.cells[column].dataset.value || "";
+      var order = numeric ? Number(x) - Number(y) : x.localeCompare(y);
+      return ascending ? order : -order;
+    });
+    ascending = !ascending;
+    rows.forEach(function (row) { body.appendChild(row); });
+  });
+});
+</script>
+</body>
+</html>
+`
@@ -0,0 +1,209 @@
+package common
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// JUnitReporter writes the results as a JUnit XML file so CI systems can display them
+type JUnitReporter struct {
+	Path string
+}
+
+type junitTestSuites struct {
+	XMLName  xml.Name         `xml:"testsuites"`
+	Name     string           `xml:"name,attr"`
+	Tests    int              `xml:"tests,attr"`
+	Failures int              `xml:"failures,attr"`
+	Errors   int              `xml:"errors,attr"`
+	Time     string           `xml:"time,attr"`
+	Suites   []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name      string          `xml:"name,attr"`
+	Tests     int             `xml:"tests,attr"`
+	Failures  int             `xml:"failures,attr"`
+	Errors    int             `xml:"errors,attr"`
+	Time      string          `xml:"time,attr"`
+	Timestamp string          `xml:"timestamp,attr"`
+	Cases     []junitTestCase `xml:"testcase"`
+	SystemErr string          `xml:"system-err,omitempty"`
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+	Error     *junitFailure `xml:"error,omitempty"`
+	SystemOut string        `xml:"system-out,omitempty"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Type    string `xml:"type,attr,omitempty"`
+	Details string `xml:",chardata"`
+}
+
+func (r *JUnitReporter) Name() string {
+	return "junit"
+}
+
+// Report maps every result to a testcase. FAILED results become failures, ERROR results errors,
+// and the handler logs captured while the test was running go to system-out. The restarts of the handler
+// go to the system-err of the suite, after the warning of a growing RSS.
+func (r *JUnitReporter) Report(status string, errorReason *string, results []Result, log *zap.Logger) error {
+	if !IsFinalRunStatus(status) {
+		return nil
+	}
+
+	suite := junitTestSuite{
+		Name:      "runpod",
+		Timestamp: time.Now().UTC().Format("2006-01-02T15:04:05"),
+		Cases:     make([]junitTestCase, 0, len(results)),
+	}
+
+	var totalTime int64
+	for _, result := range results {
+		testCase := junitTestCase{
+			Name:      junitCaseName(result),
+			ClassName: junitClassName(result),
+			Time:      junitSeconds(result.ExecutionTime),
+			SystemOut: strings.Join(result.Logs, "\n"),
+		}
+		totalTime += result.ExecutionTime
+
+		switch result.Status {
+		case "FAILED":
+			message, details := describeResultError(result.Error)
+			testCase.Failure = &junitFailure{Message: message, Type: "FAILED", Details: details}
+			suite.Failures++
+		case "ERROR":
+			message, details := describeResultError(result.Error)
+			if result.Exit != nil {
+				details = strings.TrimSpace(details + "\n" + result.Exit.Details())
+			}
+			testCase.Error = &junitFailure{Message: message, Type: "ERROR", Details: details}
+			suite.Errors++
+		}
+
+		suite.Cases = append(suite.Cases, testCase)
+	}
+
+	// a run that failed before any test could report is still visible in the CI
+	if len(results) == 0 && status != RunPassed {
+		message := "The test run failed."
+		if errorReason != nil {
+			message = *errorReason
+		}
+		suite.Cases = append(suite.Cases, junitTestCase{
+			Name:      "initialization",
+			ClassName: "runpod",
+			Time:      junitSeconds(0),
+			Error:     &junitFailure{Message: message, Type: "ERROR"},
+		})
+		suite.Errors++
+	}
+
+	restarts := make([]string, 0)
+	if warning := MemoryWarning(results); warning != "" {
+		restarts = append(restarts, warning)
+	}
+	for _, restart := range HandlerRestarts() {
+		restarts = append(restarts, restart.Summary())
+		for _, line := range restart.LastLogs {
+			restarts = append(restarts, "  "+line)
+		}
+	}
+	suite.SystemErr = strings.Join(restarts, "\n")
+
+	suite.Tests = len(suite.Cases)
+	suite.Time = junitSeconds(totalTime)
+
+	document := junitTestSuites{
+		Name:     "runpod",
+		Tests:    suite.Tests,
+		Failures: suite.Failures,
+		Errors:   suite.Errors,
+		Time:     suite.Time,
+		Suites:   []junitTestSuite{suite},
+	}
+
+	data, err := xml.MarshalIndent(document, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal the JUnit report: %w", err)
+	}
+
+	if dir := filepath.Dir(r.Path); dir != "" {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return fmt.Errorf("failed to create %s: %w", dir, err)
+		}
+	}
+	if err := os.WriteFile(r.Path, append([]byte(xml.Header), data...), 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %w", r.Path, err)
+	}
+
+	log.Info("Results written to JUnit file", zap.String("path", r.Path))
+	return nil
+}
+
+func junitCaseName(result Result) string {
+	if result.Name != "" {
+		return result.Name
+	}
+	return fmt.Sprintf("Test %d", result.ID)
+}
+
+// junitClassName groups the test cases by the test file they come from
+func junitClassName(result Result) string {
+	if result.Source == "" {
+		return "runpod"
+	}
+	return strings.SplitN(result.Source, "#", 2)[0]
+}
+
+func junitSeconds(milliseconds int64) string {
+	return fmt.Sprintf("%.3f", float64(milliseconds)/1000)
+}
+
+// describeResultError returns a one line message and the full details of a result error
+func describeResultError(resultError interface{}) (string, string) {
+	switch e := resultError.(type) {
+	case nil:
+		return "The test failed.", ""
+	case string:
+		return firstLine(e), e
+	case Failure:
+		lines := make([]string, 0, len(e.Mismatches))
+		for _, mismatch := range e.Mismatches {
+			lines = append(lines, fmt.Sprintf("%s: %s", mismatch.Path, mismatch.Message))
+		}
+		return e.Message, strings.Join(lines, "\n")
+	default:
+		details, err := json.MarshalIndent(e, "", "  ")
+		if err != nil {
+			return "The test failed.", fmt.Sprintf("%v", e)
+		}
+		// errors reported by the runpod SDK carry their message in error_message
+		if fields, ok := e.(map[string]interface{}); ok {
+			for _, key := range []string{"error_message", "message"} {
+				if message, ok := fields[key].(string); ok && message != "" {
+					return firstLine(message), string(details)
+				}
+			}
+		}
+		return "The test failed.", string(details)
+	}
+}
+
+func firstLine(text string) string {
+	return strings.SplitN(strings.TrimSpace(text), "\n", 2)[0]
+}
@@ -0,0 +1,132 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// LocalReporting is true for test runs without a webhook. The results are then printed to the terminal
+// and the exit code of the process tells whether every test passed.
+func LocalReporting() bool {
+	return os.Getenv("RUNPOD_TEST") == "true" && os.Getenv("RUNPOD_TEST_WEBHOOK_URL") == ""
+}
+
+// ExitLocalRun stops the handler along with the processes it started and exits with code
+func ExitLocalRun(code int, log *zap.Logger) {
+	stopCommands(syscall.SIGTERM, time.Now().Add(shutdownGrace()), log)
+	Exit(code, log)
+}
+
+// Exit hands the last logs of the commands to the sinks, spools the ones that were not sent, delivers the reports
+// left in the outbox and exits the process with code. Only the first call exits, the later ones wait for it.
+func Exit(code int, log *zap.Logger) {
+	exitWithin(context.Background(), code, log)
+}
+
+// exitWithin is Exit giving up on the outbox once ctx is done
+func exitWithin(ctx context.Context, code int, log *zap.Logger) {
+	exitOnce.Do(func() {
+		drainLogs(ctx)
+		PersistLogs(log)
+		FlushOutbox(ctx, log)
+		log.Sync()
+		os.Exit(code)
+	})
+	select {}
+}
+
+// TerminalReporter prints a pass/fail table of the results
+type TerminalReporter struct{}
+
+func (r *TerminalReporter) Name() string {
+	return "terminal"
+}
+
+func (r *TerminalReporter) Report(status string, errorReason *string, results []Result, log *zap.Logger) error {
+	if !IsFinalRunStatus(status) {
+		return nil
+	}
+
+	color := useColor()
+	paint := func(code string, text string) string {
+		if !color {
+			return text
+		}
+		return "\x1b[" + code + "m" + text + "\x1b[0m"
+	}
+
+	fmt.Println()
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(writer, "#\tTEST\tRESULT\tTIME\tERROR")
+
+	passed, failed := 0, 0
+	var totalTime int64
+	for _, result := range results {
+		label := paint("31", "FAIL")
+		message := ""
+		if result.Status == "COMPLETED" {
+			label = paint("32", "PASS")
+			passed++
+		} else {
+			if result.Status == "ERROR" {
+				label = paint("31", "ERROR")
+			}
+			message, _ = describeResultError(result.Error)
+			failed++
+		}
+		totalTime += result.ExecutionTime
+
+		fmt.Fprintf(writer, "%d\t%s\t%s\t%.3fs\t%s\n", result.ID, junitCaseName(result), label, float64(result.ExecutionTime)/1000, truncateLine(message, 120))
+	}
+	if err := writer.Flush(); err != nil {
+		return err
+	}
+
+	summary := fmt.Sprintf("%s: %d passed, %d failed in %.3fs", status, passed, failed, float64(totalTime)/1000)
+	if status != RunPassed {
+		fmt.Println("\n" + paint("1;31", summary))
+	} else {
+		fmt.Println("\n" + paint("1;32", summary))
+	}
+	if errorReason != nil {
+		fmt.Println(paint("31", *errorReason))
+	}
+	if warning := MemoryWarning(results); warning != "" {
+		fmt.Println(paint("33", warning))
+	}
+	for _, restart := range HandlerRestarts() {
+		fmt.Println(paint("33", restart.Summary()))
+	}
+	if dropped := DroppedLogLines(); dropped > 0 {
+		fmt.Println(paint("33", fmt.Sprintf("%d handler log lines were dropped, a log spool was full or a sink rejected them", dropped)))
+	}
+	return nil
+}
+
+// useColor is false when NO_COLOR is set or stdout is not a terminal
+func useColor() bool {
+	if os.Getenv("NO_COLOR") != "" {
+		return false
+	}
+	info, err := os.Stdout.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0
+}
+
+func truncateLine(text string, limit int) string {
+	text = strings.ReplaceAll(text, "\t", " ")
+	runes := []rune(text)
+	if len(runes) <= limit {
+		return text
+	}
+	return string(runes[:limit-3]) + "..."
+}
@@ -0,0 +1,87 @@
+package common
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// FileLogSink appends the logs to an NDJSON file. Once the file reaches MaxSize it is renamed to path.1,
+// the previous path.1 to path.2 and so on, keeping at most Backups old files.
+type FileLogSink struct {
+	Path    string
+	MaxSize int
+	Backups int
+
+	file *os.File
+	size int64
+}
+
+func NewFileLogSink(path string, maxSize int, backups int) *FileLogSink {
+	return &FileLogSink{Path: path, MaxSize: maxSize, Backups: backups}
+}
+
+func (s *FileLogSink) Name() string {
+	return "file"
+}
+
+func (s *FileLogSink) Send(entries []LogEntry) error {
+	payload, err := marshalNDJSON(entries)
+	if err != nil {
+		return err
+	}
+
+	if s.file != nil && s.size > 0 && s.size+int64(len(payload)) > int64(s.MaxSize) {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+	if s.file == nil {
+		if err := s.open(); err != nil {
+			return err
+		}
+	}
+
+	n, err := s.file.Write(payload)
+	s.size += int64(n)
+	return err
+}
+
+func (s *FileLogSink) open() error {
+	if dir := filepath.Dir(s.Path); dir != "" {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return fmt.Errorf("failed to create %s: %w", dir, err)
+		}
+	}
+	file, err := os.OpenFile(s.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", s.Path, err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to read %s: %w", s.Path, err)
+	}
+	s.file = file
+	s.size = info.Size()
+	return nil
+}
+
+func (s *FileLogSink) rotate() error {
+	s.file.Close()
+	s.file = nil
+	s.size = 0
+
+	if s.Backups < 1 {
+		return os.Remove(s.Path)
+	}
+	os.Remove(fmt.Sprintf("%s.%d", s.Path, s.Backups))
+	for i := s.Backups - 1; i >= 1; i-- {
+		// a missing backup only means the file did not rotate that often yet
+		os.Rename(fmt.Sprintf("%s.%d", s.Path, i), fmt.Sprintf("%s.%d", s.Path, i+1))
+	}
+	if err := os.Rename(s.Path, s.Path+".1"); err != nil {
+		return fmt.Errorf("failed to rotate %s: %w", s.Path, err)
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+package common
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// readLogFile returns the messages of an NDJSON log file, nil when it does not exist
+func readLogFile(t *testing.T, path string) []string {
+	t.Helper()
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	messages := make([]string, 0)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var entry LogEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			t.Fatalf("%s: invalid line %q: %v", path, scanner.Text(), err)
+		}
+		messages = append(messages, entry.Message)
+	}
+	return messages
+}
+
+// logLineSize is the size of one NDJSON line the tests write
+func logLineSize(t *testing.T) int {
+	t.Helper()
+	payload, err := marshalNDJSON([]LogEntry{{Message: "message 0"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(payload)
+}
+
+func TestFileLogSinkRotation(t *testing.T) {
+	tests := []struct {
+		name    string
+		backups int
+		batches int
+		// want are the messages of path, path.1, path.2 and path.3
+		want [][]string
+	}{
+		{
+			name:    "no rotation under the max size",
+			backups: 2,
+			batches: 2,
+			want:    [][]string{{"message 0", "message 1"}, nil, nil, nil},
+		},
+		{
+			name:    "rotates into numbered backups",
+			backups: 2,
+			batches: 5,
+			want:    [][]string{{"message 4"}, {"message 2", "message 3"}, {"message 0", "message 1"}, nil},
+		},
+		{
+			name:    "drops the oldest backup",
+			backups: 2,
+			batches: 7,
+			want:    [][]string{{"message 6"}, {"message 4", "message 5"}, {"message 2", "message 3"}, nil},
+		},
+		{
+			name:    "without backups the file starts over",
+			backups: 0,
+			batches: 5,
+			want:    [][]string{{"message 4"}, nil, nil, nil},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "logs", "handler.ndjson")
+			// two lines fit in a file
+			sink := NewFileLogSink(path, 2*logLineSize(t), test.backups)
+			for i := 0; i < test.batches; i++ {
+				if err := sink.Send([]LogEntry{{Message: fmt.Sprintf("message %d", i)}}); err != nil {
+					t.Fatalf("Send() = %v", err)
+				}
+			}
+			sink.file.Close()
+
+			for i, want := range test.want {
+				file := path
+				if i > 0 {
+					file = fmt.Sprintf("%s.%d", path, i)
+				}
+				if got := readLogFile(t, file); fmt.Sprint(got) != fmt.Sprint(want) {
+					t.Errorf("%s = %v, want %v", filepath.Base(file), got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestFileLogSinkAppendsToExistingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "handler.ndjson")
+	first := NewFileLogSink(path, 2*logLineSize(t), 1)
+	if err := first.Send([]LogEntry{{Message: "message 0"}}); err != nil {
+		t.Fatal(err)
+	}
+	first.file.Close()
+
+	// the next run counts the size of the file it found
+	second := NewFileLogSink(path, 2*logLineSize(t), 1)
+	for i := 1; i <= 2; i++ {
+		if err := second.Send([]LogEntry{{Message: fmt.Sprintf("message %d", i)}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	second.file.Close()
+
+	if got := readLogFile(t, path); fmt.Sprint(got) != "[message 2]" {
+		t.Errorf("handler.ndjson = %v", got)
+	}
+	if got := readLogFile(t, path+".1"); fmt.Sprint(got) != "[message 0 message 1]" {
+		t.Errorf("handler.ndjson.1 = %v", got)
+	}
+}
@@ -0,0 +1,414 @@
+package common
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// logBatchSize and logBatchInterval bound how long a handler log line waits before it is sent to the sinks
+	logBatchSize     = 16
+	logBatchInterval = 3 * time.Second
+
+	logTimestampLayout = "2006-01-02T15:04:05.000Z"
+
+	defaultTinybirdUrl = "https://api.us-east.tinybird.co/v0/events?wait=true&name=sls_test_logs_v1"
+)
+
+// LogEntry is a handler log event along with the test that was running when it was printed
+type LogEntry struct {
+	TestId     string    `json:"testId"`
+	Level      string    `json:"level"`
+	Stream     string    `json:"stream"`
+	PodId      string    `json:"podId"`
+	JobId      string    `json:"jobId,omitempty"`
+	TestNumber int       `json:"testNumber"`
+	Message    string    `json:"message"`
+	Timestamp  string    `json:"timestamp"`
+	Time       time.Time `json:"-"`
+}
+
+// LogSink ships the handler logs out of the process. Send gets the entries in the order they were printed
+// and is never called concurrently for the same sink.
+type LogSink interface {
+	Name() string
+	Send(entries []LogEntry) error
+}
+
+var (
+	logSinksMutex = &sync.Mutex{}
+	logSinks      []LogSink
+	logSinksOnce  sync.Once
+	logWorkers    []*logSinkWorker
+	// logForwarders are the flush requests of the running ForwardLogs, the request is closed once the events
+	// it was batching were handed to the sinks
+	logForwarders = make(map[chan chan struct{}]bool)
+)
+
+// RegisterLogSink adds a sink on top of the ones configured through the environment,
+// it has to be called before the first command starts
+func RegisterLogSink(sink LogSink) {
+	logSinksMutex.Lock()
+	defer logSinksMutex.Unlock()
+	logSinks = append(logSinks, sink)
+}
+
+// configuredLogSinks returns the registered sinks followed by the ones listed in RUNPOD_LOG_SINKS.
+// Without RUNPOD_LOG_SINKS the logs go to Tinybird when RUNPOD_TINYBIRD_TOKEN is set and nowhere otherwise.
+func configuredLogSinks(log *zap.Logger) []LogSink {
+	logSinksMutex.Lock()
+	configured := append([]LogSink(nil), logSinks...)
+	logSinksMutex.Unlock()
+
+	names := os.Getenv("RUNPOD_LOG_SINKS")
+	if names == "" && os.Getenv("RUNPOD_TINYBIRD_TOKEN") != "" {
+		names = "tinybird"
+	}
+
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(strings.ToLower(name))
+		switch name {
+		case "":
+		case "tinybird":
+			token := os.Getenv("RUNPOD_TINYBIRD_TOKEN")
+			if token == "" {
+				log.Error("The tinybird log sink needs RUNPOD_TINYBIRD_TOKEN")
+				continue
+			}
+			url := os.Getenv("RUNPOD_TINYBIRD_URL")
+			if url == "" {
+				url = defaultTinybirdUrl
+			}
+			configured = append(configured, &TinybirdLogSink{Url: url, Token: token})
+		case "file":
+			path := os.Getenv("RUNPOD_LOG_FILE")
+			if path == "" {
+				path = "runpod-logs.ndjson"
+			}
+			configured = append(configured, NewFileLogSink(path, envInt("RUNPOD_LOG_FILE_MAX_SIZE_MB", 10)*1024*1024, envInt("RUNPOD_LOG_FILE_BACKUPS", 3)))
+		case "stdout":
+			configured = append(configured, &StdoutLogSink{})
+		case "otlp":
+			configured = append(configured, NewOTLPLogSink())
+		default:
+			log.Error("Unknown log sink", zap.String("sink", name))
+		}
+	}
+	return configured
+}
+
+// envInt reads a positive number from the environment, falling back to fallback when it is not set or invalid
+func envInt(name string, fallback int) int {
+	var value int
+	if _, err := fmt.Sscanf(os.Getenv(name), "%d", &value); err != nil || value <= 0 {
+		return fallback
+	}
+	return value
+}
+
+// logSinkWorker sends the entries of one sink in order, so a slow or unreachable sink does not hold up the others
+type logSinkWorker struct {
+	sink  LogSink
+	spool *logSpool
+}
+
+// startLogSinks starts a worker per configured sink, once for the whole process since both the handler and the
+// AI API forward their logs to the same sinks
+func startLogSinks(log *zap.Logger) []*logSinkWorker {
+	logSinksOnce.Do(func() {
+		workers := make([]*logSinkWorker, 0)
+		for _, sink := range configuredLogSinks(log) {
+			worker := &logSinkWorker{sink: sink, spool: newLogSpool(sink.Name())}
+			go worker.run(log)
+			workers = append(workers, worker)
+			log.Info("Sending handler logs", zap.String("sink", sink.Name()))
+		}
+
+		logSinksMutex.Lock()
+		logWorkers = workers
+		logSinksMutex.Unlock()
+	})
+
+	logSinksMutex.Lock()
+	defer logSinksMutex.Unlock()
+	return logWorkers
+}
+
+// run sends the spooled entries, oldest first. A batch the sink did not take is retried with backoff while
+// the new entries wait in the spool. It logs when the sink starts failing and when it recovers instead of
+// once per attempt.
+func (w *logSinkWorker) run(log *zap.Logger) {
+	backoff := logRetryInitialBackoff
+	failing := false
+	for {
+		batch, sent := w.spool.next()
+		if batch == nil {
+			<-w.spool.notify
+			continue
+		}
+
+		for {
+			err := w.send(batch)
+			if err == nil {
+				break
+			}
+			if errors.Is(err, errNotRetryable) {
+				// the sink would reject the batch again, holding on to it would block the logs after it
+				atomic.AddInt64(&droppedLogLines, int64(len(batch)))
+				log.Error("The sink rejected logs, dropping them", zap.String("sink", w.sink.Name()), zap.Int("entries", len(batch)), zap.Error(err))
+				break
+			}
+			if !failing {
+				log.Error("Failed to send logs, spooling them until the sink recovers", zap.String("sink", w.sink.Name()), zap.Error(err))
+				failing = true
+			}
+			time.Sleep(backoff)
+			backoff = min(backoff*2, logRetryMaxBackoff)
+		}
+		sent()
+
+		if failing {
+			log.Info("Sending logs again", zap.String("sink", w.sink.Name()))
+			failing = false
+		}
+		backoff = logRetryInitialBackoff
+	}
+}
+
+func (w *logSinkWorker) send(batch []LogEntry) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			// the sink would panic on the same batch again
+			err = fmt.Errorf("panic: %v\n%s: %w", r, debug.Stack(), errNotRetryable)
+		}
+	}()
+	return w.sink.Send(batch)
+}
+
+// PersistLogs writes the logs the sinks did not take yet to their spool, the next run sends them
+func PersistLogs(log *zap.Logger) {
+	logSinksMutex.Lock()
+	workers := logWorkers
+	logSinksMutex.Unlock()
+
+	for _, worker := range workers {
+		worker.spool.persist(log)
+	}
+}
+
+// newLogEntry is the entry of an attributed event that is sent to the sinks
+func newLogEntry(event LogEvent) LogEntry {
+	return LogEntry{
+		TestId:     os.Getenv("RUNPOD_TEST_ID"),
+		Level:      event.Level,
+		Stream:     event.Stream,
+		PodId:      os.Getenv("RUNPOD_POD_ID"),
+		JobId:      event.JobID,
+		TestNumber: event.TestNumber,
+		Message:    event.Message,
+		Timestamp:  event.Time.Format(logTimestampLayout),
+		Time:       event.Time,
+	}
+}
+
+// ForwardLogs keeps the events captured from a command for the reporters and sends them to the configured sinks
+// in batches. It returns once logBuffer is closed.
+func ForwardLogs(logBuffer chan LogEvent, log *zap.Logger) {
+	workers := startLogSinks(log)
+	buffer := make([]LogEntry, 0)
+
+	flushes := make(chan chan struct{})
+	logSinksMutex.Lock()
+	logForwarders[flushes] = true
+	logSinksMutex.Unlock()
+	defer func() {
+		logSinksMutex.Lock()
+		delete(logForwarders, flushes)
+		logSinksMutex.Unlock()
+	}()
+
+	ticker := time.NewTicker(logBatchInterval)
+	defer ticker.Stop()
+
+	flush := func() {
+		if len(buffer) == 0 {
+			return
+		}
+		for _, worker := range workers {
+			worker.spool.push(buffer, log)
+		}
+		buffer = make([]LogEntry, 0)
+	}
+	add := func(event LogEvent) {
+		if event.Message == "" {
+			return
+		}
+		attributeEvent(&event)
+
+		buffer = append(buffer, newLogEntry(event))
+		captureLog(event)
+	}
+
+	for {
+		select {
+		case event, ok := <-logBuffer:
+			if !ok {
+				flush()
+				return
+			}
+
+			add(event)
+			if len(buffer) >= logBatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case done := <-flushes:
+			// the events already in logBuffer were printed before the flush was requested
+			for drained := false; !drained; {
+				select {
+				case event, ok := <-logBuffer:
+					if ok {
+						add(event)
+					} else {
+						drained = true
+					}
+				default:
+					drained = true
+				}
+			}
+			flush()
+			close(done)
+		}
+	}
+}
+
+// flushLogForwarders asks every ForwardLogs to hand the events it is batching to the sinks, waiting until deadline
+func flushLogForwarders(deadline time.Time) {
+	logSinksMutex.Lock()
+	forwarders := make([]chan chan struct{}, 0, len(logForwarders))
+	for flushes := range logForwarders {
+		forwarders = append(forwarders, flushes)
+	}
+	logSinksMutex.Unlock()
+
+	for _, flushes := range forwarders {
+		done := make(chan struct{})
+		select {
+		case flushes <- done:
+			select {
+			case <-done:
+			case <-time.After(time.Until(deadline)):
+			}
+		case <-time.After(time.Until(deadline)):
+		}
+	}
+}
+
+// pushLogEvent sends an event of the server itself to the sinks without going through a command's ForwardLogs
+func pushLogEvent(event LogEvent, log *zap.Logger) {
+	attributeEvent(&event)
+	captureLog(event)
+	entries := []LogEntry{newLogEntry(event)}
+	for _, worker := range startLogSinks(log) {
+		worker.spool.push(entries, log)
+	}
+}
+
+// waitForLogSinks waits until every sink took the spooled entries or deadline passed
+func waitForLogSinks(deadline time.Time) {
+	logSinksMutex.Lock()
+	workers := logWorkers
+	logSinksMutex.Unlock()
+
+	for _, worker := range workers {
+		for !worker.spool.empty() && time.Now().Before(deadline) {
+			time.Sleep(50 * time.Millisecond)
+		}
+	}
+}
+
+// sinkStatusError returns the error of a sink answer with status, nil for a 2xx. The 4xx answers but 408 and 429
+// are not retryable, the sink would reject the same batch again.
+func sinkStatusError(status int) error {
+	if status >= 200 && status < 300 {
+		return nil
+	}
+	err := fmt.Errorf("request failed with status %d", status)
+	if status >= 400 && status < 500 && status != http.StatusRequestTimeout && status != http.StatusTooManyRequests {
+		return fmt.Errorf("%w: %w", err, errNotRetryable)
+	}
+	return err
+}
+
+// marshalNDJSON writes one JSON object per line, the format Tinybird and the file sink expect
+func marshalNDJSON(entries []LogEntry) ([]byte, error) {
+	var builder strings.Builder
+	for _, entry := range entries {
+		line, err := json.Marshal(entry)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal logs: %w: %w", err, errNotRetryable)
+		}
+		builder.Write(line)
+		builder.WriteByte('\n')
+	}
+	return []byte(builder.String()), nil
+}
+
+// TinybirdLogSink posts the logs to the Tinybird events API
+type TinybirdLogSink struct {
+	Url   string
+	Token string
+}
+
+func (s *TinybirdLogSink) Name() string {
+	return "tinybird"
+}
+
+func (s *TinybirdLogSink) Send(entries []LogEntry) error {
+	payload, err := marshalNDJSON(entries)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", s.Url, strings.NewReader(string(payload)))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w: %w", err, errNotRetryable)
+	}
+	req.Header.Set("Authorization", "Bearer "+s.Token)
+	req.Header.Set("Content-Type", "text/plain")
+
+	client := &http.Client{Timeout: 2 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return sinkStatusError(resp.StatusCode)
+}
+
+// StdoutLogSink prints every entry as a JSON line, for log collectors that read the container output
+type StdoutLogSink struct{}
+
+func (s *StdoutLogSink) Name() string {
+	return "stdout"
+}
+
+func (s *StdoutLogSink) Send(entries []LogEntry) error {
+	payload, err := marshalNDJSON(entries)
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(payload)
+	return err
+}
@@ -1,23 +1,15 @@
 package common
 
 import (
-	"bytes"
-	"encoding/json"
 	"fmt"
-	"net/http"
 	"os"
-	"runtime/debug"
-	"sls-local-server/packages/vars"
-	"strings"
 	"sync"
-	"time"
 
 	prettyconsole "github.com/thessem/zap-prettyconsole"
 	"go.uber.org/zap"
 )
 
 var Mutex = &sync.Mutex{}
-var GqlMutex = &sync.Mutex{}
 
 var (
 	log        *zap.Logger
@@ -36,154 +28,46 @@ func init() {
 	}
 }
 
-func SendResultsToGraphQL(status string, errorReason *string, log *zap.Logger, results []Result) {
-	GqlMutex.Lock()
-	defer GqlMutex.Unlock()
+// maxCapturedLogLines is how many handler log lines are kept per test for the reporters
+const maxCapturedLogLines = 2000
 
-	runpodPodId := os.Getenv("RUNPOD_POD_ID")
-	jwtToken := os.Getenv("RUNPOD_JWT_TOKEN")
-	runpodTestId := os.Getenv("RUNPOD_TEST_ID")
-	webhookUrl := os.Getenv("RUNPOD_TEST_WEBHOOK_URL")
-
-	if webhookUrl == "" {
-		log.Error("RUNPOD_TEST_WEBHOOK_URL not set")
-		return
-	}
-
-	time.Sleep(time.Duration(10) * time.Second)
-
-	jsonData, err := json.Marshal(map[string]interface{}{
-		"podId":   runpodPodId,
-		"testId":  runpodTestId,
-		"results": results,
-		"status":  status,
-		"error":   errorReason,
-	})
-	if err != nil {
-		log.Error("Failed to marshal results", zap.Error(err))
-		return
-	}
-
-	req, err := http.NewRequest("POST", webhookUrl, bytes.NewBuffer(jsonData))
-	if err != nil {
-		log.Error("Failed to create request", zap.Error(err))
-		return
-	}
+var (
+	capturedLogsMutex = &sync.Mutex{}
+	capturedLogs      = make(map[int][]string)
+	capturedJobLogs   = make(map[string][]string)
+)
 
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", "Bearer "+jwtToken)
+// captureLog keeps a handler log event along with the test and the job it was attributed to
+func captureLog(event LogEvent) {
+	capturedLogsMutex.Lock()
+	defer capturedLogsMutex.Unlock()
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		log.Error("Failed to send request", zap.Error(err))
-		return
+	line := fmt.Sprintf("[%s] %s", event.Level, event.Message)
+	if len(capturedLogs[event.TestNumber]) < maxCapturedLogLines {
+		capturedLogs[event.TestNumber] = append(capturedLogs[event.TestNumber], line)
 	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		log.Error("Request failed", zap.Int("status", resp.StatusCode))
-		return
+	if event.JobID != "" && len(capturedJobLogs[event.JobID]) < maxCapturedLogLines && keepsJobLogs(event.TestNumber) {
+		capturedJobLogs[event.JobID] = append(capturedJobLogs[event.JobID], line)
 	}
-
-	time.Sleep(30 * time.Second)
-	log.Info("Results sent to GraphQL", zap.Any("results", results))
 }
 
-func SendLogsToTinyBird(logBuffer chan string, log *zap.Logger) {
-	buffer := make([]map[string]interface{}, 0)
-	tinybirdToken := os.Getenv("RUNPOD_TINYBIRD_TOKEN")
-	runpodPodId := os.Getenv("RUNPOD_POD_ID")
-
-	ticker := time.NewTicker(3 * time.Second)
-	defer ticker.Stop()
-
-	var testNumber = vars.CURRENT_TEST_ID
-
-	for {
-		select {
-		case logMsg, ok := <-logBuffer:
-			if !ok {
-				log.Error("log buffer closed")
-				time.Sleep(10 * time.Second)
-				continue
-			}
-
-			if logMsg == "" {
-				continue
-			}
-
-			testNumber = vars.CURRENT_TEST_ID
-			level := "info"
-			logMessageList := strings.Split(logMsg, "\n")
-
-			for _, logMessage := range logMessageList {
-				fmt.Println("logMsg: ### ", logMessage)
-				if logMessage == "" {
-					continue
-				}
-				if strings.HasPrefix(logMessage, "#ERROR:") {
-					level = "error"
-					logMessage = strings.TrimPrefix(logMessage, "#ERROR:")
-				}
-				logEntry := map[string]interface{}{
-					"testId":     os.Getenv("RUNPOD_TEST_ID"),
-					"level":      level,
-					"podId":      runpodPodId,
-					"testNumber": testNumber,
-					"message":    logMessage,
-					"timestamp":  time.Now().UTC().Format("2006-01-02T15:04:05.000Z"),
-				}
-
-				buffer = append(buffer, logEntry)
-			}
-
-			if len(buffer) >= 16 {
-				fmt.Println("sending logs to tinybird - above", len(buffer))
-				go sendLogs(buffer, tinybirdToken, log)
-				buffer = make([]map[string]interface{}, 0)
-			}
-		case <-ticker.C:
-			if len(buffer) > 0 {
-				fmt.Println("sending logs to tinybird", len(buffer))
-				go sendLogs(buffer, tinybirdToken, log)
-				buffer = make([]map[string]interface{}, 0)
-			}
-		}
-	}
+// forgetJobLogs drops the log lines of a job that is not remembered anymore
+func forgetJobLogs(jobID string) {
+	capturedLogsMutex.Lock()
+	defer capturedLogsMutex.Unlock()
+	delete(capturedJobLogs, jobID)
 }
 
-func sendLogs(buffer []map[string]interface{}, token string, log *zap.Logger) {
-	url := "https://api.us-east.tinybird.co/v0/events?wait=true&name=sls_test_logs_v1"
-
-	var records []string
-	for _, entry := range buffer {
-		jsonBytes, err := json.Marshal(entry)
-		if err == nil {
-			records = append(records, string(jsonBytes))
-		}
-	}
-	payload := strings.Join(records, "\n")
-
-	defer func() {
-		if r := recover(); r != nil {
-			log.Error("Recovered from panic in log sending",
-				zap.Any("panic", r),
-				zap.String("stack", string(debug.Stack())))
-		}
-	}()
-
-	req, err := http.NewRequest("POST", url, strings.NewReader(payload))
-	if err != nil {
-		log.Error("Failed to create request", zap.Error(err))
-		return
-	}
-	req.Header.Set("Authorization", "Bearer "+token)
-	req.Header.Set("Content-Type", "text/plain")
+// CapturedLogs returns the handler log lines attributed to the test
+func CapturedLogs(testNumber int) []string {
+	capturedLogsMutex.Lock()
+	defer capturedLogsMutex.Unlock()
+	return append([]string(nil), capturedLogs[testNumber]...)
+}
 
-	client := &http.Client{Timeout: 2 * time.Second}
-	_, err = client.Do(req)
-	if err != nil {
-		log.Error("Failed to send logs to tinybird", zap.Error(err))
-	}
+// CapturedJobLogs returns the handler log lines attributed to the job
+func CapturedJobLogs(jobID string) []string {
+	capturedLogsMutex.Lock()
+	defer capturedLogsMutex.Unlock()
+	return append([]string(nil), capturedJobLogs[jobID]...)
 }
@@ -0,0 +1,421 @@
+package common
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultMetricsIntervalMs = 500
+	// maxResourceSamples bounds the samples kept for the reports, the oldest are dropped
+	maxResourceSamples = 20000
+	// clockTicks is USER_HZ, the unit of the CPU times in /proc/<pid>/stat, 100 on every Linux architecture we run on
+	clockTicks = 100
+
+	// minTrendTests is how many tests with samples a growing RSS trend needs
+	minTrendTests = 3
+	// defaultRSSGrowthMB is how much the RSS has to grow between the first and the last test to be flagged
+	defaultRSSGrowthMB = 50
+	// rssGrowthRatio is the share of the tests that have to end with more RSS than the previous one
+	rssGrowthRatio = 0.75
+)
+
+// resourceSample is what the handler process tree used at a point in time. CgroupMemory is -1 without cgroup v2.
+// Rates is false for the samples taken when a job starts or finishes, they come too soon after the previous sample
+// for a CPU or IO rate to mean anything so they only have the instant values.
+type resourceSample struct {
+	Time                time.Time
+	Rates               bool
+	CPUPercent          float64
+	RSS                 int64
+	OpenFDs             int
+	Threads             int
+	ReadBytesPerSecond  float64
+	WriteBytesPerSecond float64
+	CgroupMemory        int64
+}
+
+// processCounters are the cumulative counters of a process, the samples are the difference between two reads
+type processCounters struct {
+	CPUTicks   int64
+	ReadBytes  int64
+	WriteBytes int64
+}
+
+var (
+	resourceSamplesMutex = &sync.Mutex{}
+	resourceSamples      = make([]resourceSample, 0)
+	// sampleRequests asks the running sampler for a sample right away, when a job starts or finishes
+	sampleRequests = make(chan struct{}, 1)
+)
+
+func metricsEnabled() bool {
+	return os.Getenv("RUNPOD_METRICS") != "false"
+}
+
+func requestResourceSample() {
+	select {
+	case sampleRequests <- struct{}{}:
+	default:
+	}
+}
+
+func recordResourceSample(sample resourceSample) {
+	resourceSamplesMutex.Lock()
+	defer resourceSamplesMutex.Unlock()
+	resourceSamples = append(resourceSamples, sample)
+	if len(resourceSamples) > maxResourceSamples {
+		resourceSamples = resourceSamples[len(resourceSamples)-maxResourceSamples:]
+	}
+}
+
+// startResourceSampling samples the process tree of pid every RUNPOD_METRICS_INTERVAL_MS and when a job starts or
+// finishes, until the returned function is called. The samples of the jobs are at least a quarter of the interval
+// apart, a load test starts and finishes jobs far more often than that.
+func startResourceSampling(pid int) func() {
+	if !metricsEnabled() {
+		return func() {}
+	}
+
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		interval := time.Duration(envInt("RUNPOD_METRICS_INTERVAL_MS", defaultMetricsIntervalMs)) * time.Millisecond
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		sampler := &resourceSampler{root: pid, memoryFile: cgroupMemoryFile()}
+		sampler.sample(true)
+		last := time.Now()
+		for {
+			rates := false
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				rates = true
+			case <-sampleRequests:
+				if time.Since(last) < interval/4 {
+					continue
+				}
+			}
+			if sample, ok := sampler.sample(rates); ok {
+				recordResourceSample(sample)
+			}
+			last = time.Now()
+		}
+	}()
+
+	return func() {
+		close(stop)
+		<-stopped
+	}
+}
+
+// resourceSampler reads the process tree of root, the rates of a sample are computed from the previous sample with
+// rates
+type resourceSampler struct {
+	root       int
+	memoryFile string
+	previous   map[int]processCounters
+	previousAt time.Time
+}
+
+// sample reads the process tree, with the CPU and IO rates since the previous sample with rates when rates is set.
+// The first sample with rates only sets the counters the next one is computed from.
+func (s *resourceSampler) sample(rates bool) (resourceSample, bool) {
+	now := time.Now()
+	sample := resourceSample{Time: now.UTC(), CgroupMemory: -1}
+
+	counters := make(map[int]processCounters)
+	for pid, stat := range processTree(s.root) {
+		sample.RSS += stat.RSS
+		sample.Threads += stat.Threads
+		sample.OpenFDs += countOpenFDs(pid)
+
+		current := processCounters{CPUTicks: stat.CPUTicks}
+		current.ReadBytes, current.WriteBytes = readProcessIO(pid)
+		counters[pid] = current
+	}
+
+	if s.memoryFile != "" {
+		if content, err := os.ReadFile(s.memoryFile); err == nil {
+			if value, err := strconv.ParseInt(strings.TrimSpace(string(content)), 10, 64); err == nil {
+				sample.CgroupMemory = value
+			}
+		}
+	}
+
+	if !rates {
+		return sample, true
+	}
+	previous, previousAt := s.previous, s.previousAt
+	s.previous, s.previousAt = counters, now
+	if previous == nil || !now.After(previousAt) {
+		return sample, false
+	}
+
+	// a process that exited took its counters with it, the ones that started count from zero
+	var cpuTicks, readBytes, writeBytes int64
+	for pid, current := range counters {
+		before := previous[pid]
+		cpuTicks += max(current.CPUTicks-before.CPUTicks, 0)
+		readBytes += max(current.ReadBytes-before.ReadBytes, 0)
+		writeBytes += max(current.WriteBytes-before.WriteBytes, 0)
+	}
+	elapsed := now.Sub(previousAt).Seconds()
+	sample.Rates = true
+	sample.CPUPercent = float64(cpuTicks) / clockTicks / elapsed * 100
+	sample.ReadBytesPerSecond = float64(readBytes) / elapsed
+	sample.WriteBytesPerSecond = float64(writeBytes) / elapsed
+	return sample, true
+}
+
+// processStat is what the sampler uses from /proc/<pid>/stat
+type processStat struct {
+	State        byte
+	ParentPid    int
+	ProcessGroup int
+	CPUTicks     int64
+	Threads      int
+	RSS          int64
+}
+
+func readProcessStat(pid int) (processStat, error) {
+	content, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return processStat{}, err
+	}
+
+	// the command name is between parentheses and can contain spaces, the fields after it start with the state
+	text := string(content)
+	fields := strings.Fields(text[strings.LastIndexByte(text, ')')+1:])
+	if len(fields) < 22 {
+		return processStat{}, fmt.Errorf("unexpected /proc/%d/stat", pid)
+	}
+	parse := func(index int) int64 {
+		value, _ := strconv.ParseInt(fields[index], 10, 64)
+		return value
+	}
+	// state is field 3 of proc(5), ppid 4, pgrp 5, utime 14, stime 15, num_threads 20 and rss 24
+	return processStat{
+		State:        fields[0][0],
+		ParentPid:    int(parse(1)),
+		ProcessGroup: int(parse(2)),
+		CPUTicks:     parse(11) + parse(12),
+		Threads:      int(parse(17)),
+		RSS:          parse(21) * int64(os.Getpagesize()),
+	}, nil
+}
+
+// processTree returns the stat of root and its descendants, including the ones that left its process group
+func processTree(root int) map[int]processStat {
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return nil
+	}
+
+	stats := make(map[int]processStat)
+	children := make(map[int][]int)
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		// the processes that exited meanwhile are skipped
+		if stat, err := readProcessStat(pid); err == nil {
+			stats[pid] = stat
+			children[stat.ParentPid] = append(children[stat.ParentPid], pid)
+		}
+	}
+
+	tree := make(map[int]processStat)
+	if _, running := stats[root]; !running {
+		return tree
+	}
+	pending := []int{root}
+	for len(pending) > 0 {
+		pid := pending[0]
+		pending = pending[1:]
+		tree[pid] = stats[pid]
+		pending = append(pending, children[pid]...)
+	}
+	return tree
+}
+
+func countOpenFDs(pid int) int {
+	entries, err := os.ReadDir(fmt.Sprintf("/proc/%d/fd", pid))
+	if err != nil {
+		return 0
+	}
+	return len(entries)
+}
+
+// readProcessIO returns the bytes the process read from and wrote to the storage layer
+func readProcessIO(pid int) (int64, int64) {
+	file, err := os.Open(fmt.Sprintf("/proc/%d/io", pid))
+	if err != nil {
+		return 0, 0
+	}
+	defer file.Close()
+
+	var readBytes, writeBytes int64
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		key, value, found := strings.Cut(scanner.Text(), ":")
+		if !found {
+			continue
+		}
+		number, _ := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+		switch key {
+		case "read_bytes":
+			readBytes = number
+		case "write_bytes":
+			writeBytes = number
+		}
+	}
+	return readBytes, writeBytes
+}
+
+// cgroupMemoryFile returns the cgroup v2 memory.current of the server, empty without cgroup v2
+func cgroupMemoryFile() string {
+	for _, path := range cgroupFiles("memory.current", "") {
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+	return ""
+}
+
+// JobResourceUsage returns what the handler used while the job ran, nil when no sample was taken meanwhile.
+// The sample taken when the job finished is a little after FinishedAt, the window ends jobFinishGrace later.
+func JobResourceUsage(jobID string) *ResourceUsage {
+	window, found := findJobWindow(jobID)
+	if !found {
+		return nil
+	}
+	end := window.FinishedAt.Add(jobFinishGrace)
+	if window.FinishedAt.IsZero() {
+		end = time.Now()
+	}
+
+	resourceSamplesMutex.Lock()
+	samples := make([]resourceSample, 0)
+	for _, sample := range resourceSamples {
+		if !sample.Time.Before(window.StartedAt) && !sample.Time.After(end) {
+			samples = append(samples, sample)
+		}
+	}
+	resourceSamplesMutex.Unlock()
+
+	if len(samples) == 0 {
+		return nil
+	}
+	usage := &ResourceUsage{
+		Samples:  len(samples),
+		RSSStart: samples[0].RSS,
+		RSSEnd:   samples[len(samples)-1].RSS,
+	}
+	usage.RSS = newResourceStat(samples, func(s resourceSample) float64 { return float64(s.RSS) })
+	usage.OpenFDs = newResourceStat(samples, func(s resourceSample) float64 { return float64(s.OpenFDs) })
+	usage.Threads = newResourceStat(samples, func(s resourceSample) float64 { return float64(s.Threads) })
+
+	// the rates only come from the periodic samples, a test shorter than the interval has none
+	rated := make([]resourceSample, 0, len(samples))
+	for _, sample := range samples {
+		if sample.Rates {
+			rated = append(rated, sample)
+		}
+	}
+	if len(rated) > 0 {
+		usage.CPUPercent = newResourceStat(rated, func(s resourceSample) float64 { return s.CPUPercent })
+		usage.ReadBytesPerSecond = newResourceStat(rated, func(s resourceSample) float64 { return s.ReadBytesPerSecond })
+		usage.WriteBytesPerSecond = newResourceStat(rated, func(s resourceSample) float64 { return s.WriteBytesPerSecond })
+	}
+	if samples[0].CgroupMemory >= 0 {
+		memory := newResourceStat(samples, func(s resourceSample) float64 { return float64(s.CgroupMemory) })
+		usage.CgroupMemory = &memory
+	}
+	return usage
+}
+
+func newResourceStat(samples []resourceSample, value func(resourceSample) float64) ResourceStat {
+	stat := ResourceStat{Min: math.Inf(1), Max: math.Inf(-1)}
+	var total float64
+	for _, sample := range samples {
+		v := value(sample)
+		stat.Min = math.Min(stat.Min, v)
+		stat.Max = math.Max(stat.Max, v)
+		total += v
+	}
+	stat.Avg = math.Round(total/float64(len(samples))*100) / 100
+	stat.Min = math.Round(stat.Min*100) / 100
+	stat.Max = math.Round(stat.Max*100) / 100
+	return stat
+}
+
+// Details describes the usage of a test, one resource per line
+func (u *ResourceUsage) Details() string {
+	lines := []string{
+		fmt.Sprintf("Samples: %d", u.Samples),
+		fmt.Sprintf("CPU: min %.1f%%, avg %.1f%%, max %.1f%%", u.CPUPercent.Min, u.CPUPercent.Avg, u.CPUPercent.Max),
+		fmt.Sprintf("RSS: min %s, avg %s, max %s, %s at the start and %s at the end", formatBytes(int64(u.RSS.Min)), formatBytes(int64(u.RSS.Avg)),
+			formatBytes(int64(u.RSS.Max)), formatBytes(u.RSSStart), formatBytes(u.RSSEnd)),
+		fmt.Sprintf("Open files: min %.0f, avg %.1f, max %.0f", u.OpenFDs.Min, u.OpenFDs.Avg, u.OpenFDs.Max),
+		fmt.Sprintf("Threads: min %.0f, avg %.1f, max %.0f", u.Threads.Min, u.Threads.Avg, u.Threads.Max),
+		fmt.Sprintf("Disk read: avg %s/s, max %s/s", formatBytes(int64(u.ReadBytesPerSecond.Avg)), formatBytes(int64(u.ReadBytesPerSecond.Max))),
+		fmt.Sprintf("Disk write: avg %s/s, max %s/s", formatBytes(int64(u.WriteBytesPerSecond.Avg)), formatBytes(int64(u.WriteBytesPerSecond.Max))),
+	}
+	if u.CgroupMemory != nil {
+		lines = append(lines, fmt.Sprintf("Cgroup memory: min %s, avg %s, max %s", formatBytes(int64(u.CgroupMemory.Min)),
+			formatBytes(int64(u.CgroupMemory.Avg)), formatBytes(int64(u.CgroupMemory.Max))))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// MemoryWarning flags an RSS that keeps growing from one test to the next, the way a handler leaking memory
+// across requests ends up OOM killed. The RSS at the end of each test, in the order they ran, has to grow by
+// RUNPOD_METRICS_RSS_GROWTH_MB overall with most tests ending higher than the previous one. It is empty otherwise.
+func MemoryWarning(results []Result) string {
+	type testEnd struct {
+		finished time.Time
+		rss      int64
+	}
+	ends := make([]testEnd, 0)
+	for _, result := range results {
+		if result.Resources == nil || result.JobID == "" {
+			continue
+		}
+		if window, found := findJobWindow(result.JobID); found {
+			ends = append(ends, testEnd{finished: window.FinishedAt, rss: result.Resources.RSSEnd})
+		}
+	}
+	if len(ends) < minTrendTests {
+		return ""
+	}
+	sort.SliceStable(ends, func(a, b int) bool {
+		return ends[a].finished.Before(ends[b].finished)
+	})
+
+	growing := 0
+	for i := 1; i < len(ends); i++ {
+		if ends[i].rss > ends[i-1].rss {
+			growing++
+		}
+	}
+	growth := ends[len(ends)-1].rss - ends[0].rss
+	threshold := int64(envInt("RUNPOD_METRICS_RSS_GROWTH_MB", defaultRSSGrowthMB)) * 1024 * 1024
+	if growth < threshold || float64(growing) < rssGrowthRatio*float64(len(ends)-1) {
+		return ""
+	}
+	return fmt.Sprintf("The handler RSS grew by %s over %d tests, from %s to %s, it may be leaking memory across requests",
+		formatBytes(growth), len(ends), formatBytes(ends[0].rss), formatBytes(ends[len(ends)-1].rss))
+}
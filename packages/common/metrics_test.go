@@ -0,0 +1,66 @@
+package common
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMemoryWarning(t *testing.T) {
+	const mb = 1024 * 1024
+
+	// testEnd is a test whose job finished at the given second with the RSS in MB, without a job when finished is negative
+	type testEnd struct {
+		finished int
+		rss      int64
+	}
+
+	tests := []struct {
+		name   string
+		growth string
+		ends   []testEnd
+		want   string
+	}{
+		{name: "no tests"},
+		{name: "too few tests", ends: []testEnd{{1, 100}, {2, 400}}},
+		{name: "steady growth", ends: []testEnd{{1, 100}, {2, 120}, {3, 140}, {4, 160}}, want: "grew by 60.0 MiB over 4 tests, from 100.0 MiB to 160.0 MiB"},
+		{name: "growth below the threshold", ends: []testEnd{{1, 100}, {2, 110}, {3, 120}, {4, 130}}},
+		{name: "lower threshold", growth: "20", ends: []testEnd{{1, 100}, {2, 110}, {3, 120}, {4, 130}}, want: "grew by 30.0 MiB over 4 tests"},
+		{name: "one spike is not a trend", ends: []testEnd{{1, 100}, {2, 300}, {3, 200}, {4, 250}, {5, 240}}},
+		{name: "most tests growing", ends: []testEnd{{1, 100}, {2, 130}, {3, 125}, {4, 160}, {5, 190}}, want: "grew by 90.0 MiB over 5 tests"},
+		{name: "ordered by when the jobs finished", ends: []testEnd{{3, 160}, {1, 100}, {2, 130}}, want: "from 100.0 MiB to 160.0 MiB"},
+		{name: "shrinking", ends: []testEnd{{1, 300}, {2, 200}, {3, 100}}},
+		{name: "tests without a job are skipped", ends: []testEnd{{1, 100}, {-1, 900}, {2, 130}, {3, 160}}, want: "over 3 tests"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			useJobWindows(t)
+			t.Setenv("RUNPOD_METRICS_RSS_GROWTH_MB", test.growth)
+			start := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+
+			results := make([]Result, 0, len(test.ends))
+			for i, end := range test.ends {
+				result := Result{ID: i + 1, Resources: &ResourceUsage{RSSEnd: end.rss * mb}}
+				if end.finished >= 0 {
+					result.JobID = fmt.Sprintf("job-%d", i+1)
+					JobStarted(result.JobID, i+1, start)
+					JobFinished(result.JobID, start.Add(time.Duration(end.finished)*time.Second))
+				}
+				results = append(results, result)
+			}
+
+			got := MemoryWarning(results)
+			if test.want == "" {
+				if got != "" {
+					t.Fatalf("got %q, want no warning", got)
+				}
+				return
+			}
+			if !strings.Contains(got, test.want) {
+				t.Fatalf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
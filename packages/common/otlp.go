@@ -0,0 +1,184 @@
+package common
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultOTLPLogsEndpoint = "http://localhost:4318/v1/logs"
+
+// OTLPLogSink exports the logs to an OpenTelemetry collector with OTLP/HTTP, using the JSON encoding
+type OTLPLogSink struct {
+	Endpoint    string
+	Headers     map[string]string
+	ServiceName string
+}
+
+// NewOTLPLogSink reads the endpoint, headers and service name from the standard OTEL_* environment variables
+func NewOTLPLogSink() *OTLPLogSink {
+	endpoint := os.Getenv("OTEL_EXPORTER_OTLP_LOGS_ENDPOINT")
+	if endpoint == "" {
+		if base := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"); base != "" {
+			endpoint = strings.TrimSuffix(base, "/") + "/v1/logs"
+		} else {
+			endpoint = defaultOTLPLogsEndpoint
+		}
+	}
+
+	headers := map[string]string{}
+	for _, variable := range []string{"OTEL_EXPORTER_OTLP_HEADERS", "OTEL_EXPORTER_OTLP_LOGS_HEADERS"} {
+		for key, value := range parseOTLPHeaders(os.Getenv(variable)) {
+			headers[key] = value
+		}
+	}
+
+	serviceName := os.Getenv("OTEL_SERVICE_NAME")
+	if serviceName == "" {
+		serviceName = "sls-local-server"
+	}
+
+	return &OTLPLogSink{Endpoint: endpoint, Headers: headers, ServiceName: serviceName}
+}
+
+// parseOTLPHeaders reads a list of key=value pairs separated by commas, the values are percent-encoded like the
+// W3C baggage so they can hold commas. A value that does not decode is kept as it is.
+func parseOTLPHeaders(text string) map[string]string {
+	headers := map[string]string{}
+	for _, header := range strings.Split(text, ",") {
+		key, value, found := strings.Cut(header, "=")
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		if !found || key == "" {
+			continue
+		}
+		if decoded, err := url.PathUnescape(value); err == nil {
+			value = decoded
+		}
+		headers[key] = value
+	}
+	return headers
+}
+
+func (s *OTLPLogSink) Name() string {
+	return "otlp"
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+// otlpValue is an AnyValue, the JSON encoding of OTLP writes 64 bit integers as strings
+type otlpValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	IntValue    *string `json:"intValue,omitempty"`
+}
+
+type otlpLogRecord struct {
+	TimeUnixNano         string          `json:"timeUnixNano"`
+	ObservedTimeUnixNano string          `json:"observedTimeUnixNano"`
+	SeverityNumber       int             `json:"severityNumber"`
+	SeverityText         string          `json:"severityText"`
+	Body                 otlpValue       `json:"body"`
+	Attributes           []otlpAttribute `json:"attributes"`
+}
+
+func otlpString(key string, value string) otlpAttribute {
+	return otlpAttribute{Key: key, Value: otlpValue{StringValue: &value}}
+}
+
+func otlpInt(key string, value int64) otlpAttribute {
+	text := strconv.FormatInt(value, 10)
+	return otlpAttribute{Key: key, Value: otlpValue{IntValue: &text}}
+}
+
+// otlpSeverity maps the handler levels to the OpenTelemetry severity numbers
+func otlpSeverity(level string) (int, string) {
+	switch level {
+	case "debug":
+		return 5, "DEBUG"
+	case "warn":
+		return 13, "WARN"
+	case "error":
+		return 17, "ERROR"
+	default:
+		return 9, "INFO"
+	}
+}
+
+// Send exports the entries as a single resource, the pod and the test run are resource attributes
+// and the test that was running is an attribute of every record
+func (s *OTLPLogSink) Send(entries []LogEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+
+	observed := strconv.FormatInt(time.Now().UnixNano(), 10)
+	records := make([]otlpLogRecord, 0, len(entries))
+	for _, entry := range entries {
+		severityNumber, severityText := otlpSeverity(entry.Level)
+		message := entry.Message
+		records = append(records, otlpLogRecord{
+			TimeUnixNano:         strconv.FormatInt(entry.Time.UnixNano(), 10),
+			ObservedTimeUnixNano: observed,
+			SeverityNumber:       severityNumber,
+			SeverityText:         severityText,
+			Body:                 otlpValue{StringValue: &message},
+			Attributes: []otlpAttribute{
+				otlpString("log.iostream", entry.Stream),
+				otlpInt("runpod.test_number", int64(entry.TestNumber)),
+			},
+		})
+		if entry.JobId != "" {
+			records[len(records)-1].Attributes = append(records[len(records)-1].Attributes, otlpString("runpod.job_id", entry.JobId))
+		}
+	}
+
+	resource := []otlpAttribute{otlpString("service.name", s.ServiceName)}
+	if entries[0].PodId != "" {
+		resource = append(resource, otlpString("runpod.pod_id", entries[0].PodId))
+	}
+	if entries[0].TestId != "" {
+		resource = append(resource, otlpString("runpod.test_id", entries[0].TestId))
+	}
+
+	payload, err := json.Marshal(map[string]interface{}{
+		"resourceLogs": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{"attributes": resource},
+				"scopeLogs": []interface{}{
+					map[string]interface{}{
+						"scope":      map[string]interface{}{"name": "sls-local-server"},
+						"logRecords": records,
+					},
+				},
+			},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal logs: %w: %w", err, errNotRetryable)
+	}
+
+	req, err := http.NewRequest("POST", s.Endpoint, bytes.NewReader(payload))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w: %w", err, errNotRetryable)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range s.Headers {
+		req.Header.Set(key, value)
+	}
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return sinkStatusError(resp.StatusCode)
+}
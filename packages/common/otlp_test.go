@@ -0,0 +1,208 @@
+package common
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseOTLPHeaders(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want map[string]string
+	}{
+		{name: "empty", text: "", want: map[string]string{}},
+		{name: "single", text: "api-key=secret", want: map[string]string{"api-key": "secret"}},
+		{name: "several with spaces", text: " a = 1 , b=2", want: map[string]string{"a": "1", "b": "2"}},
+		{name: "percent-encoded", text: "Authorization=Basic%20dXNlcjpwYXNz,list=a%2Cb", want: map[string]string{"Authorization": "Basic dXNlcjpwYXNz", "list": "a,b"}},
+		{name: "plus is kept", text: "token=a+b", want: map[string]string{"token": "a+b"}},
+		{name: "invalid escape kept as is", text: "token=100%", want: map[string]string{"token": "100%"}},
+		{name: "equals in the value", text: "token=abc==", want: map[string]string{"token": "abc=="}},
+		{name: "missing key or value separator", text: "=1,novalue,b=2", want: map[string]string{"b": "2"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := parseOTLPHeaders(test.text); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("parseOTLPHeaders(%q) = %v, want %v", test.text, got, test.want)
+			}
+		})
+	}
+}
+
+func TestNewOTLPLogSink(t *testing.T) {
+	t.Setenv("OTEL_EXPORTER_OTLP_LOGS_ENDPOINT", "")
+	t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", "http://collector:4318/")
+	t.Setenv("OTEL_EXPORTER_OTLP_HEADERS", "a=1,b=2")
+	t.Setenv("OTEL_EXPORTER_OTLP_LOGS_HEADERS", "b=3%2C4")
+	t.Setenv("OTEL_SERVICE_NAME", "")
+
+	sink := NewOTLPLogSink()
+	if sink.Endpoint != "http://collector:4318/v1/logs" {
+		t.Errorf("Endpoint = %q", sink.Endpoint)
+	}
+	if want := map[string]string{"a": "1", "b": "3,4"}; !reflect.DeepEqual(sink.Headers, want) {
+		t.Errorf("Headers = %v, want %v", sink.Headers, want)
+	}
+	if sink.ServiceName != "sls-local-server" {
+		t.Errorf("ServiceName = %q", sink.ServiceName)
+	}
+}
+
+// otlpRequest is the part of an OTLP/HTTP JSON export the tests look at
+type otlpRequest struct {
+	ResourceLogs []struct {
+		Resource struct {
+			Attributes []otlpAttribute `json:"attributes"`
+		} `json:"resource"`
+		ScopeLogs []struct {
+			Scope struct {
+				Name string `json:"name"`
+			} `json:"scope"`
+			LogRecords []otlpLogRecord `json:"logRecords"`
+		} `json:"scopeLogs"`
+	} `json:"resourceLogs"`
+}
+
+func attributeMap(attributes []otlpAttribute) map[string]string {
+	values := map[string]string{}
+	for _, attribute := range attributes {
+		switch {
+		case attribute.Value.StringValue != nil:
+			values[attribute.Key] = *attribute.Value.StringValue
+		case attribute.Value.IntValue != nil:
+			values[attribute.Key] = *attribute.Value.IntValue
+		}
+	}
+	return values
+}
+
+func TestOTLPLogSinkSend(t *testing.T) {
+	var request *http.Request
+	var body []byte
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		request = r
+		body, _ = io.ReadAll(r.Body)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer collector.Close()
+
+	sink := &OTLPLogSink{
+		Endpoint:    collector.URL + "/v1/logs",
+		Headers:     map[string]string{"Api-Key": "secret"},
+		ServiceName: "handler",
+	}
+	captured := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	entries := []LogEntry{
+		{TestId: "test-1", PodId: "pod-1", Level: "error", Stream: StreamStderr, JobId: "job-1", TestNumber: 2, Message: "boom", Time: captured},
+		{TestId: "test-1", PodId: "pod-1", Level: "info", Stream: StreamStdout, Message: "ready", Time: captured},
+	}
+	if err := sink.Send(entries); err != nil {
+		t.Fatalf("Send() = %v", err)
+	}
+
+	if request.Method != http.MethodPost || request.URL.Path != "/v1/logs" {
+		t.Errorf("request = %s %s, want POST /v1/logs", request.Method, request.URL.Path)
+	}
+	if got := request.Header.Get("Content-Type"); got != "application/json" {
+		t.Errorf("Content-Type = %q", got)
+	}
+	if got := request.Header.Get("Api-Key"); got != "secret" {
+		t.Errorf("Api-Key = %q", got)
+	}
+
+	var export otlpRequest
+	if err := json.Unmarshal(body, &export); err != nil {
+		t.Fatalf("the collector got invalid JSON: %v\n%s", err, body)
+	}
+	if len(export.ResourceLogs) != 1 || len(export.ResourceLogs[0].ScopeLogs) != 1 {
+		t.Fatalf("want one resource and one scope, got %s", body)
+	}
+	resource := attributeMap(export.ResourceLogs[0].Resource.Attributes)
+	if want := map[string]string{"service.name": "handler", "runpod.pod_id": "pod-1", "runpod.test_id": "test-1"}; !reflect.DeepEqual(resource, want) {
+		t.Errorf("resource attributes = %v, want %v", resource, want)
+	}
+	scope := export.ResourceLogs[0].ScopeLogs[0]
+	if scope.Scope.Name != "sls-local-server" {
+		t.Errorf("scope = %q", scope.Scope.Name)
+	}
+	if len(scope.LogRecords) != 2 {
+		t.Fatalf("want 2 records, got %d", len(scope.LogRecords))
+	}
+
+	records := []struct {
+		body           string
+		severityNumber int
+		severityText   string
+		attributes     map[string]string
+	}{
+		{body: "boom", severityNumber: 17, severityText: "ERROR", attributes: map[string]string{"log.iostream": StreamStderr, "runpod.test_number": "2", "runpod.job_id": "job-1"}},
+		{body: "ready", severityNumber: 9, severityText: "INFO", attributes: map[string]string{"log.iostream": StreamStdout, "runpod.test_number": "0"}},
+	}
+	for i, want := range records {
+		record := scope.LogRecords[i]
+		if record.Body.StringValue == nil || *record.Body.StringValue != want.body {
+			t.Errorf("record %d body = %v, want %q", i, record.Body.StringValue, want.body)
+		}
+		if record.SeverityNumber != want.severityNumber || record.SeverityText != want.severityText {
+			t.Errorf("record %d severity = %d %s, want %d %s", i, record.SeverityNumber, record.SeverityText, want.severityNumber, want.severityText)
+		}
+		if record.TimeUnixNano != "1714564800000000000" {
+			t.Errorf("record %d timeUnixNano = %s", i, record.TimeUnixNano)
+		}
+		if got := attributeMap(record.Attributes); !reflect.DeepEqual(got, want.attributes) {
+			t.Errorf("record %d attributes = %v, want %v", i, got, want.attributes)
+		}
+	}
+}
+
+func TestOTLPLogSinkStatus(t *testing.T) {
+	tests := []struct {
+		status    int
+		wantErr   bool
+		retryable bool
+	}{
+		{status: http.StatusOK},
+		{status: http.StatusAccepted},
+		{status: http.StatusBadRequest, wantErr: true},
+		{status: http.StatusUnauthorized, wantErr: true},
+		{status: http.StatusRequestTimeout, wantErr: true, retryable: true},
+		{status: http.StatusTooManyRequests, wantErr: true, retryable: true},
+		{status: http.StatusInternalServerError, wantErr: true, retryable: true},
+		{status: http.StatusServiceUnavailable, wantErr: true, retryable: true},
+	}
+	for _, test := range tests {
+		t.Run(http.StatusText(test.status), func(t *testing.T) {
+			collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(test.status)
+			}))
+			defer collector.Close()
+
+			sink := &OTLPLogSink{Endpoint: collector.URL, ServiceName: "handler"}
+			err := sink.Send([]LogEntry{{Level: "info", Message: "line", Time: time.Now()}})
+			if (err != nil) != test.wantErr {
+				t.Fatalf("Send() = %v, want error %t", err, test.wantErr)
+			}
+			if err != nil && errors.Is(err, errNotRetryable) == test.retryable {
+				t.Errorf("Send() = %v, want retryable %t", err, test.retryable)
+			}
+		})
+	}
+}
+
+func TestOTLPLogSinkCollectorDown(t *testing.T) {
+	collector := httptest.NewServer(http.NotFoundHandler())
+	endpoint := collector.URL
+	collector.Close()
+
+	sink := &OTLPLogSink{Endpoint: endpoint, ServiceName: "handler"}
+	err := sink.Send([]LogEntry{{Level: "info", Message: "line", Time: time.Now()}})
+	if err == nil || errors.Is(err, errNotRetryable) {
+		t.Errorf("Send() = %v, want a retryable error", err)
+	}
+}
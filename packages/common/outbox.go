@@ -0,0 +1,387 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	deliveryAttempts       = 5
+	deliveryInitialBackoff = time.Second
+	deliveryMaxBackoff     = 16 * time.Second
+	deliveryAttemptTimeout = 30 * time.Second
+	// shutdownFlushTimeout bounds how long FlushOutbox delays the exit of the process
+	shutdownFlushTimeout = 30 * time.Second
+	// outboxRetention is how long an entry another run left for a different webhook or token is kept
+	outboxRetention = 24 * time.Hour
+	// outboxPoll is how often FlushOutbox checks whether the worker delivered the reports of this run
+	outboxPoll = 50 * time.Millisecond
+)
+
+var (
+	// runKey identifies this run in every report, the receiver keeps the report with the highest sequence
+	runKey         = newRunKey()
+	reportSequence int64
+	outbox         = &outboxQueue{notify: make(chan struct{}, 1)}
+)
+
+// errNotRetryable marks webhook answers that will not change when the same report is sent again
+var errNotRetryable = errors.New("not retryable")
+
+// outboxEntry is a report waiting to be delivered to the webhook. It is saved on disk until the webhook
+// accepted it, the JWT is read from the environment when it is sent and never written to disk.
+type outboxEntry struct {
+	WebhookUrl string `json:"webhookUrl"`
+	// TokenHash fingerprints the JWT the report was made with, so another run only replays it with the same token
+	TokenHash      string          `json:"tokenHash"`
+	IdempotencyKey string          `json:"idempotencyKey"`
+	Sequence       int64           `json:"sequence"`
+	Payload        json.RawMessage `json:"payload"`
+
+	path    string
+	created time.Time
+}
+
+// outboxQueue hands the reports of this run to a worker that delivers them, so reporting never waits for the
+// webhook. Only the latest report is pending, every report carries all the results known at the time.
+type outboxQueue struct {
+	mutex    sync.Mutex
+	pending  *outboxEntry
+	inflight *outboxEntry
+	// cancel stops the delivery in flight once a newer report supersedes it
+	cancel context.CancelFunc
+	notify chan struct{}
+	once   sync.Once
+}
+
+// enqueue saves the entry to the outbox and hands it to the worker, superseding the reports not delivered yet.
+// The entry is written before taking the lock so the worker never waits for the disk.
+func (q *outboxQueue) enqueue(entry *outboxEntry, log *zap.Logger) {
+	if err := saveOutboxEntry(entry); err != nil {
+		log.Warn("Failed to save the results to the outbox, sending them anyway", zap.Error(err))
+	}
+
+	q.mutex.Lock()
+	// a newer report saved meanwhile already carries these results
+	if (q.pending != nil && q.pending.Sequence > entry.Sequence) || (q.inflight != nil && q.inflight.Sequence > entry.Sequence) {
+		q.mutex.Unlock()
+		entry.remove()
+		return
+	}
+	superseded := q.pending
+	q.pending = entry
+	if q.inflight != nil && q.inflight.Sequence < entry.Sequence {
+		q.cancel()
+	}
+	q.mutex.Unlock()
+
+	if superseded != nil {
+		superseded.remove()
+	}
+
+	q.once.Do(func() { go q.run(log) })
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+}
+
+// run delivers the pending report whenever there is one
+func (q *outboxQueue) run(log *zap.Logger) {
+	for range q.notify {
+		for {
+			q.mutex.Lock()
+			entry := q.pending
+			if entry == nil {
+				q.mutex.Unlock()
+				break
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			q.pending, q.inflight, q.cancel = nil, entry, cancel
+			q.mutex.Unlock()
+
+			err := deliver(ctx, entry, log)
+			cancel()
+
+			q.mutex.Lock()
+			q.inflight, q.cancel = nil, nil
+			superseded := q.pending != nil
+			q.mutex.Unlock()
+
+			switch {
+			case err == nil:
+				entry.remove()
+				dropSuperseded(entry.IdempotencyKey, entry.Sequence)
+				log.Info("Results sent to GraphQL", zap.Int64("sequence", entry.Sequence))
+			case superseded:
+				entry.remove()
+			case errors.Is(err, errNotRetryable):
+				entry.remove()
+				log.Error("Failed to report results", zap.String("reporter", "graphql"), zap.Int64("sequence", entry.Sequence), zap.Error(err))
+			default:
+				log.Error("Failed to report results, they stay in the outbox", zap.String("reporter", "graphql"), zap.Int64("sequence", entry.Sequence), zap.Error(err))
+			}
+		}
+	}
+}
+
+// idle tells whether the worker has no report left to deliver
+func (q *outboxQueue) idle() bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.pending == nil && q.inflight == nil
+}
+
+// stop cancels the delivery in flight, the report stays in the outbox for the next run
+func (q *outboxQueue) stop() {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.pending = nil
+	if q.cancel != nil {
+		q.cancel()
+	}
+}
+
+func outboxDir() string {
+	if dir := os.Getenv("RUNPOD_TEST_OUTBOX_DIR"); dir != "" {
+		return dir
+	}
+	return filepath.Join(os.TempDir(), "sls-local-server-outbox")
+}
+
+// nextReportSequence returns the sequence of the next report of this run
+func nextReportSequence() int64 {
+	return atomic.AddInt64(&reportSequence, 1)
+}
+
+// saveOutboxEntry writes the entry to the outbox, the name keeps the entries in the order they were created
+func saveOutboxEntry(entry *outboxEntry) error {
+	dir := outboxDir()
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(dir, fmt.Sprintf("%020d-%s-%06d.json", time.Now().UnixNano(), entry.IdempotencyKey, entry.Sequence))
+	// write then rename so a crash never leaves a partial entry behind
+	if err := os.WriteFile(path+".tmp", data, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return err
+	}
+	entry.path = path
+	entry.created = time.Now()
+	return nil
+}
+
+func loadOutboxEntries() ([]*outboxEntry, error) {
+	paths, err := filepath.Glob(filepath.Join(outboxDir(), "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths)
+
+	entries := make([]*outboxEntry, 0, len(paths))
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		entry := &outboxEntry{}
+		if err := json.Unmarshal(data, entry); err != nil {
+			// an unreadable entry can never be delivered
+			os.Remove(path)
+			continue
+		}
+		entry.path = path
+		if info, err := os.Stat(path); err == nil {
+			entry.created = info.ModTime()
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+func (entry *outboxEntry) remove() {
+	if entry.path != "" {
+		os.Remove(entry.path)
+	}
+}
+
+// dropSuperseded removes the saved entries of a run that are older than sequence, every report carries all
+// the results known at the time so only the latest one of a run matters
+func dropSuperseded(idempotencyKey string, sequence int64) {
+	entries, err := loadOutboxEntries()
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		if entry.IdempotencyKey == idempotencyKey && entry.Sequence < sequence {
+			entry.remove()
+		}
+	}
+}
+
+// tokenHash fingerprints the JWT of this run, the token itself is never written to disk
+func tokenHash() string {
+	sum := sha256.Sum256([]byte(os.Getenv("RUNPOD_JWT_TOKEN")))
+	return fmt.Sprintf("%x", sum[:8])
+}
+
+// replayable tells whether this run can deliver an entry: it has to go to the same webhook with the same token,
+// the reports of other tests or of an expired token would be rejected or land in the wrong place
+func (entry *outboxEntry) replayable() bool {
+	return entry.WebhookUrl == os.Getenv("RUNPOD_TEST_WEBHOOK_URL") && entry.TokenHash == tokenHash()
+}
+
+// FlushOutbox waits for the worker to deliver the reports of this run, then delivers the ones left in the outbox
+// by previous runs with the same webhook and token. Entries for another webhook or token are dropped once they
+// are older than outboxRetention. It is called before the process exits and gives up when ctx is done or after
+// shutdownFlushTimeout, the reports not delivered by then stay in the outbox.
+func FlushOutbox(ctx context.Context, log *zap.Logger) {
+	ctx, cancel := context.WithTimeout(ctx, shutdownFlushTimeout)
+	defer cancel()
+
+	for !outbox.idle() {
+		select {
+		case <-ctx.Done():
+			outbox.stop()
+			log.Error("Gave up delivering the results, they stay in the outbox", zap.Error(ctx.Err()))
+			return
+		case <-time.After(outboxPoll):
+		}
+	}
+
+	entries, err := loadOutboxEntries()
+	if err != nil {
+		log.Error("Failed to read the outbox", zap.Error(err))
+		return
+	}
+
+	latest := map[string]*outboxEntry{}
+	for _, entry := range entries {
+		if !entry.replayable() {
+			if time.Since(entry.created) > outboxRetention {
+				log.Warn("Dropping stale results from the outbox", zap.String("path", entry.path))
+				entry.remove()
+			}
+			continue
+		}
+		if previous, exists := latest[entry.IdempotencyKey]; exists {
+			if previous.Sequence > entry.Sequence {
+				entry.remove()
+				continue
+			}
+			previous.remove()
+		}
+		latest[entry.IdempotencyKey] = entry
+	}
+
+	for _, entry := range entries {
+		if latest[entry.IdempotencyKey] != entry {
+			continue
+		}
+		if ctx.Err() != nil {
+			log.Error("Gave up delivering the results left in the outbox", zap.Error(ctx.Err()))
+			return
+		}
+		if err := deliver(ctx, entry, log); err != nil {
+			log.Error("Failed to deliver results from the outbox", zap.String("path", entry.path), zap.Error(err))
+			if errors.Is(err, errNotRetryable) {
+				entry.remove()
+			}
+			continue
+		}
+		entry.remove()
+		log.Info("Delivered results from the outbox", zap.String("idempotency_key", entry.IdempotencyKey), zap.Int64("sequence", entry.Sequence))
+	}
+}
+
+// deliver posts the entry to the webhook, retrying with exponential backoff on network errors,
+// 429 and 5xx answers until deliveryAttempts is reached or ctx is done
+func deliver(ctx context.Context, entry *outboxEntry, log *zap.Logger) error {
+	backoff := deliveryInitialBackoff
+
+	var err error
+	for attempt := 1; attempt <= deliveryAttempts; attempt++ {
+		err = post(ctx, entry)
+		if err == nil || errors.Is(err, errNotRetryable) {
+			return err
+		}
+		if attempt == deliveryAttempts {
+			break
+		}
+
+		log.Warn("Failed to send results, retrying",
+			zap.Int("attempt", attempt),
+			zap.Duration("backoff", backoff),
+			zap.Error(err))
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return fmt.Errorf("%w (%s)", err, ctx.Err().Error())
+		}
+		backoff = min(backoff*2, deliveryMaxBackoff)
+	}
+	return fmt.Errorf("gave up after %d attempts: %w", deliveryAttempts, err)
+}
+
+func post(ctx context.Context, entry *outboxEntry) error {
+	ctx, cancel := context.WithTimeout(ctx, deliveryAttemptTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "POST", entry.WebhookUrl, bytes.NewReader(entry.Payload))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w: %w", err, errNotRetryable)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+os.Getenv("RUNPOD_JWT_TOKEN"))
+	req.Header.Set("Idempotency-Key", fmt.Sprintf("%s-%d", entry.IdempotencyKey, entry.Sequence))
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500 {
+		return fmt.Errorf("request failed with status %d", resp.StatusCode)
+	}
+	return fmt.Errorf("request failed with status %d: %w", resp.StatusCode, errNotRetryable)
+}
+
+// newRunKey returns a random key, prefixed with the test id when there is one
+func newRunKey() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%d", time.Now().UnixNano())
+	}
+	key := fmt.Sprintf("%x", b)
+	if testId := os.Getenv("RUNPOD_TEST_ID"); testId != "" {
+		key = strings.NewReplacer("/", "_", "\\", "_").Replace(testId) + "-" + key
+	}
+	return key
+}
@@ -0,0 +1,160 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// outboxFiles returns the idempotency key and sequence of the entries saved in the outbox
+func outboxFiles(t *testing.T) []string {
+	t.Helper()
+	entries, err := loadOutboxEntries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		files = append(files, fmt.Sprintf("%s-%d", entry.IdempotencyKey, entry.Sequence))
+	}
+	return files
+}
+
+func TestOutboxQueueSupersedes(t *testing.T) {
+	tests := []struct {
+		name      string
+		inflight  int64
+		sequences []int64
+		pending   int64
+		cancelled bool
+		files     []string
+	}{
+		{name: "first report", sequences: []int64{1}, pending: 1, files: []string{"run-1"}},
+		{name: "a newer report supersedes the pending one", sequences: []int64{1, 2, 3}, pending: 3, files: []string{"run-3"}},
+		{name: "an older report saved late is dropped", sequences: []int64{2, 1}, pending: 2, files: []string{"run-2"}},
+		{name: "a newer report cancels the delivery in flight", inflight: 1, sequences: []int64{2}, pending: 2, cancelled: true, files: []string{"run-2"}},
+		{name: "an older report than the one in flight is dropped", inflight: 3, sequences: []int64{2}, files: []string{}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("RUNPOD_TEST_OUTBOX_DIR", t.TempDir())
+			log := zap.NewNop()
+			q := &outboxQueue{notify: make(chan struct{}, 1)}
+			// no worker, the test looks at what it would deliver
+			q.once.Do(func() {})
+			cancelled := false
+			if test.inflight != 0 {
+				q.inflight = &outboxEntry{IdempotencyKey: "run", Sequence: test.inflight}
+				q.cancel = func() { cancelled = true }
+			}
+
+			for _, sequence := range test.sequences {
+				q.enqueue(&outboxEntry{IdempotencyKey: "run", Sequence: sequence, Payload: []byte("{}")}, log)
+			}
+
+			pending := int64(0)
+			if q.pending != nil {
+				pending = q.pending.Sequence
+			}
+			if pending != test.pending || cancelled != test.cancelled {
+				t.Fatalf("pending %d, cancelled %t, want %d, %t", pending, cancelled, test.pending, test.cancelled)
+			}
+			if files := outboxFiles(t); !reflect.DeepEqual(files, test.files) {
+				t.Fatalf("outbox has %v, want %v", files, test.files)
+			}
+		})
+	}
+}
+
+func TestFlushOutboxReplay(t *testing.T) {
+	type saved struct {
+		key      string
+		sequence int64
+		// other saves the entry for another webhook and token
+		other bool
+		age   time.Duration
+	}
+
+	tests := []struct {
+		name      string
+		saved     []saved
+		status    int
+		delivered []string
+		files     []string
+	}{
+		{
+			name:      "only the latest report of a run is delivered",
+			saved:     []saved{{key: "a", sequence: 1}, {key: "a", sequence: 3}, {key: "a", sequence: 2}, {key: "b", sequence: 1}},
+			status:    http.StatusOK,
+			delivered: []string{"a-3", "b-1"},
+			files:     []string{},
+		},
+		{
+			name:      "a rejected report is dropped",
+			saved:     []saved{{key: "a", sequence: 1}},
+			status:    http.StatusUnauthorized,
+			delivered: []string{"a-1"},
+			files:     []string{},
+		},
+		{
+			name:      "reports of another webhook are kept until they are stale",
+			saved:     []saved{{key: "a", sequence: 1, other: true}, {key: "b", sequence: 1, other: true, age: outboxRetention + time.Hour}},
+			status:    http.StatusOK,
+			delivered: []string{},
+			files:     []string{"a-1"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var mutex sync.Mutex
+			delivered := make([]string, 0)
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mutex.Lock()
+				delivered = append(delivered, r.Header.Get("Idempotency-Key"))
+				mutex.Unlock()
+				w.WriteHeader(test.status)
+			}))
+			defer server.Close()
+
+			t.Setenv("RUNPOD_TEST_OUTBOX_DIR", t.TempDir())
+			t.Setenv("RUNPOD_TEST_WEBHOOK_URL", server.URL)
+			t.Setenv("RUNPOD_JWT_TOKEN", "token")
+			for _, s := range test.saved {
+				entry := &outboxEntry{WebhookUrl: server.URL, TokenHash: tokenHash(), IdempotencyKey: s.key, Sequence: s.sequence, Payload: []byte("{}")}
+				if s.other {
+					entry.WebhookUrl, entry.TokenHash = "http://other.invalid", "other"
+				}
+				if err := saveOutboxEntry(entry); err != nil {
+					t.Fatal(err)
+				}
+				modified := time.Now().Add(-s.age)
+				os.Chtimes(entry.path, modified, modified)
+			}
+
+			FlushOutbox(context.Background(), zap.NewNop())
+
+			sort.Strings(delivered)
+			if !reflect.DeepEqual(delivered, test.delivered) {
+				t.Fatalf("delivered %v, want %v", delivered, test.delivered)
+			}
+			if files := outboxFiles(t); !reflect.DeepEqual(files, test.files) {
+				t.Fatalf("outbox has %v, want %v", files, test.files)
+			}
+			if leftovers, _ := filepath.Glob(filepath.Join(os.Getenv("RUNPOD_TEST_OUTBOX_DIR"), "*.tmp")); len(leftovers) != 0 {
+				t.Fatalf("temporary files %v are left in the outbox", leftovers)
+			}
+		})
+	}
+}
@@ -0,0 +1,279 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// RedactedMarker replaces every secret removed from the logs and the reported results
+const RedactedMarker = "[REDACTED]"
+
+// minSecretLength keeps short values such as "true" or "runpod" from being masked everywhere
+const minSecretLength = 8
+
+// secretEnvNames are always treated as secrets on top of the names matching secretEnvName
+var secretEnvNames = map[string]bool{
+	"RUNPOD_JWT_TOKEN":       true,
+	"RUNPOD_TINYBIRD_TOKEN":  true,
+	"RUNPOD_IDE_POD_JWT":     true,
+	"RUNPOD_API_KEY":         true,
+	"HF_TOKEN":               true,
+	"HUGGING_FACE_HUB_TOKEN": true,
+	"AWS_ACCESS_KEY_ID":      true,
+	"AWS_SECRET_ACCESS_KEY":  true,
+	"AWS_SESSION_TOKEN":      true,
+}
+
+// secretEnvName matches the env variables that hold a secret by convention
+var secretEnvName = regexp.MustCompile(`(?i)(^|_)(TOKEN|SECRET|PASSWORD|PASSWD|API_?KEY|ACCESS_KEY|PRIVATE_KEY|CREDENTIALS?)(_|$)`)
+
+// tokenPatterns find well known secrets, only the secret group is masked when the pattern has one
+var tokenPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`(?i)\bbearer\s+(?P<secret>[A-Za-z0-9\-._~+/]{16,}=*)`),
+	regexp.MustCompile(`\beyJ[A-Za-z0-9_-]+\.eyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+`),
+	regexp.MustCompile(`\b(?:AKIA|ASIA)[0-9A-Z]{16}\b`),
+	regexp.MustCompile(`(?i)aws_secret_access_key["']?\s*[:=]\s*["']?(?P<secret>[A-Za-z0-9/+=]{40})`),
+	regexp.MustCompile(`\bhf_[A-Za-z0-9]{30,}\b`),
+	regexp.MustCompile(`\brpa_[A-Za-z0-9]{20,}\b`),
+	// signatures and credentials of presigned S3, GCS and Azure URLs
+	regexp.MustCompile(`(?i)[?&](?:X-Amz-Signature|X-Amz-Credential|X-Amz-Security-Token|X-Goog-Signature|X-Goog-Credential|Signature|sig)=(?P<secret>[^&\s"'<>]+)`),
+}
+
+// redactor masks secrets in the text leaving the process, through the log sinks or the result reporters
+type redactor struct {
+	mutex    sync.RWMutex
+	values   []string
+	replacer *strings.Replacer
+	patterns []*regexp.Regexp
+}
+
+var secrets = newRedactor()
+
+// newRedactor picks up the secret env variables of the process, the ones listed in RUNPOD_REDACT_ENV and the
+// regexes in RUNPOD_REDACT_PATTERNS, one per line
+func newRedactor() *redactor {
+	r := &redactor{patterns: append([]*regexp.Regexp(nil), tokenPatterns...)}
+
+	listed := map[string]bool{}
+	for _, name := range strings.Split(os.Getenv("RUNPOD_REDACT_ENV"), ",") {
+		listed[strings.TrimSpace(name)] = true
+	}
+	for _, variable := range os.Environ() {
+		name, value, _ := strings.Cut(variable, "=")
+		if listed[name] || isSecretEnvName(name) {
+			r.addValues(value)
+		}
+	}
+
+	for _, pattern := range strings.Split(os.Getenv("RUNPOD_REDACT_PATTERNS"), "\n") {
+		if pattern = strings.TrimSpace(pattern); pattern == "" {
+			continue
+		}
+		if compiled, err := compileRedactPattern(pattern); err == nil {
+			r.patterns = append(r.patterns, compiled)
+		} else {
+			// the logger is not set up yet when the package variables are initialized
+			fmt.Fprintf(os.Stderr, "Ignoring invalid redaction pattern %q from RUNPOD_REDACT_PATTERNS: %s\n", pattern, err.Error())
+		}
+	}
+	return r
+}
+
+func isSecretEnvName(name string) bool {
+	return secretEnvNames[name] || secretEnvName.MatchString(name)
+}
+
+// addValues masks the values from now on, the longest first so a secret containing another is masked whole
+func (r *redactor) addValues(values ...string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for _, value := range values {
+		if len(value) >= minSecretLength {
+			r.values = append(r.values, value)
+		}
+	}
+	sort.SliceStable(r.values, func(a, b int) bool {
+		return len(r.values[a]) > len(r.values[b])
+	})
+
+	pairs := make([]string, 0, len(r.values)*2)
+	for _, value := range r.values {
+		pairs = append(pairs, value, RedactedMarker)
+	}
+	r.replacer = strings.NewReplacer(pairs...)
+}
+
+// AddSecretEnv masks the value of an env variable of the test config when it is marked as secret, its name
+// looks like a secret or it is listed in RUNPOD_REDACT_ENV
+func AddSecretEnv(env EnvVar) {
+	listed := false
+	for _, name := range strings.Split(os.Getenv("RUNPOD_REDACT_ENV"), ",") {
+		listed = listed || strings.TrimSpace(name) == env.Key
+	}
+	if env.Secret || listed || isSecretEnvName(env.Key) {
+		secrets.addValues(env.Value)
+	}
+}
+
+// AddRedactPatterns masks what the regexes match from now on
+func AddRedactPatterns(patterns ...string) error {
+	compiled := make([]*regexp.Regexp, 0, len(patterns))
+	for _, pattern := range patterns {
+		expression, err := compileRedactPattern(pattern)
+		if err != nil {
+			return fmt.Errorf("invalid redaction pattern %q: %w", pattern, err)
+		}
+		compiled = append(compiled, expression)
+	}
+
+	secrets.mutex.Lock()
+	defer secrets.mutex.Unlock()
+	secrets.patterns = append(secrets.patterns, compiled...)
+	return nil
+}
+
+// compileRedactPattern compiles a redaction regex, a pattern matching the empty string would put a marker between
+// every character of the logs
+func compileRedactPattern(pattern string) (*regexp.Regexp, error) {
+	expression, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	if expression.MatchString("") {
+		return nil, errors.New("it matches the empty string")
+	}
+	return expression, nil
+}
+
+// Redact masks the secrets in text and tells whether it found any
+func Redact(text string) (string, bool) {
+	secrets.mutex.RLock()
+	defer secrets.mutex.RUnlock()
+
+	redacted := text
+	if secrets.replacer != nil {
+		redacted = secrets.replacer.Replace(redacted)
+	}
+	for _, pattern := range secrets.patterns {
+		redacted = replaceSecret(pattern, redacted)
+	}
+	return redacted, redacted != text
+}
+
+// replaceSecret masks the secret group of the matches, or the whole match when the pattern has no such group
+func replaceSecret(pattern *regexp.Regexp, text string) string {
+	group := pattern.SubexpIndex("secret")
+
+	var builder strings.Builder
+	last := 0
+	for _, match := range pattern.FindAllStringSubmatchIndex(text, -1) {
+		start, end := match[0], match[1]
+		if group > 0 && match[2*group] >= 0 {
+			start, end = match[2*group], match[2*group+1]
+		}
+		if start < last {
+			continue
+		}
+		builder.WriteString(text[last:start])
+		builder.WriteString(RedactedMarker)
+		last = end
+	}
+	if last == 0 {
+		return text
+	}
+	builder.WriteString(text[last:])
+	return builder.String()
+}
+
+// RedactValue masks the secrets in the strings of a decoded JSON value, it returns a copy when it found any
+func RedactValue(value interface{}) (interface{}, bool) {
+	switch v := value.(type) {
+	case string:
+		return Redact(v)
+	case map[string]interface{}:
+		redacted := make(map[string]interface{}, len(v))
+		changed := false
+		for key, item := range v {
+			var itemChanged bool
+			redacted[key], itemChanged = RedactValue(item)
+			changed = changed || itemChanged
+		}
+		if !changed {
+			return value, false
+		}
+		return redacted, true
+	case []interface{}:
+		redacted := make([]interface{}, len(v))
+		changed := false
+		for i, item := range v {
+			var itemChanged bool
+			redacted[i], itemChanged = RedactValue(item)
+			changed = changed || itemChanged
+		}
+		if !changed {
+			return value, false
+		}
+		return redacted, true
+	case Failure:
+		failure := Failure{Message: v.Message, Mismatches: make([]Mismatch, len(v.Mismatches))}
+		changed := false
+		for i, mismatch := range v.Mismatches {
+			var expected, actual, message bool
+			mismatch.Expected, expected = RedactValue(mismatch.Expected)
+			mismatch.Actual, actual = RedactValue(mismatch.Actual)
+			mismatch.Message, message = Redact(mismatch.Message)
+			failure.Mismatches[i] = mismatch
+			changed = changed || expected || actual || message
+		}
+		if !changed {
+			return value, false
+		}
+		return failure, true
+	default:
+		return value, false
+	}
+}
+
+// redactResults returns a copy of the results with the secrets masked, the results that had any are marked
+// as Redacted so reviewers know something was removed
+func redactResults(results []Result) []Result {
+	redacted := make([]Result, len(results))
+	for i, result := range results {
+		var input, output, resultError, logs, stream bool
+		result.Input, input = RedactValue(result.Input)
+		result.Output, output = RedactValue(result.Output)
+		result.Error, resultError = RedactValue(result.Error)
+
+		if len(result.Logs) > 0 {
+			lines := make([]string, len(result.Logs))
+			for j, line := range result.Logs {
+				var changed bool
+				lines[j], changed = Redact(line)
+				logs = logs || changed
+			}
+			result.Logs = lines
+		}
+
+		if result.Stream != nil {
+			streamStats := *result.Stream
+			streamStats.Chunks = make([]StreamChunk, len(result.Stream.Chunks))
+			for j, chunk := range result.Stream.Chunks {
+				var changed bool
+				chunk.Output, changed = RedactValue(chunk.Output)
+				streamStats.Chunks[j] = chunk
+				stream = stream || changed
+			}
+			result.Stream = &streamStats
+		}
+
+		result.Redacted = result.Redacted || input || output || resultError || logs || stream
+		redacted[i] = result
+	}
+	return redacted
+}
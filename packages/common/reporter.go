@@ -0,0 +1,135 @@
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+// Statuses of a test run, only PASSED, FAILED and ERRORED are final. Reports with another status are progress updates.
+const (
+	RunInitializing = "INITIALIZING"
+	RunRunning      = "RUNNING"
+	RunPassed       = "PASSED"
+	RunFailed       = "FAILED"
+	RunErrored      = "ERRORED"
+)
+
+func IsFinalRunStatus(status string) bool {
+	return status == RunPassed || status == RunFailed || status == RunErrored
+}
+
+// CommandFailed reports that the handler command stopped or could not start.
+// The test run replaces it so the failure ends the run instead of being reported on its own.
+var CommandFailed = func(errorMsg string, results []Result, log *zap.Logger) {
+	ReportResults(RunErrored, &errorMsg, log, results)
+}
+
+// Reporter sends the results of a test run out of the process.
+// Reporters that only handle final results ignore the progress updates, see IsFinalRunStatus.
+type Reporter interface {
+	Name() string
+	Report(status string, errorReason *string, results []Result, log *zap.Logger) error
+}
+
+var (
+	reportersMutex = &sync.Mutex{}
+	reporters      []Reporter
+)
+
+// RegisterReporter adds a reporter on top of the ones configured through the environment
+func RegisterReporter(reporter Reporter) {
+	reportersMutex.Lock()
+	defer reportersMutex.Unlock()
+	reporters = append(reporters, reporter)
+}
+
+// configuredReporters returns the registered reporters followed by the ones enabled in the environment.
+// The files are written before the webhook is called since its delivery can be retried for a while.
+func configuredReporters() []Reporter {
+	reportersMutex.Lock()
+	configured := append([]Reporter(nil), reporters...)
+	reportersMutex.Unlock()
+
+	if path := os.Getenv("RUNPOD_TEST_JUNIT_FILE"); path != "" {
+		configured = append(configured, &JUnitReporter{Path: path})
+	}
+	if path := os.Getenv("RUNPOD_TEST_HTML_FILE"); path != "" {
+		configured = append(configured, &HTMLReporter{Path: path})
+	}
+	if LocalReporting() {
+		configured = append(configured, &TerminalReporter{})
+	}
+	if webhookUrl := os.Getenv("RUNPOD_TEST_WEBHOOK_URL"); webhookUrl != "" {
+		configured = append(configured, &GraphQLReporter{WebhookUrl: webhookUrl})
+	}
+	return configured
+}
+
+// ReportResults hands the results to every configured reporter, a failing reporter does not stop the others.
+// The secrets are masked before any reporter sees the results.
+func ReportResults(status string, errorReason *string, log *zap.Logger, results []Result) {
+	configured := configuredReporters()
+	if len(configured) == 0 {
+		log.Error("No result reporter configured, set RUNPOD_TEST_WEBHOOK_URL, RUNPOD_TEST_JUNIT_FILE or RUNPOD_TEST_HTML_FILE")
+		return
+	}
+
+	results = redactResults(results)
+	if errorReason != nil {
+		redactedReason, _ := Redact(*errorReason)
+		errorReason = &redactedReason
+	}
+
+	for _, reporter := range configured {
+		if err := reporter.Report(status, errorReason, results, log); err != nil {
+			log.Error("Failed to report results", zap.String("reporter", reporter.Name()), zap.Error(err))
+		}
+	}
+}
+
+// GraphQLReporter posts the results to the runpod test webhook
+type GraphQLReporter struct {
+	WebhookUrl string
+}
+
+func (r *GraphQLReporter) Name() string {
+	return "graphql"
+}
+
+// Report saves the results to the outbox and hands them to the worker that sends them to the webhook with retries,
+// it does not wait for the delivery. Every report carries the run key and a sequence number, so the receiver can
+// ignore duplicates and reports older than one it already has. A report that could not be delivered stays in the
+// outbox until FlushOutbox.
+func (r *GraphQLReporter) Report(status string, errorReason *string, results []Result, log *zap.Logger) error {
+	sequence := nextReportSequence()
+	payload, err := json.Marshal(map[string]interface{}{
+		"podId":           os.Getenv("RUNPOD_POD_ID"),
+		"testId":          os.Getenv("RUNPOD_TEST_ID"),
+		"results":         results,
+		"status":          status,
+		"final":           IsFinalRunStatus(status),
+		"error":           errorReason,
+		"droppedLogLines": DroppedLogLines(),
+		"restarts":        HandlerRestarts(),
+		"memoryWarning":   MemoryWarning(results),
+		"idempotencyKey":  runKey,
+		"sequence":        sequence,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal results: %w", err)
+	}
+
+	outbox.enqueue(&outboxEntry{
+		WebhookUrl:     r.WebhookUrl,
+		TokenHash:      tokenHash(),
+		IdempotencyKey: runKey,
+		Sequence:       sequence,
+		Payload:        payload,
+	}, log)
+	log.Debug("Results queued for GraphQL", zap.Int64("sequence", sequence), zap.Any("results", results))
+	return nil
+}
@@ -0,0 +1,232 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// defaultShutdownTimeoutSeconds bounds the whole shutdown, under the 10 seconds docker stop waits before it
+	// kills the container
+	defaultShutdownTimeoutSeconds = 9
+	// defaultShutdownGraceSeconds is how long the commands have to exit after the signal before they are killed,
+	// the rest of the shutdown timeout goes to the logs and the reports
+	defaultShutdownGraceSeconds = 5
+	// logDrainTimeout bounds how long the sinks have to take the last logs before they are spooled for the next run
+	logDrainTimeout = 5 * time.Second
+	// shutdownReserve is the part of the shutdown timeout the grace never takes, for the logs and the reports
+	shutdownReserve = 2 * time.Second
+	// killWait is how long the output of a killed command is read before giving up on it, a process that left
+	// the group can keep it open
+	killWait = time.Second
+	// processGroupPoll is how often a stopping process group is checked for processes left
+	processGroupPoll = 100 * time.Millisecond
+)
+
+// trackedCommand is a command started in its own process group, done is closed once it exited and its output
+// was read to the end
+type trackedCommand struct {
+	cmd  *exec.Cmd
+	done chan struct{}
+}
+
+var (
+	commandMutex    = &sync.Mutex{}
+	runningCommands = make(map[*trackedCommand]bool)
+	commandStopping bool
+	exitOnce        = &sync.Once{}
+)
+
+// startCommand starts cmd and remembers it so it can be stopped along with the processes it started. Once the
+// commands are being stopped no command starts anymore.
+func startCommand(cmd *exec.Cmd) (*trackedCommand, error) {
+	commandMutex.Lock()
+	defer commandMutex.Unlock()
+	if commandStopping {
+		return nil, errors.New("the server is shutting down")
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	tracked := &trackedCommand{cmd: cmd, done: make(chan struct{})}
+	runningCommands[tracked] = true
+	return tracked, nil
+}
+
+// finished forgets the command, its output was read to the end
+func (c *trackedCommand) finished() {
+	commandMutex.Lock()
+	defer commandMutex.Unlock()
+	delete(runningCommands, c)
+	close(c.done)
+}
+
+func isCommandStopping() bool {
+	commandMutex.Lock()
+	defer commandMutex.Unlock()
+	return commandStopping
+}
+
+// signalGroup sends sig to every process of the group of the command, the processes that are gone are ignored
+func (c *trackedCommand) signalGroup(sig syscall.Signal, log *zap.Logger) {
+	err := syscall.Kill(-c.cmd.Process.Pid, sig)
+	if err != nil && err != syscall.ESRCH {
+		log.Error("Failed to signal the process group", zap.Int("pid", c.cmd.Process.Pid), zap.String("signal", sig.String()), zap.Error(err))
+	}
+}
+
+// groupAlive tells whether a process of the group of the command is still running
+func (c *trackedCommand) groupAlive() bool {
+	return processGroupAlive(c.cmd.Process.Pid)
+}
+
+// processGroupAlive tells whether a process of the group is still running. The zombies do not count: as PID 1 of
+// a container the server inherits the orphans of the group and nothing reaps them, kill(-pgid, 0) would keep
+// finding them.
+func processGroupAlive(pgid int) bool {
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return syscall.Kill(-pgid, 0) == nil
+	}
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		if stat, err := readProcessStat(pid); err == nil && stat.ProcessGroup == pgid && stat.State != 'Z' {
+			return true
+		}
+	}
+	return false
+}
+
+// shutdownGrace reads RUNPOD_SHUTDOWN_GRACE_SECONDS
+func shutdownGrace() time.Duration {
+	return time.Duration(envInt("RUNPOD_SHUTDOWN_GRACE_SECONDS", defaultShutdownGraceSeconds)) * time.Second
+}
+
+// stopCommands forwards sig to the process groups of the running commands so the processes they started with
+// sh -c get it too. The groups still running at deadline are killed. It returns once the output of the commands
+// was read to the end, or killWait after deadline. The commands exiting from now on are not reported as failed
+// nor restarted.
+func stopCommands(sig syscall.Signal, deadline time.Time, log *zap.Logger) {
+	commandMutex.Lock()
+	commandStopping = true
+	commands := make([]*trackedCommand, 0, len(runningCommands))
+	for tracked := range runningCommands {
+		commands = append(commands, tracked)
+	}
+	commandMutex.Unlock()
+
+	for _, tracked := range commands {
+		log.Info("Stopping the command", zap.Int("pid", tracked.cmd.Process.Pid), zap.String("signal", sig.String()), zap.Duration("grace", time.Until(deadline)))
+		tracked.signalGroup(sig, log)
+	}
+
+	for _, tracked := range commands {
+		select {
+		case <-tracked.done:
+		case <-time.After(time.Until(deadline)):
+		}
+		// the processes the command started can outlive it
+		for tracked.groupAlive() && time.Now().Before(deadline) {
+			time.Sleep(processGroupPoll)
+		}
+		if tracked.groupAlive() {
+			log.Warn("The command did not stop in time, killing it", zap.Int("pid", tracked.cmd.Process.Pid))
+			tracked.signalGroup(syscall.SIGKILL, log)
+		}
+	}
+
+	// the output of a killed group closes right away unless a process that left it holds it open
+	killed := time.Now().Add(killWait)
+	for _, tracked := range commands {
+		select {
+		case <-tracked.done:
+		case <-time.After(time.Until(killed)):
+			log.Warn("The output of the command was not read to the end", zap.Int("pid", tracked.cmd.Process.Pid))
+		}
+	}
+}
+
+// killCommands kills the process groups of the running commands without waiting for them
+func killCommands(log *zap.Logger) {
+	commandMutex.Lock()
+	defer commandMutex.Unlock()
+	commandStopping = true
+	for tracked := range runningCommands {
+		tracked.signalGroup(syscall.SIGKILL, log)
+	}
+}
+
+// drainLogs hands the events the commands printed to the sinks and waits for them to be sent, the ones that
+// were not are spooled by PersistLogs. When ctx has a deadline the logs get at most half of the time left, the
+// reports need the rest.
+func drainLogs(ctx context.Context) {
+	deadline := time.Now().Add(logDrainTimeout)
+	if ctxDeadline, ok := ctx.Deadline(); ok && time.Until(ctxDeadline)/2 < logDrainTimeout {
+		deadline = time.Now().Add(time.Until(ctxDeadline) / 2)
+	}
+	flushLogForwarders(deadline)
+	waitForLogSinks(deadline)
+}
+
+// HandleShutdownSignals shuts down the server gracefully on SIGINT and SIGTERM, a second signal kills the commands
+// and exits right away
+func HandleShutdownSignals(log *zap.Logger) {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		go Shutdown(sig.(syscall.Signal), log)
+
+		sig = <-signals
+		fmt.Printf("Received %s again, exiting now\n", sig.String())
+		log.Warn("Received a second signal, exiting without waiting for the shutdown", zap.String("signal", sig.String()))
+		killCommands(log)
+		log.Sync()
+		os.Exit(1)
+	}()
+}
+
+// Shutdown forwards sig to the commands and waits for them to stop, then ends the test run with the reason and
+// sends a final shutdown event to the log sinks before exiting. A run that already finished keeps its status.
+// The whole shutdown takes at most RUNPOD_SHUTDOWN_TIMEOUT_SECONDS, the commands get RUNPOD_SHUTDOWN_GRACE_SECONDS
+// of it to exit.
+func Shutdown(sig syscall.Signal, log *zap.Logger) {
+	reason := fmt.Sprintf("Shutting down: received %s", sig.String())
+	fmt.Println(reason)
+	log.Info("Received signal, shutting down", zap.String("signal", sig.String()))
+
+	timeout := time.Duration(envInt("RUNPOD_SHUTDOWN_TIMEOUT_SECONDS", defaultShutdownTimeoutSeconds)) * time.Second
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	grace := min(shutdownGrace(), max(timeout-killWait-shutdownReserve, 0))
+
+	stopCommands(sig, time.Now().Add(grace), log)
+
+	// the events are buffered in memory, taking them is quick
+	flushLogForwarders(time.Now().Add(killWait))
+	pushLogEvent(newLogEvent(StreamSystem, "warn", reason), log)
+
+	CommandFailed(reason, []Result{
+		{
+			ID:     0,
+			Name:   "initialization",
+			Error:  reason,
+			Status: "ERROR",
+		},
+	}, log)
+
+	exitWithin(ctx, 1, log)
+}
@@ -0,0 +1,241 @@
+package common
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// logRingSize is how many entries a sink keeps in memory, once it is full they are spilled to a segment on disk
+	logRingSize = 4096
+	// defaultLogSpoolMaxMB bounds the segments of a sink on disk, the entries over it are dropped
+	defaultLogSpoolMaxMB = 512
+
+	logRetryInitialBackoff = time.Second
+	logRetryMaxBackoff     = 30 * time.Second
+)
+
+// droppedLogLines counts the handler log lines that never made it to a sink
+var droppedLogLines int64
+
+// DroppedLogLines returns how many handler log lines were dropped because a log spool was full or a sink rejected them
+func DroppedLogLines() int64 {
+	return atomic.LoadInt64(&droppedLogLines)
+}
+
+func logSpoolDir(sink string) string {
+	dir := os.Getenv("RUNPOD_LOG_SPOOL_DIR")
+	if dir == "" {
+		dir = filepath.Join(os.TempDir(), "sls-local-server-log-spool")
+	}
+	return filepath.Join(dir, sink)
+}
+
+// logSpool queues the entries of a sink. The newest entries are kept in memory, when the sink is slow or offline
+// they are spilled to NDJSON segments on disk which are sent first once it recovers, so the order is kept.
+type logSpool struct {
+	mutex    sync.Mutex
+	dir      string
+	maxBytes int64
+	memory   []LogEntry
+	// sending are the entries taken from memory that the worker is sending, sendingSince is when they were taken
+	sending      []LogEntry
+	sendingSince int64
+	// sendingSegment is where persist spilled the entries being sent, it is removed once the sink took them
+	sendingSegment string
+	segments       []string
+	diskBytes      int64
+	// notify wakes up the worker when entries are pushed
+	notify chan struct{}
+	// full is true while entries are being dropped, to log it once instead of for every batch
+	full bool
+}
+
+// newLogSpool picks up the segments left by a previous run so they are replayed
+func newLogSpool(sink string) *logSpool {
+	spool := &logSpool{
+		dir:      logSpoolDir(sink),
+		maxBytes: int64(envInt("RUNPOD_LOG_SPOOL_MAX_MB", defaultLogSpoolMaxMB)) * 1024 * 1024,
+		memory:   make([]LogEntry, 0, logRingSize),
+		notify:   make(chan struct{}, 1),
+	}
+
+	paths, _ := filepath.Glob(filepath.Join(spool.dir, "*.ndjson"))
+	sort.Strings(paths)
+	for _, path := range paths {
+		if info, err := os.Stat(path); err == nil {
+			spool.segments = append(spool.segments, path)
+			spool.diskBytes += info.Size()
+		}
+	}
+	return spool
+}
+
+// push adds entries to the spool, it never blocks on the sink
+func (s *logSpool) push(entries []LogEntry, log *zap.Logger) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if len(s.memory)+len(entries) > logRingSize {
+		pending := append(s.memory, entries...)
+		s.memory = make([]LogEntry, 0, logRingSize)
+		s.spill(pending, time.Now().UnixNano(), false, log)
+	} else {
+		s.memory = append(s.memory, entries...)
+	}
+
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+}
+
+// spill writes the entries to a new segment named after stamp, the caller holds the mutex. The segment goes after
+// the others, or before them when front is set. It returns the path of the segment, empty when nothing was written.
+func (s *logSpool) spill(entries []LogEntry, stamp int64, front bool, log *zap.Logger) string {
+	if len(entries) == 0 {
+		return ""
+	}
+
+	payload, err := marshalNDJSON(entries)
+	if err == nil && s.diskBytes+int64(len(payload)) > s.maxBytes {
+		err = fmt.Errorf("the spool reached %d bytes", s.maxBytes)
+	}
+	if err == nil {
+		err = os.MkdirAll(s.dir, 0700)
+	}
+	path := filepath.Join(s.dir, fmt.Sprintf("%020d.ndjson", stamp))
+	if err == nil {
+		// write then rename so a crash never leaves a partial segment behind
+		if err = os.WriteFile(path+".tmp", payload, 0600); err == nil {
+			err = os.Rename(path+".tmp", path)
+		}
+	}
+
+	if err != nil {
+		atomic.AddInt64(&droppedLogLines, int64(len(entries)))
+		if !s.full {
+			log.Error("Failed to spool logs, dropping them", zap.String("dir", s.dir), zap.Int("entries", len(entries)), zap.Error(err))
+		}
+		s.full = true
+		return ""
+	}
+	s.full = false
+	if front {
+		s.segments = append([]string{path}, s.segments...)
+	} else {
+		s.segments = append(s.segments, path)
+	}
+	s.diskBytes += int64(len(payload))
+	return path
+}
+
+// next returns the oldest entries of the spool and a function that removes them once they were sent,
+// or nil when the spool is empty
+func (s *logSpool) next() ([]LogEntry, func()) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for len(s.segments) > 0 {
+		path := s.segments[0]
+		entries, size, err := readLogSegment(path)
+		if err != nil {
+			// an unreadable segment can never be sent
+			os.Remove(path)
+			s.segments = s.segments[1:]
+			continue
+		}
+		return entries, func() {
+			s.mutex.Lock()
+			defer s.mutex.Unlock()
+			os.Remove(path)
+			s.segments = s.segments[1:]
+			s.diskBytes -= size
+		}
+	}
+
+	if len(s.memory) == 0 {
+		return nil, nil
+	}
+	// the worker owns the entries from now on and keeps them until the sink took them. No segment was left, so the
+	// entries are older than any segment spilled while they are sent.
+	s.sending = s.memory
+	s.sendingSince = time.Now().UnixNano()
+	s.memory = make([]LogEntry, 0, logRingSize)
+	return s.sending, func() {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		s.sending = nil
+		if s.sendingSegment != "" {
+			s.removeSegment(s.sendingSegment)
+			s.sendingSegment = ""
+		}
+	}
+}
+
+// removeSegment deletes a segment whose entries the sink took, the caller holds the mutex
+func (s *logSpool) removeSegment(path string) {
+	for i, segment := range s.segments {
+		if segment == path {
+			if info, err := os.Stat(path); err == nil {
+				s.diskBytes -= info.Size()
+			}
+			os.Remove(path)
+			s.segments = append(s.segments[:i], s.segments[i+1:]...)
+			return
+		}
+	}
+}
+
+// empty tells whether the sink took every entry
+func (s *logSpool) empty() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(s.memory) == 0 && s.sending == nil && len(s.segments) == 0
+}
+
+// persist spills the entries that were not sent yet so they are replayed by the next run. The entries being sent
+// go ahead of the segments spilled since they were taken, and their segment is removed if the sink takes them after all.
+func (s *logSpool) persist(log *zap.Logger) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.sending != nil && s.sendingSegment == "" {
+		s.sendingSegment = s.spill(s.sending, s.sendingSince, true, log)
+	}
+	pending := s.memory
+	s.memory = make([]LogEntry, 0, logRingSize)
+	s.spill(pending, time.Now().UnixNano(), false, log)
+}
+
+func readLogSegment(path string) ([]LogEntry, int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer file.Close()
+
+	var size int64
+	entries := make([]LogEntry, 0)
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		size += int64(len(scanner.Bytes())) + 1
+		var entry LogEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			continue
+		}
+		entry.Time, _ = time.Parse(logTimestampLayout, entry.Timestamp)
+		entries = append(entries, entry)
+	}
+	return entries, size, scanner.Err()
+}
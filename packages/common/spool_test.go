@@ -0,0 +1,142 @@
+package common
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func logEntries(messages ...string) []LogEntry {
+	entries := make([]LogEntry, 0, len(messages))
+	for _, message := range messages {
+		entries = append(entries, LogEntry{Message: message, Timestamp: time.Now().UTC().Format(logTimestampLayout)})
+	}
+	return entries
+}
+
+// drainLogSpool takes every entry of the spool the way the worker does and returns their messages
+func drainLogSpool(s *logSpool) []string {
+	messages := make([]string, 0)
+	for {
+		entries, done := s.next()
+		if entries == nil {
+			return messages
+		}
+		for _, entry := range entries {
+			messages = append(messages, entry.Message)
+		}
+		done()
+	}
+}
+
+func TestLogSpoolOrder(t *testing.T) {
+	log := zap.NewNop()
+
+	tests := []struct {
+		name string
+		// run drives the spool and returns the one to drain, a new spool stands for the next run of the server
+		run  func(s *logSpool) *logSpool
+		want []string
+	}{
+		{
+			name: "memory only",
+			run: func(s *logSpool) *logSpool {
+				s.push(logEntries("a", "b"), log)
+				return s
+			},
+			want: []string{"a", "b"},
+		},
+		{
+			name: "segments are sent before memory",
+			run: func(s *logSpool) *logSpool {
+				s.push(logEntries("a"), log)
+				s.push(logEntries(make([]string, logRingSize)...), log)
+				s.push(logEntries("b"), log)
+				return s
+			},
+			want: append(append([]string{"a"}, make([]string, logRingSize)...), "b"),
+		},
+		{
+			name: "segments of a previous run are replayed in order",
+			run: func(s *logSpool) *logSpool {
+				s.spill(logEntries("a", "b"), time.Now().UnixNano(), false, log)
+				s.spill(logEntries("c"), time.Now().UnixNano(), false, log)
+				s.push(logEntries("d"), log)
+				s.persist(log)
+				return newLogSpool("test")
+			},
+			want: []string{"a", "b", "c", "d"},
+		},
+		{
+			name: "entries being sent are replayed before the segments spilled meanwhile",
+			run: func(s *logSpool) *logSpool {
+				s.push(logEntries("a"), log)
+				s.next()
+				s.spill(logEntries("b"), time.Now().UnixNano(), false, log)
+				s.push(logEntries("c"), log)
+				s.persist(log)
+				return newLogSpool("test")
+			},
+			want: []string{"a", "b", "c"},
+		},
+		{
+			name: "entries sent after persist are not replayed",
+			run: func(s *logSpool) *logSpool {
+				s.push(logEntries("a"), log)
+				_, done := s.next()
+				s.spill(logEntries("b"), time.Now().UnixNano(), false, log)
+				s.persist(log)
+				done()
+				return newLogSpool("test")
+			},
+			want: []string{"b"},
+		},
+		{
+			name: "persist twice spills the entries being sent once",
+			run: func(s *logSpool) *logSpool {
+				s.push(logEntries("a"), log)
+				s.next()
+				s.persist(log)
+				s.persist(log)
+				return newLogSpool("test")
+			},
+			want: []string{"a"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("RUNPOD_LOG_SPOOL_DIR", t.TempDir())
+			s := test.run(newLogSpool("test"))
+			if got := drainLogSpool(s); !reflect.DeepEqual(got, test.want) {
+				t.Fatalf("sent %d entries %q, want %d entries %q", len(got), got, len(test.want), test.want)
+			}
+			if !s.empty() || s.diskBytes != 0 {
+				t.Errorf("the spool kept %d segments of %d bytes after the entries were sent", len(s.segments), s.diskBytes)
+			}
+			if paths, _ := filepath.Glob(filepath.Join(s.dir, "*.ndjson")); len(paths) != 0 {
+				t.Errorf("segments %v are left on disk", paths)
+			}
+		})
+	}
+}
+
+func TestLogSpoolDropsOverTheLimit(t *testing.T) {
+	t.Setenv("RUNPOD_LOG_SPOOL_DIR", t.TempDir())
+	log := zap.NewNop()
+	s := newLogSpool("test")
+	s.maxBytes = 1024
+
+	dropped := DroppedLogLines()
+	s.spill(logEntries("a"), time.Now().UnixNano(), false, log)
+	s.spill(logEntries(make([]string, 100)...), time.Now().UnixNano(), false, log)
+	if !s.full || DroppedLogLines()-dropped != 100 {
+		t.Fatalf("full = %t with %d dropped lines, want the 100 lines over the limit dropped", s.full, DroppedLogLines()-dropped)
+	}
+	if got := drainLogSpool(s); !reflect.DeepEqual(got, []string{"a"}) {
+		t.Fatalf("sent %q, want the entries under the limit", got)
+	}
+}
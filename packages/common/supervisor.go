@@ -0,0 +1,253 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Restart policies of the handler, set with RUNPOD_RESTART_POLICY
+const (
+	RestartNever     = "never"
+	RestartOnFailure = "on-failure"
+	RestartAlways    = "always"
+)
+
+const (
+	defaultMaxRestarts           = 5
+	defaultRestartBackoffSeconds = 1
+	defaultMaxBackoffSeconds     = 30
+	// stableUptime is how long the handler has to run for the next restart to start over with the initial backoff
+	stableUptime = time.Minute
+	// crashLoopRestarts restarts within crashLoopWindow is a crash loop, the supervisor gives up
+	crashLoopRestarts = 5
+	crashLoopWindow   = 2 * time.Minute
+	// restartTailLines is how many of the last log lines of the handler are kept with a restart
+	restartTailLines = 20
+)
+
+// Restart records an exit of the handler that the supervisor restarted it after
+type Restart struct {
+	Attempt  int          `json:"attempt"`
+	ExitCode int          `json:"exitCode"`
+	Error    string       `json:"error,omitempty"`
+	Exit     *ProcessExit `json:"exit,omitempty"`
+	Started  time.Time    `json:"startedAt"`
+	Exited   time.Time    `json:"exitedAt"`
+	// Backoff is how long the supervisor waited before starting the handler again, in milliseconds
+	Backoff  int64    `json:"backoff"`
+	LastLogs []string `json:"lastLogs,omitempty"`
+}
+
+// Summary describes the restart in one line for the reports
+func (r Restart) Summary() string {
+	exit := fmt.Sprintf("exited with code %d", r.ExitCode)
+	if r.Exit != nil {
+		exit = r.Exit.Summary()
+	}
+	return fmt.Sprintf("Restart %d: the handler %s after %s, started again after %s", r.Attempt, exit,
+		r.Exited.Sub(r.Started).Round(time.Millisecond), time.Duration(r.Backoff)*time.Millisecond)
+}
+
+// HandlerRestarting is called once the handler exited and is about to be restarted, the jobs it was running died
+// with it. The job API replaces it to queue them again or fail them.
+var HandlerRestarting = func(log *zap.Logger) {}
+
+var (
+	restartsMutex = &sync.Mutex{}
+	restarts      = make([]Restart, 0)
+)
+
+// HandlerRestarts returns the restarts of the handler so far
+func HandlerRestarts() []Restart {
+	restartsMutex.Lock()
+	defer restartsMutex.Unlock()
+	return append([]Restart(nil), restarts...)
+}
+
+func recordRestart(restart Restart) {
+	restartsMutex.Lock()
+	defer restartsMutex.Unlock()
+	restarts = append(restarts, restart)
+}
+
+// restartPolicy decides whether the handler is started again once it exited
+type restartPolicy struct {
+	Mode        string
+	MaxRestarts int
+	Backoff     time.Duration
+	MaxBackoff  time.Duration
+}
+
+// restartPolicyFromEnv reads RUNPOD_RESTART_POLICY, RUNPOD_RESTART_MAX_RETRIES, RUNPOD_RESTART_BACKOFF_SECONDS and
+// RUNPOD_RESTART_MAX_BACKOFF_SECONDS. The handler is never restarted by default, like before the supervisor existed.
+func restartPolicyFromEnv(log *zap.Logger) restartPolicy {
+	policy := restartPolicy{
+		Mode:        strings.ToLower(strings.TrimSpace(os.Getenv("RUNPOD_RESTART_POLICY"))),
+		MaxRestarts: envInt("RUNPOD_RESTART_MAX_RETRIES", defaultMaxRestarts),
+		Backoff:     time.Duration(envInt("RUNPOD_RESTART_BACKOFF_SECONDS", defaultRestartBackoffSeconds)) * time.Second,
+		MaxBackoff:  time.Duration(envInt("RUNPOD_RESTART_MAX_BACKOFF_SECONDS", defaultMaxBackoffSeconds)) * time.Second,
+	}
+	switch policy.Mode {
+	case RestartNever, RestartOnFailure, RestartAlways:
+	case "":
+		policy.Mode = RestartNever
+	default:
+		log.Error("Unknown restart policy, the handler is not restarted", zap.String("policy", policy.Mode))
+		policy.Mode = RestartNever
+	}
+	if policy.MaxBackoff < policy.Backoff {
+		policy.MaxBackoff = policy.Backoff
+	}
+	return policy
+}
+
+// shouldRestart tells whether the handler is started again after an exit, or why not. On failure the handler is
+// restarted at most MaxRestarts times, always has no limit besides the crash loop detection.
+func (p restartPolicy) shouldRestart(exitErr error, restarted int) (bool, string) {
+	switch {
+	case p.Mode == RestartNever:
+		return false, ""
+	case p.Mode == RestartOnFailure && exitErr == nil:
+		return false, ""
+	case p.Mode == RestartOnFailure && restarted >= p.MaxRestarts:
+		return false, fmt.Sprintf("gave up after %d restarts", restarted)
+	}
+	return true, ""
+}
+
+// restartBackoff tracks the restarts of the handler for the crash loop detection and the backoff between them
+type restartBackoff struct {
+	policy restartPolicy
+	next   time.Duration
+	recent []time.Time
+}
+
+func newRestartBackoff(policy restartPolicy) *restartBackoff {
+	return &restartBackoff{policy: policy, next: policy.Backoff}
+}
+
+// record adds a restart after the handler ran from started to exited. It returns how long to wait before starting
+// the handler again, or why the supervisor gives up when the handler is in a crash loop.
+func (b *restartBackoff) record(started time.Time, exited time.Time) (time.Duration, string) {
+	// only the restarts within the window count towards a crash loop
+	b.recent = append(b.recent, exited)
+	for len(b.recent) > 0 && exited.Sub(b.recent[0]) > crashLoopWindow {
+		b.recent = b.recent[1:]
+	}
+	if len(b.recent) > crashLoopRestarts {
+		return 0, fmt.Sprintf("crash loop: the handler exited %d times within %s", len(b.recent), crashLoopWindow)
+	}
+
+	if exited.Sub(started) >= stableUptime {
+		b.next = b.policy.Backoff
+	}
+	backoff := b.next
+	b.next = min(b.next*2, b.policy.MaxBackoff)
+	return backoff, ""
+}
+
+// logTail keeps the last lines the handler printed
+type logTail struct {
+	mutex sync.Mutex
+	lines []string
+}
+
+func (t *logTail) add(line string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.lines = append(t.lines, line)
+	if len(t.lines) > restartTailLines {
+		t.lines = t.lines[len(t.lines)-restartTailLines:]
+	}
+}
+
+func (t *logTail) snapshot() []string {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return append([]string(nil), t.lines...)
+}
+
+// commandStartError is returned by runProcess when the command could not be started
+type commandStartError struct {
+	err error
+}
+
+func (e *commandStartError) Error() string {
+	return e.err.Error()
+}
+
+func (e *commandStartError) Unwrap() error {
+	return e.err
+}
+
+// isExitError tells whether err is the exit status of a command, rather than a failure to wait for it
+func isExitError(err error) bool {
+	var exitErr *exec.ExitError
+	return errors.As(err, &exitErr)
+}
+
+// superviseCommand runs the handler and restarts it according to the restart policy, waiting between restarts with
+// an exponential backoff. Once the handler is not restarted anymore it returns why the supervisor gave up, empty when
+// the policy does not restart it, along with how the last run ended and its error.
+func superviseCommand(command string, logBuffer chan<- LogEvent, log *zap.Logger) (string, *ProcessExit, error) {
+	policy := restartPolicyFromEnv(log)
+	backoffs := newRestartBackoff(policy)
+
+	for attempt := 0; ; attempt++ {
+		tail := &logTail{}
+		started := time.Now().UTC()
+		exit, err := runProcess(command, false, logBuffer, tail, log)
+		exited := time.Now().UTC()
+		var startErr *commandStartError
+		if errors.As(err, &startErr) {
+			// starting the command again would fail the same way
+			return "", nil, err
+		}
+
+		restart, reason := policy.shouldRestart(err, attempt)
+		if !restart {
+			return reason, exit, err
+		}
+
+		backoff, crashLoop := backoffs.record(started, exited)
+		if crashLoop != "" {
+			return crashLoop, exit, err
+		}
+		recordRestart(Restart{
+			Attempt:  attempt + 1,
+			ExitCode: exit.ExitCode,
+			Error:    errorText(err),
+			Exit:     exit,
+			Started:  started,
+			Exited:   exited,
+			Backoff:  backoff.Milliseconds(),
+			LastLogs: tail.snapshot(),
+		})
+
+		message := fmt.Sprintf("Handler %s, restarting in %s (restart %d)", exit.Summary(), backoff, attempt+1)
+		fmt.Println(message)
+		log.Warn("Restarting the handler", zap.Int("exitCode", exit.ExitCode), zap.Duration("backoff", backoff), zap.Int("restart", attempt+1))
+		logBuffer <- newLogEvent(StreamSystem, "warn", message)
+		HandlerRestarting(log)
+
+		time.Sleep(backoff)
+		if isCommandStopping() {
+			// the server is stopping, stopCommands' caller is exiting
+			select {}
+		}
+	}
+}
+
+func errorText(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
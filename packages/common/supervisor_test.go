@@ -0,0 +1,172 @@
+package common
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestRestartPolicyFromEnv(t *testing.T) {
+	tests := []struct {
+		name string
+		env  map[string]string
+		want restartPolicy
+	}{
+		{
+			name: "defaults",
+			want: restartPolicy{Mode: RestartNever, MaxRestarts: 5, Backoff: time.Second, MaxBackoff: 30 * time.Second},
+		},
+		{
+			name: "on failure",
+			env:  map[string]string{"RUNPOD_RESTART_POLICY": " On-Failure ", "RUNPOD_RESTART_MAX_RETRIES": "2"},
+			want: restartPolicy{Mode: RestartOnFailure, MaxRestarts: 2, Backoff: time.Second, MaxBackoff: 30 * time.Second},
+		},
+		{
+			name: "always with a backoff",
+			env:  map[string]string{"RUNPOD_RESTART_POLICY": "always", "RUNPOD_RESTART_BACKOFF_SECONDS": "3", "RUNPOD_RESTART_MAX_BACKOFF_SECONDS": "10"},
+			want: restartPolicy{Mode: RestartAlways, MaxRestarts: 5, Backoff: 3 * time.Second, MaxBackoff: 10 * time.Second},
+		},
+		{
+			name: "max backoff below the backoff",
+			env:  map[string]string{"RUNPOD_RESTART_POLICY": "always", "RUNPOD_RESTART_BACKOFF_SECONDS": "40"},
+			want: restartPolicy{Mode: RestartAlways, MaxRestarts: 5, Backoff: 40 * time.Second, MaxBackoff: 40 * time.Second},
+		},
+		{
+			name: "invalid numbers use the defaults",
+			env:  map[string]string{"RUNPOD_RESTART_POLICY": "always", "RUNPOD_RESTART_MAX_RETRIES": "-1", "RUNPOD_RESTART_BACKOFF_SECONDS": "soon"},
+			want: restartPolicy{Mode: RestartAlways, MaxRestarts: 5, Backoff: time.Second, MaxBackoff: 30 * time.Second},
+		},
+		{
+			name: "unknown policy never restarts",
+			env:  map[string]string{"RUNPOD_RESTART_POLICY": "unless-stopped"},
+			want: restartPolicy{Mode: RestartNever, MaxRestarts: 5, Backoff: time.Second, MaxBackoff: 30 * time.Second},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for _, name := range []string{"RUNPOD_RESTART_POLICY", "RUNPOD_RESTART_MAX_RETRIES", "RUNPOD_RESTART_BACKOFF_SECONDS", "RUNPOD_RESTART_MAX_BACKOFF_SECONDS"} {
+				t.Setenv(name, test.env[name])
+			}
+			if got := restartPolicyFromEnv(zap.NewNop()); got != test.want {
+				t.Fatalf("got %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestShouldRestart(t *testing.T) {
+	failed := errors.New("exit status 1")
+
+	tests := []struct {
+		name      string
+		mode      string
+		exitErr   error
+		restarted int
+		want      bool
+		reason    string
+	}{
+		{name: "never after a failure", mode: RestartNever, exitErr: failed},
+		{name: "never after a clean exit", mode: RestartNever},
+		{name: "on failure after a failure", mode: RestartOnFailure, exitErr: failed, restarted: 2, want: true},
+		{name: "on failure after a clean exit", mode: RestartOnFailure},
+		{name: "on failure out of restarts", mode: RestartOnFailure, exitErr: failed, restarted: 3, reason: "gave up after 3 restarts"},
+		{name: "always after a clean exit", mode: RestartAlways, want: true},
+		{name: "always has no limit", mode: RestartAlways, exitErr: failed, restarted: 100, want: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			policy := restartPolicy{Mode: test.mode, MaxRestarts: 3}
+			restart, reason := policy.shouldRestart(test.exitErr, test.restarted)
+			if restart != test.want || reason != test.reason {
+				t.Fatalf("got %t %q, want %t %q", restart, reason, test.want, test.reason)
+			}
+		})
+	}
+}
+
+func TestRestartBackoff(t *testing.T) {
+	policy := restartPolicy{Mode: RestartAlways, Backoff: time.Second, MaxBackoff: 5 * time.Second}
+	start := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	// each run starts after the backoff of the previous one, ran is how long the handler ran before exiting
+	type run struct {
+		ran       time.Duration
+		backoff   time.Duration
+		crashLoop bool
+	}
+
+	tests := []struct {
+		name string
+		runs []run
+	}{
+		{
+			name: "backoff doubles up to the max",
+			runs: []run{
+				{ran: time.Second, backoff: time.Second},
+				{ran: time.Second, backoff: 2 * time.Second},
+				{ran: time.Second, backoff: 4 * time.Second},
+				{ran: time.Second, backoff: 5 * time.Second},
+				{ran: time.Second, backoff: 5 * time.Second},
+			},
+		},
+		{
+			name: "a stable run starts over with the initial backoff",
+			runs: []run{
+				{ran: time.Second, backoff: time.Second},
+				{ran: time.Second, backoff: 2 * time.Second},
+				{ran: stableUptime, backoff: time.Second},
+				{ran: time.Second, backoff: 2 * time.Second},
+			},
+		},
+		{
+			name: "crash loop",
+			runs: []run{
+				{ran: time.Second, backoff: time.Second},
+				{ran: time.Second, backoff: 2 * time.Second},
+				{ran: time.Second, backoff: 4 * time.Second},
+				{ran: time.Second, backoff: 5 * time.Second},
+				{ran: time.Second, backoff: 5 * time.Second},
+				{ran: time.Second, crashLoop: true},
+			},
+		},
+		{
+			name: "restarts outside the window do not count",
+			runs: []run{
+				{ran: time.Second, backoff: time.Second},
+				{ran: time.Second, backoff: 2 * time.Second},
+				{ran: time.Second, backoff: 4 * time.Second},
+				{ran: time.Second, backoff: 5 * time.Second},
+				{ran: 55 * time.Second, backoff: 5 * time.Second},
+				{ran: 55 * time.Second, backoff: 5 * time.Second},
+				{ran: 55 * time.Second, backoff: 5 * time.Second},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			backoffs := newRestartBackoff(policy)
+			now := start
+			for i, r := range test.runs {
+				started := now
+				now = now.Add(r.ran)
+				backoff, crashLoop := backoffs.record(started, now)
+				if r.crashLoop {
+					if !strings.HasPrefix(crashLoop, "crash loop: the handler exited 6 times") {
+						t.Fatalf("run %d: got %q, want a crash loop", i, crashLoop)
+					}
+					return
+				}
+				if crashLoop != "" || backoff != r.backoff {
+					t.Fatalf("run %d: got %s %q, want %s", i, backoff, crashLoop, r.backoff)
+				}
+				now = now.Add(backoff)
+			}
+		})
+	}
+}
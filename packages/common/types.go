@@ -1,16 +1,72 @@
 package common
 
-import "time"
-
 type Test struct {
 	ID    *int        `json:"id,omitempty"`
 	Name  string      `json:"name"`
 	Input interface{} `json:"input"`
+	// Source is the test file and position the test was loaded from
+	Source string `json:"source,omitempty"`
 
 	Timeout *int `json:"timeout"`
+	// Mode is how the test is sent to the handler, sync (default) uses /runsync, async polls /status after /run
+	// and stream reads /stream after /run
+	Mode string `json:"mode,omitempty"`
+
+	ExpectedOutput *ExpectedOutput `json:"expectedOutput,omitempty"`
+	Assertions     []Assertion     `json:"assertions,omitempty"`
+	InputSchema    interface{}     `json:"inputSchema,omitempty"`
+	OutputSchema   interface{}     `json:"outputSchema,omitempty"`
+
+	// Invalid tests already have a FAILED result and are not sent to the handler
+	Invalid bool `json:"-"`
+}
+
+// TestConfig is the config section of the test file
+type TestConfig struct {
+	RunsOn              string      `json:"runsOn,omitempty"`
+	GpuTypeID           string      `json:"gpuTypeId,omitempty"`
+	GpuCount            int         `json:"gpuCount,omitempty"`
+	CpuFlavor           string      `json:"cpuFlavor,omitempty"`
+	Env                 []EnvVar    `json:"env,omitempty"`
+	AllowedCudaVersions []string    `json:"allowedCudaVersions,omitempty"`
+	Mode                string      `json:"mode,omitempty"`
+	Concurrency         int         `json:"concurrency,omitempty"`
+	Redact              []string    `json:"redact,omitempty"`
+	InputSchema         interface{} `json:"inputSchema,omitempty"`
+	OutputSchema        interface{} `json:"outputSchema,omitempty"`
+}
+
+type EnvVar struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+	// Secret masks the value in the logs and the results, see common.AddSecretEnv
+	Secret bool `json:"secret,omitempty"`
+}
+
+// TestFile is the wrapped form of the test file, {"tests": [...], "config": {...}, "load": {...}}
+type TestFile struct {
+	Tests  []Test      `json:"tests"`
+	Config TestConfig  `json:"config"`
+	Load   *LoadConfig `json:"load,omitempty"`
+}
+
+// LoadConfig is the load section of the test file. The inputs of the tests are replayed against the handler,
+// either at a target rate for Duration seconds or with a fixed number of requests in flight for each stage of Ramp.
+type LoadConfig struct {
+	Duration int         `json:"duration,omitempty"`
+	RPS      float64     `json:"rps,omitempty"`
+	Ramp     []LoadStage `json:"ramp,omitempty"`
+	// Tests are the names of the tests whose inputs are used, every valid test by default
+	Tests []string `json:"tests,omitempty"`
+	// MaxErrorRate and MaxP99Latency (milliseconds) fail the load test when they are exceeded
+	MaxErrorRate  *float64 `json:"maxErrorRate,omitempty"`
+	MaxP99Latency *int64   `json:"maxP99Latency,omitempty"`
+}
 
-	StartedAt time.Time `json:"startedAt,omitempty"`
-	Completed bool      `json:"completed,omitempty"`
+// LoadStage keeps Concurrency requests in flight for Duration seconds
+type LoadStage struct {
+	Concurrency int `json:"concurrency"`
+	Duration    int `json:"duration"`
 }
 
 type ExpectedOutput struct {
@@ -18,13 +74,138 @@ type ExpectedOutput struct {
 	Error   string      `json:"error"`
 }
 
+// Assertion checks the values selected by a JSONPath expression in the response.
+// Operators: equals, contains, matches, within, lengthBetween, isType and exists.
+type Assertion struct {
+	Path     string      `json:"path"`
+	Operator string      `json:"operator"`
+	Value    interface{} `json:"value,omitempty"`
+	Epsilon  *float64    `json:"epsilon,omitempty"`
+	Min      *float64    `json:"min,omitempty"`
+	Max      *float64    `json:"max,omitempty"`
+}
+
+// Mismatch is a single difference between what a test expected and what the handler returned.
+type Mismatch struct {
+	Path       string      `json:"path"`
+	SchemaPath string      `json:"schemaPath,omitempty"`
+	Operator   string      `json:"operator,omitempty"`
+	Expected   interface{} `json:"expected,omitempty"`
+	Actual     interface{} `json:"actual,omitempty"`
+	Message    string      `json:"message"`
+}
+
+// Failure is used as the Result error when a response did not match the test expectations.
+type Failure struct {
+	Message    string     `json:"message"`
+	Mismatches []Mismatch `json:"mismatches"`
+}
+
 type Result struct {
-	ID            int         `json:"id"`
-	Name          string      `json:"name,omitempty"`
-	Status        string      `json:"status"`
-	Error         interface{} `json:"error"`
-	ExecutionTime int64       `json:"executionTime"`
-	Output        interface{} `json:"output,omitempty"`
+	ID     int         `json:"id"`
+	Name   string      `json:"name,omitempty"`
+	Source string      `json:"source,omitempty"`
+	Status string      `json:"status"`
+	Error  interface{} `json:"error"`
+	// DelayTime is how long the job waited in the queue, ExecutionTime how long the worker ran it, both in milliseconds
+	DelayTime     int64        `json:"delayTime"`
+	ExecutionTime int64        `json:"executionTime"`
+	Output        interface{}  `json:"output,omitempty"`
+	Stream        *StreamStats `json:"stream,omitempty"`
+	Load          *LoadReport  `json:"load,omitempty"`
+	// JobID is the job the test was sent as, the load result runs many jobs and has none
+	JobID string `json:"jobId,omitempty"`
+	// Exit is how the handler process ended, it is set on the initialization result when the handler stopped
+	Exit *ProcessExit `json:"exit,omitempty"`
+	// Resources is what the handler used while the job of the test ran
+	Resources *ResourceUsage `json:"resources,omitempty"`
+	// Redacted is true when secrets were masked in the input, output, error or logs of the result
+	Redacted bool `json:"redacted,omitempty"`
+	// Input and Logs are only shown by the local reporters, they are not sent to the webhook.
+	// Logs are the handler logs attributed to the job, or to the test when there is no job.
+	Input interface{} `json:"-"`
+	Logs  []string    `json:"-"`
+}
+
+// ProcessExit is how a command ended and the resources it used. OOMKilled is true when the OOM killer killed a
+// process of the cgroup while the command was running.
+type ProcessExit struct {
+	ExitCode  int    `json:"exitCode"`
+	Signal    string `json:"signal,omitempty"`
+	OOMKilled bool   `json:"oomKilled"`
+	// PeakRSS is the largest resident set size of the command or a process it waited for, in bytes
+	PeakRSS int64 `json:"peakRss"`
+	// UserCPUTime, SystemCPUTime and WallTime are in milliseconds
+	UserCPUTime   int64 `json:"userCpuTime"`
+	SystemCPUTime int64 `json:"systemCpuTime"`
+	WallTime      int64 `json:"wallTime"`
+}
+
+// ResourceStat is the minimum, average and maximum of a resource over the samples of a test
+type ResourceStat struct {
+	Min float64 `json:"min"`
+	Avg float64 `json:"avg"`
+	Max float64 `json:"max"`
+}
+
+// ResourceUsage is what the handler process tree used while a test ran, sampled from /proc every
+// RUNPOD_METRICS_INTERVAL_MS. Tests running at the same time share the samples. RSS and CgroupMemory are in bytes,
+// RSSStart and RSSEnd are the first and last RSS samples of the test.
+type ResourceUsage struct {
+	Samples             int           `json:"samples"`
+	CPUPercent          ResourceStat  `json:"cpuPercent"`
+	RSS                 ResourceStat  `json:"rss"`
+	RSSStart            int64         `json:"rssStart"`
+	RSSEnd              int64         `json:"rssEnd"`
+	OpenFDs             ResourceStat  `json:"openFds"`
+	Threads             ResourceStat  `json:"threads"`
+	ReadBytesPerSecond  ResourceStat  `json:"readBytesPerSecond"`
+	WriteBytesPerSecond ResourceStat  `json:"writeBytesPerSecond"`
+	CgroupMemory        *ResourceStat `json:"cgroupMemory,omitempty"`
+}
+
+// StreamStats records the chunks received by a stream test, times are in milliseconds since the job was submitted
+type StreamStats struct {
+	TimeToFirstChunk *int64        `json:"timeToFirstChunk,omitempty"`
+	Chunks           []StreamChunk `json:"chunks"`
+}
+
+type StreamChunk struct {
+	Output     interface{} `json:"output"`
+	ReceivedAt int64       `json:"receivedAt"`
+}
+
+// LoadReport is the outcome of the load section, the stages follow the ramp of the config
+type LoadReport struct {
+	Total  LoadStats   `json:"total"`
+	Stages []LoadStats `json:"stages,omitempty"`
+}
+
+// LoadStats summarizes the requests of a load stage, durations are in milliseconds and throughput in requests per second
+type LoadStats struct {
+	Concurrency         int            `json:"concurrency,omitempty"`
+	TargetRPS           float64        `json:"targetRps,omitempty"`
+	Duration            int64          `json:"duration"`
+	Requests            int            `json:"requests"`
+	Errors              int            `json:"errors"`
+	ErrorRate           float64        `json:"errorRate"`
+	Throughput          float64        `json:"throughput"`
+	Latency             Percentiles    `json:"latency"`
+	QueueDelay          Percentiles    `json:"queueDelay"`
+	QueueDelayHistogram []HistogramBin `json:"queueDelayHistogram"`
+}
+
+type Percentiles struct {
+	P50 int64 `json:"p50"`
+	P90 int64 `json:"p90"`
+	P99 int64 `json:"p99"`
+	Max int64 `json:"max"`
+}
+
+// HistogramBin counts the values up to UpTo milliseconds, the last bin has no upper bound and UpTo 0
+type HistogramBin struct {
+	UpTo  int64 `json:"upTo,omitempty"`
+	Count int   `json:"count"`
 }
 
 var results []Result
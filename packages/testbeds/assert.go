@@ -0,0 +1,297 @@
+package testbeds
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"sls-local-server/packages/common"
+)
+
+// maxReportedValueLength keeps huge outputs such as base64 images out of the reported mismatches
+const maxReportedValueLength = 256
+
+// verifyResponse returns everything in the response that does not satisfy the expectedOutput, assertions and output schema of the test
+func verifyResponse(test common.Test, responseData map[string]interface{}) []common.Mismatch {
+	mismatches := checkExpectedOutput(test.ExpectedOutput, responseData)
+	mismatches = append(mismatches, checkAssertions(test.Assertions, responseData)...)
+	mismatches = append(mismatches, checkOutputSchema(test, responseData)...)
+
+	if len(mismatches) > maxMismatches {
+		mismatches = mismatches[:maxMismatches]
+	}
+	return mismatches
+}
+
+// checkAssertions evaluates every assertion against the parsed response and returns the failing ones
+func checkAssertions(assertions []common.Assertion, responseData map[string]interface{}) []common.Mismatch {
+	mismatches := make([]common.Mismatch, 0)
+	root := normalizeJSON(responseData)
+
+	for _, assertion := range assertions {
+		mismatches = append(mismatches, checkAssertion(assertion, root)...)
+	}
+	return mismatches
+}
+
+func checkAssertion(assertion common.Assertion, root interface{}) []common.Mismatch {
+	matches, err := evaluateJSONPath(assertion.Path, root)
+	if err != nil {
+		return []common.Mismatch{{
+			Path:     assertion.Path,
+			Operator: assertion.Operator,
+			Message:  fmt.Sprintf("invalid path: %s", err.Error()),
+		}}
+	}
+
+	if assertion.Operator == "exists" {
+		shouldExist := assertion.Value == nil || assertion.Value == true
+		if shouldExist && len(matches) == 0 {
+			return []common.Mismatch{{
+				Path:     assertion.Path,
+				Operator: assertion.Operator,
+				Message:  "path does not exist",
+			}}
+		}
+		if !shouldExist && len(matches) > 0 {
+			return []common.Mismatch{{
+				Path:     matches[0].Path,
+				Operator: assertion.Operator,
+				Actual:   reportedValue(matches[0].Value),
+				Message:  "path exists but should not",
+			}}
+		}
+		return nil
+	}
+
+	if len(matches) == 0 {
+		return []common.Mismatch{{
+			Path:     assertion.Path,
+			Operator: assertion.Operator,
+			Expected: reportedValue(assertion.Value),
+			Message:  "path does not exist",
+		}}
+	}
+
+	mismatches := make([]common.Mismatch, 0)
+	for _, match := range matches {
+		message := evaluateOperator(assertion, match.Value)
+		if message == "" {
+			continue
+		}
+
+		mismatches = append(mismatches, common.Mismatch{
+			Path:     match.Path,
+			Operator: assertion.Operator,
+			Expected: expectedForReport(assertion),
+			Actual:   reportedValue(match.Value),
+			Message:  message,
+		})
+	}
+	return mismatches
+}
+
+// assertionOperators are the operators evaluateOperator knows, exists is handled by checkAssertion
+var assertionOperators = map[string]bool{
+	"exists":        true,
+	"equals":        true,
+	"contains":      true,
+	"matches":       true,
+	"within":        true,
+	"lengthBetween": true,
+	"isType":        true,
+}
+
+// validateAssertions returns the assertions that can never pass whatever the handler returns, so the test is
+// reported as invalid instead of failing against every response
+func validateAssertions(assertions []common.Assertion) []common.Mismatch {
+	mismatches := make([]common.Mismatch, 0)
+	for _, assertion := range assertions {
+		message := ""
+		if _, err := parseJSONPath(assertion.Path); err != nil {
+			message = fmt.Sprintf("invalid path: %s", err.Error())
+		} else if !assertionOperators[assertion.Operator] {
+			message = fmt.Sprintf("unknown operator %q", assertion.Operator)
+		} else if assertion.Operator == "lengthBetween" {
+			switch {
+			case assertion.Min == nil && assertion.Max == nil:
+				message = "lengthBetween requires min, max or both"
+			case assertion.Min != nil && assertion.Max != nil && *assertion.Min > *assertion.Max:
+				message = fmt.Sprintf("min %v is greater than max %v", *assertion.Min, *assertion.Max)
+			}
+		}
+
+		if message != "" {
+			mismatches = append(mismatches, common.Mismatch{
+				Path:     assertion.Path,
+				Operator: assertion.Operator,
+				Message:  message,
+			})
+		}
+	}
+	return mismatches
+}
+
+// evaluateOperator returns an empty string when actual satisfies the assertion and the reason otherwise
+func evaluateOperator(assertion common.Assertion, actual interface{}) string {
+	expected := normalizeJSON(assertion.Value)
+
+	switch assertion.Operator {
+	case "equals":
+		if !reflect.DeepEqual(expected, actual) {
+			return "value is not equal"
+		}
+	case "contains":
+		return evaluateContains(expected, actual)
+	case "matches":
+		pattern, ok := expected.(string)
+		if !ok {
+			return "matches requires a regular expression string as value"
+		}
+		regex, err := regexp.Compile(pattern)
+		if err != nil {
+			return fmt.Sprintf("invalid regular expression: %s", err.Error())
+		}
+		text, ok := actual.(string)
+		if !ok {
+			return fmt.Sprintf("expected a string, got %s", jsonType(actual))
+		}
+		if !regex.MatchString(text) {
+			return "value does not match the regular expression"
+		}
+	case "within":
+		target, ok := expected.(float64)
+		if !ok {
+			return "within requires a number as value"
+		}
+		number, ok := actual.(float64)
+		if !ok {
+			return fmt.Sprintf("expected a number, got %s", jsonType(actual))
+		}
+		epsilon := 0.0
+		if assertion.Epsilon != nil {
+			epsilon = *assertion.Epsilon
+		}
+		if math.Abs(number-target) > epsilon {
+			return fmt.Sprintf("value is not within %v of %v", epsilon, target)
+		}
+	case "lengthBetween":
+		length, ok := valueLength(actual)
+		if !ok {
+			return fmt.Sprintf("%s has no length", jsonType(actual))
+		}
+		if assertion.Min != nil && float64(length) < *assertion.Min {
+			return fmt.Sprintf("length %d is smaller than %v", length, *assertion.Min)
+		}
+		if assertion.Max != nil && float64(length) > *assertion.Max {
+			return fmt.Sprintf("length %d is greater than %v", length, *assertion.Max)
+		}
+	case "isType":
+		typeName, ok := expected.(string)
+		if !ok {
+			return "isType requires a type name as value"
+		}
+		if !isType(actual, typeName) {
+			return fmt.Sprintf("expected %s, got %s", typeName, jsonType(actual))
+		}
+	default:
+		return fmt.Sprintf("unknown operator %q", assertion.Operator)
+	}
+
+	return ""
+}
+
+// evaluateContains checks for a substring, an array element or a subset of an object depending on the type of actual
+func evaluateContains(expected interface{}, actual interface{}) string {
+	switch value := actual.(type) {
+	case string:
+		substring, ok := expected.(string)
+		if !ok {
+			return "contains on a string requires a string as value"
+		}
+		if !strings.Contains(value, substring) {
+			return "string does not contain the value"
+		}
+	case []interface{}:
+		for _, item := range value {
+			if reflect.DeepEqual(item, expected) {
+				return ""
+			}
+		}
+		return "array does not contain the value"
+	case map[string]interface{}:
+		if key, ok := expected.(string); ok {
+			if _, exists := value[key]; !exists {
+				return fmt.Sprintf("object does not contain the key %q", key)
+			}
+			return ""
+		}
+		subset, ok := expected.(map[string]interface{})
+		if !ok {
+			return "contains on an object requires a key or an object as value"
+		}
+		for key, expectedValue := range subset {
+			if actualValue, exists := value[key]; !exists || !reflect.DeepEqual(actualValue, expectedValue) {
+				return fmt.Sprintf("object does not contain %q with the expected value", key)
+			}
+		}
+	default:
+		return fmt.Sprintf("contains cannot be used on %s", jsonType(actual))
+	}
+	return ""
+}
+
+func valueLength(value interface{}) (int, bool) {
+	switch v := value.(type) {
+	case string:
+		return utf8.RuneCountInString(v), true
+	case []interface{}:
+		return len(v), true
+	case map[string]interface{}:
+		return len(v), true
+	}
+	return 0, false
+}
+
+func isType(value interface{}, typeName string) bool {
+	if typeName == "integer" {
+		number, ok := value.(float64)
+		return ok && number == math.Trunc(number)
+	}
+	return jsonType(value) == typeName
+}
+
+// expectedForReport describes what the assertion expected in a mismatch
+func expectedForReport(assertion common.Assertion) interface{} {
+	switch assertion.Operator {
+	case "within":
+		epsilon := 0.0
+		if assertion.Epsilon != nil {
+			epsilon = *assertion.Epsilon
+		}
+		return fmt.Sprintf("%v ± %v", assertion.Value, epsilon)
+	case "lengthBetween":
+		return map[string]*float64{"min": assertion.Min, "max": assertion.Max}
+	}
+	return reportedValue(assertion.Value)
+}
+
+// reportedValue shortens values that would make the results payload too big
+func reportedValue(value interface{}) interface{} {
+	if text, ok := value.(string); ok {
+		if utf8.RuneCountInString(text) > maxReportedValueLength {
+			return fmt.Sprintf("%s... (%d characters)", string([]rune(text)[:maxReportedValueLength]), utf8.RuneCountInString(text))
+		}
+		return text
+	}
+
+	if marshaled, err := json.Marshal(value); err == nil && len(marshaled) > maxReportedValueLength {
+		length, _ := valueLength(value)
+		return fmt.Sprintf("<%s with %d elements>", jsonType(value), length)
+	}
+	return value
+}
@@ -0,0 +1,176 @@
+package testbeds
+
+import (
+	"strings"
+	"testing"
+
+	"sls-local-server/packages/common"
+)
+
+func float(value float64) *float64 {
+	return &value
+}
+
+func TestEvaluateOperator(t *testing.T) {
+	tests := []struct {
+		name      string
+		assertion common.Assertion
+		actual    interface{}
+		want      string
+	}{
+		{name: "equals number", assertion: common.Assertion{Operator: "equals", Value: 3}, actual: float64(3)},
+		{name: "equals object", assertion: common.Assertion{Operator: "equals", Value: map[string]interface{}{"a": []int{1}}}, actual: map[string]interface{}{"a": []interface{}{float64(1)}}},
+		{name: "equals different", assertion: common.Assertion{Operator: "equals", Value: "a"}, actual: "b", want: "value is not equal"},
+		{name: "equals null", assertion: common.Assertion{Operator: "equals"}, actual: nil},
+
+		{name: "contains substring", assertion: common.Assertion{Operator: "contains", Value: "ell"}, actual: "hello"},
+		{name: "contains missing substring", assertion: common.Assertion{Operator: "contains", Value: "xyz"}, actual: "hello", want: "string does not contain the value"},
+		{name: "contains number in a string", assertion: common.Assertion{Operator: "contains", Value: 1}, actual: "1", want: "requires a string"},
+		{name: "contains array element", assertion: common.Assertion{Operator: "contains", Value: 2}, actual: []interface{}{float64(1), float64(2)}},
+		{name: "contains missing array element", assertion: common.Assertion{Operator: "contains", Value: 5}, actual: []interface{}{float64(1)}, want: "array does not contain the value"},
+		{name: "contains key", assertion: common.Assertion{Operator: "contains", Value: "a"}, actual: map[string]interface{}{"a": nil}},
+		{name: "contains missing key", assertion: common.Assertion{Operator: "contains", Value: "b"}, actual: map[string]interface{}{"a": nil}, want: `does not contain the key "b"`},
+		{name: "contains subset", assertion: common.Assertion{Operator: "contains", Value: map[string]interface{}{"a": 1}}, actual: map[string]interface{}{"a": float64(1), "b": float64(2)}},
+		{name: "contains subset with another value", assertion: common.Assertion{Operator: "contains", Value: map[string]interface{}{"a": 2}}, actual: map[string]interface{}{"a": float64(1)}, want: `does not contain "a"`},
+		{name: "contains on a number", assertion: common.Assertion{Operator: "contains", Value: 1}, actual: float64(1), want: "contains cannot be used on number"},
+
+		{name: "matches", assertion: common.Assertion{Operator: "matches", Value: "^h.*o$"}, actual: "hello"},
+		{name: "matches fails", assertion: common.Assertion{Operator: "matches", Value: "^x"}, actual: "hello", want: "does not match"},
+		{name: "matches invalid regex", assertion: common.Assertion{Operator: "matches", Value: "("}, actual: "hello", want: "invalid regular expression"},
+		{name: "matches without a pattern", assertion: common.Assertion{Operator: "matches", Value: 1}, actual: "hello", want: "requires a regular expression"},
+		{name: "matches a number", assertion: common.Assertion{Operator: "matches", Value: "1"}, actual: float64(1), want: "expected a string, got number"},
+
+		{name: "within", assertion: common.Assertion{Operator: "within", Value: 1.0, Epsilon: float(0.1)}, actual: 1.05},
+		{name: "within at the edge", assertion: common.Assertion{Operator: "within", Value: 2, Epsilon: float(0.5)}, actual: 2.5},
+		{name: "within too far", assertion: common.Assertion{Operator: "within", Value: 1.0, Epsilon: float(0.1)}, actual: 1.2, want: "not within 0.1 of 1"},
+		{name: "within without epsilon", assertion: common.Assertion{Operator: "within", Value: 1.0}, actual: 1.0},
+		{name: "within on a string", assertion: common.Assertion{Operator: "within", Value: 1.0}, actual: "1", want: "expected a number, got string"},
+		{name: "within without a number", assertion: common.Assertion{Operator: "within", Value: "1"}, actual: 1.0, want: "requires a number"},
+
+		{name: "lengthBetween string counts runes", assertion: common.Assertion{Operator: "lengthBetween", Min: float(2), Max: float(2)}, actual: "hé"},
+		{name: "lengthBetween array", assertion: common.Assertion{Operator: "lengthBetween", Min: float(1)}, actual: []interface{}{1}},
+		{name: "lengthBetween too short", assertion: common.Assertion{Operator: "lengthBetween", Min: float(3)}, actual: "ab", want: "length 2 is smaller than 3"},
+		{name: "lengthBetween too long", assertion: common.Assertion{Operator: "lengthBetween", Max: float(1)}, actual: map[string]interface{}{"a": 1, "b": 2}, want: "length 2 is greater than 1"},
+		{name: "lengthBetween on a number", assertion: common.Assertion{Operator: "lengthBetween", Max: float(1)}, actual: float64(1), want: "number has no length"},
+
+		{name: "isType string", assertion: common.Assertion{Operator: "isType", Value: "string"}, actual: "a"},
+		{name: "isType integer", assertion: common.Assertion{Operator: "isType", Value: "integer"}, actual: float64(4)},
+		{name: "isType integer with a fraction", assertion: common.Assertion{Operator: "isType", Value: "integer"}, actual: 4.5, want: "expected integer, got number"},
+		{name: "isType null", assertion: common.Assertion{Operator: "isType", Value: "null"}, actual: nil},
+		{name: "isType wrong", assertion: common.Assertion{Operator: "isType", Value: "array"}, actual: map[string]interface{}{}, want: "expected array, got object"},
+		{name: "isType without a name", assertion: common.Assertion{Operator: "isType", Value: 1}, actual: "a", want: "requires a type name"},
+
+		{name: "unknown operator", assertion: common.Assertion{Operator: "startsWith", Value: "a"}, actual: "a", want: `unknown operator "startsWith"`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := evaluateOperator(test.assertion, test.actual)
+			if test.want == "" && got != "" {
+				t.Fatalf("got %q, want no mismatch", got)
+			}
+			if !strings.Contains(got, test.want) {
+				t.Fatalf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestValidateAssertions(t *testing.T) {
+	tests := []struct {
+		name      string
+		assertion common.Assertion
+		want      string
+	}{
+		{name: "valid", assertion: common.Assertion{Path: "$.output.text", Operator: "contains", Value: "a"}},
+		{name: "exists", assertion: common.Assertion{Path: "$..id", Operator: "exists"}},
+		{name: "lengthBetween with min", assertion: common.Assertion{Path: "$.output", Operator: "lengthBetween", Min: float(1)}},
+		{name: "lengthBetween with max", assertion: common.Assertion{Path: "$.output", Operator: "lengthBetween", Max: float(1)}},
+		{name: "lengthBetween with equal bounds", assertion: common.Assertion{Path: "$.output", Operator: "lengthBetween", Min: float(2), Max: float(2)}},
+		{name: "unknown operator", assertion: common.Assertion{Path: "$.output", Operator: "startsWith"}, want: `unknown operator "startsWith"`},
+		{name: "missing operator", assertion: common.Assertion{Path: "$.output"}, want: `unknown operator ""`},
+		{name: "path without root", assertion: common.Assertion{Path: "output", Operator: "exists"}, want: "invalid path: path \"output\" must start with $"},
+		{name: "unterminated bracket", assertion: common.Assertion{Path: "$.output[0", Operator: "exists"}, want: "invalid path"},
+		{name: "lengthBetween without bounds", assertion: common.Assertion{Path: "$.output", Operator: "lengthBetween"}, want: "requires min, max or both"},
+		{name: "lengthBetween with min over max", assertion: common.Assertion{Path: "$.output", Operator: "lengthBetween", Min: float(3), Max: float(1)}, want: "min 3 is greater than max 1"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			invalid := validateAssertions([]common.Assertion{{Path: "$.output", Operator: "exists"}, test.assertion})
+			if test.want == "" {
+				if len(invalid) != 0 {
+					t.Fatalf("got %+v, want a valid assertion", invalid)
+				}
+				return
+			}
+			if len(invalid) != 1 || invalid[0].Path != test.assertion.Path || !strings.Contains(invalid[0].Message, test.want) {
+				t.Fatalf("got %+v, want %q", invalid, test.want)
+			}
+		})
+	}
+}
+
+func TestCheckAssertions(t *testing.T) {
+	response := map[string]interface{}{
+		"output": map[string]interface{}{
+			"scores": []interface{}{0.5, 0.9, 1.5},
+			"label":  "cat",
+		},
+	}
+
+	tests := []struct {
+		name      string
+		assertion common.Assertion
+		paths     []string
+		message   string
+	}{
+		{name: "exists", assertion: common.Assertion{Path: "$.output.label", Operator: "exists"}},
+		{name: "exists missing", assertion: common.Assertion{Path: "$.output.missing", Operator: "exists"}, paths: []string{"$.output.missing"}, message: "path does not exist"},
+		{name: "exists false", assertion: common.Assertion{Path: "$.output.missing", Operator: "exists", Value: false}},
+		{name: "exists false present", assertion: common.Assertion{Path: "$.output.label", Operator: "exists", Value: false}, paths: []string{"$.output.label"}, message: "path exists but should not"},
+		{name: "missing path", assertion: common.Assertion{Path: "$.output.missing", Operator: "equals", Value: 1}, paths: []string{"$.output.missing"}, message: "path does not exist"},
+		{name: "invalid path", assertion: common.Assertion{Path: "output", Operator: "equals", Value: 1}, paths: []string{"output"}, message: "invalid path"},
+		{
+			name:      "each wildcard match is checked",
+			assertion: common.Assertion{Path: "$.output.scores[*]", Operator: "within", Value: 0.5, Epsilon: float(0.5)},
+			paths:     []string{"$.output.scores[2]"},
+			message:   "not within",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mismatches := checkAssertions([]common.Assertion{test.assertion}, response)
+			if len(mismatches) != len(test.paths) {
+				t.Fatalf("got %d mismatches %+v, want %d", len(mismatches), mismatches, len(test.paths))
+			}
+			for i, mismatch := range mismatches {
+				if mismatch.Path != test.paths[i] {
+					t.Errorf("mismatch %d path = %q, want %q", i, mismatch.Path, test.paths[i])
+				}
+				if !strings.Contains(mismatch.Message, test.message) {
+					t.Errorf("mismatch %d message = %q, want %q", i, mismatch.Message, test.message)
+				}
+			}
+		})
+	}
+}
+
+func TestReportedValue(t *testing.T) {
+	long := strings.Repeat("é", maxReportedValueLength+10)
+	if got := reportedValue(long).(string); !strings.HasSuffix(got, "... (266 characters)") || !strings.HasPrefix(got, strings.Repeat("é", maxReportedValueLength)) {
+		t.Errorf("long string reported as %q", got)
+	}
+
+	array := make([]interface{}, 100)
+	for i := range array {
+		array[i] = "item"
+	}
+	if got := reportedValue(array); got != "<array with 100 elements>" {
+		t.Errorf("long array reported as %v", got)
+	}
+	if got := reportedValue("short"); got != "short" {
+		t.Errorf("short string reported as %v", got)
+	}
+}
@@ -0,0 +1,215 @@
+package testbeds
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"sls-local-server/packages/common"
+
+	"go.uber.org/zap"
+)
+
+const (
+	ModeSync   = "sync"
+	ModeAsync  = "async"
+	ModeStream = "stream"
+)
+
+const (
+	// statusPollInterval is the first delay between two /status requests of an async test, it doubles up to statusPollMaxInterval
+	statusPollInterval    = 250 * time.Millisecond
+	statusPollMaxInterval = 5 * time.Second
+)
+
+const jobAPIURL = "http://localhost:80/v2/IDE"
+
+func isValidMode(mode string) bool {
+	return mode == ModeSync || mode == ModeAsync || mode == ModeStream
+}
+
+// sendTest submits the test input to the job API and returns the last job response it got within wait.
+// Stream tests also return the chunks the handler produced.
+func sendTest(log *zap.Logger, test common.Test, testNumber int, wait time.Duration) (map[string]interface{}, *common.StreamStats, error) {
+	client := &http.Client{
+		Timeout: wait + 10*time.Second,
+	}
+
+	// Marshal back to JSON to ensure proper formatting
+	formattedInput, err := json.Marshal(map[string]any{
+		"input": test.Input,
+		"policy": map[string]any{
+			"executionTimeout": *test.Timeout,
+		},
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("You did not send the tests in a proper format. %s", err.Error())
+	}
+
+	var responseData map[string]interface{}
+	var stats *common.StreamStats
+	switch test.Mode {
+	case ModeAsync:
+		responseData, err = sendAsync(log, client, test, testNumber, formattedInput, wait)
+	case ModeStream:
+		responseData, stats, err = sendStream(log, client, test, testNumber, formattedInput, wait)
+	default:
+		responseData, err = callJobAPI(client, "POST", fmt.Sprintf("/runsync?wait=%d", wait.Milliseconds()), testNumber, formattedInput)
+	}
+	if err == nil {
+		cancelUnfinished(log, client, testNumber, responseData)
+	}
+	return responseData, stats, err
+}
+
+// cancelUnfinished cancels the job of a response that did not finish within the wait of the test, so it does not
+// stay in the queue or wait for a worker after the test gave up on it
+func cancelUnfinished(log *zap.Logger, client *http.Client, testNumber int, responseData map[string]interface{}) {
+	jobID, _ := responseData["id"].(string)
+	status, _ := responseData["status"].(string)
+	if jobID == "" || isTerminal(status) {
+		return
+	}
+	if _, err := callJobAPI(client, "POST", "/cancel/"+jobID, testNumber, nil); err != nil {
+		log.Warn("Failed to cancel the unfinished job", zap.String("job_id", jobID), zap.Error(err))
+	}
+}
+
+// sendAsync submits the test with /run and polls /status with backoff until the job finished or wait elapsed
+func sendAsync(log *zap.Logger, client *http.Client, test common.Test, testNumber int, formattedInput []byte, wait time.Duration) (map[string]interface{}, error) {
+	deadline := time.Now().Add(wait)
+
+	submitted, err := callJobAPI(client, "POST", "/run", testNumber, formattedInput)
+	if err != nil {
+		return nil, err
+	}
+	jobID, _ := submitted["id"].(string)
+	if jobID == "" {
+		return nil, fmt.Errorf("The job API did not return a job id. %v", submitted)
+	}
+	log.Info("Submitted async test", zap.String("test_name", test.Name), zap.String("job_id", jobID))
+
+	interval := statusPollInterval
+	for {
+		responseData, err := callJobAPI(client, "GET", "/status/"+jobID, testNumber, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		status, _ := responseData["status"].(string)
+		if isTerminal(status) || time.Now().Add(interval).After(deadline) {
+			return responseData, nil
+		}
+
+		time.Sleep(interval)
+		interval *= 2
+		if interval > statusPollMaxInterval {
+			interval = statusPollMaxInterval
+		}
+	}
+}
+
+// sendStream submits the test with /run and reads /stream until the job finished or wait elapsed.
+// The chunk outputs are added to the response as "stream" and used as the output when the handler
+// did not return an aggregated one, so assertions can check both.
+func sendStream(log *zap.Logger, client *http.Client, test common.Test, testNumber int, formattedInput []byte, wait time.Duration) (map[string]interface{}, *common.StreamStats, error) {
+	submittedAt := time.Now()
+	deadline := submittedAt.Add(wait)
+
+	submitted, err := callJobAPI(client, "POST", "/run", testNumber, formattedInput)
+	if err != nil {
+		return nil, nil, err
+	}
+	jobID, _ := submitted["id"].(string)
+	if jobID == "" {
+		return nil, nil, fmt.Errorf("The job API did not return a job id. %v", submitted)
+	}
+	log.Info("Submitted stream test", zap.String("test_name", test.Name), zap.String("job_id", jobID))
+
+	stats := &common.StreamStats{
+		Chunks: make([]common.StreamChunk, 0),
+	}
+	for time.Now().Before(deadline) {
+		streamData, err := callJobAPI(client, "GET", "/stream/"+jobID, testNumber, nil)
+		if err != nil {
+			return nil, stats, err
+		}
+		returnedAt := time.Since(submittedAt).Milliseconds()
+
+		chunks, _ := streamData["stream"].([]interface{})
+		for _, chunk := range chunks {
+			chunkData, _ := chunk.(map[string]interface{})
+			// the job API stamps the chunks when the worker streamed them, a long poll returns them later
+			receivedAt := returnedAt
+			if stamp, _ := chunkData["receivedAt"].(string); stamp != "" {
+				if streamedAt, err := time.Parse(time.RFC3339Nano, stamp); err == nil {
+					receivedAt = max(streamedAt.Sub(submittedAt).Milliseconds(), 0)
+				}
+			}
+			stats.Chunks = append(stats.Chunks, common.StreamChunk{
+				Output:     chunkData["output"],
+				ReceivedAt: receivedAt,
+			})
+			if stats.TimeToFirstChunk == nil {
+				stats.TimeToFirstChunk = &receivedAt
+			}
+		}
+
+		if status, _ := streamData["status"].(string); isTerminal(status) {
+			break
+		}
+	}
+
+	responseData, err := callJobAPI(client, "GET", "/status/"+jobID, testNumber, nil)
+	if err != nil {
+		return nil, stats, err
+	}
+
+	outputs := make([]interface{}, 0, len(stats.Chunks))
+	for _, chunk := range stats.Chunks {
+		outputs = append(outputs, chunk.Output)
+	}
+	responseData["stream"] = outputs
+
+	// the runpod SDK only sends the chunks as the output with return_aggregate_stream, an empty list otherwise
+	status, _ := responseData["status"].(string)
+	aggregated, isList := responseData["output"].([]interface{})
+	if status == JobCompleted && (responseData["output"] == nil || (isList && len(aggregated) == 0)) {
+		responseData["output"] = outputs
+	}
+	return responseData, stats, nil
+}
+
+// callJobAPI sends a request to the local job API and decodes the job it returns
+func callJobAPI(client *http.Client, method string, path string, testNumber int, body []byte) (map[string]interface{}, error) {
+	req, err := http.NewRequest(method, jobAPIURL+path, bytes.NewBuffer(body))
+	if err != nil {
+		return nil, fmt.Errorf("Something went wrong when sending the request to AIAPI. %s", err.Error())
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(testNumberHeader, fmt.Sprintf("%d", testNumber))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("Something went wrong when sending the request to AIAPI. %s", err.Error())
+	}
+	defer resp.Body.Close()
+
+	// Read and log response
+	responseBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read response body once test had already been completed. %s", err.Error())
+	}
+
+	var responseData map[string]interface{}
+	if err := json.Unmarshal(responseBody, &responseData); err != nil {
+		return nil, fmt.Errorf("Failed to parse response from IDE. %s", err.Error())
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("The job API answered %s %d. %v", path, resp.StatusCode, responseData["error"])
+	}
+	return responseData, nil
+}
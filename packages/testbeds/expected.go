@@ -0,0 +1,210 @@
+package testbeds
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+
+	"sls-local-server/packages/common"
+)
+
+// maxMismatches keeps the diff small enough to be sent along with the results
+const maxMismatches = 50
+
+var identifierRegex = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// checkExpectedOutput compares the response of a test against its expectedOutput.
+// The payload is deep compared with the output, the expected error has to be part of the error returned by the handler.
+func checkExpectedOutput(expected *common.ExpectedOutput, responseData map[string]interface{}) []common.Mismatch {
+	if expected == nil {
+		return nil
+	}
+
+	mismatches := make([]common.Mismatch, 0)
+	actualError, failed := responseError(responseData)
+
+	if expected.Error != "" {
+		if !failed {
+			mismatches = append(mismatches, common.Mismatch{
+				Path:     "$.error",
+				Expected: expected.Error,
+				Message:  "expected the handler to return an error but it completed",
+			})
+		} else if !strings.Contains(actualError, expected.Error) {
+			mismatches = append(mismatches, common.Mismatch{
+				Path:     "$.error",
+				Expected: expected.Error,
+				Actual:   reportedValue(actualError),
+				Message:  "error does not match the expected error",
+			})
+		}
+	} else if failed {
+		mismatches = append(mismatches, common.Mismatch{
+			Path:    "$.error",
+			Actual:  reportedValue(actualError),
+			Message: "expected the handler to complete but it returned an error",
+		})
+	}
+
+	if expected.Payload != nil {
+		mismatches = diffValues(mismatches, "$.output", normalizeJSON(expected.Payload), normalizeJSON(responseData["output"]))
+	}
+
+	return mismatches
+}
+
+// responseError returns the error of a failed response as a string
+func responseError(responseData map[string]interface{}) (string, bool) {
+	status, _ := responseData["status"].(string)
+	errorPayload, hasError := responseData["error"]
+	if status != "FAILED" && (!hasError || errorPayload == nil || errorPayload == "") {
+		return "", false
+	}
+
+	switch e := errorPayload.(type) {
+	case nil:
+		return "", true
+	case string:
+		return e, true
+	default:
+		marshaled, err := json.Marshal(e)
+		if err != nil {
+			return fmt.Sprintf("%v", e), true
+		}
+		return string(marshaled), true
+	}
+}
+
+// diffValues walks expected and actual side by side and appends every difference it finds
+func diffValues(mismatches []common.Mismatch, path string, expected interface{}, actual interface{}) []common.Mismatch {
+	if len(mismatches) > maxMismatches {
+		return mismatches
+	}
+
+	switch e := expected.(type) {
+	case map[string]interface{}:
+		a, ok := actual.(map[string]interface{})
+		if !ok {
+			return append(mismatches, typeMismatch(path, expected, actual))
+		}
+
+		for _, key := range sortedKeys(e) {
+			actualValue, exists := a[key]
+			if !exists {
+				mismatches = append(mismatches, common.Mismatch{
+					Path:     childPath(path, key),
+					Expected: reportedValue(e[key]),
+					Message:  "missing key",
+				})
+				continue
+			}
+			mismatches = diffValues(mismatches, childPath(path, key), e[key], actualValue)
+		}
+
+		for _, key := range sortedKeys(a) {
+			if _, exists := e[key]; !exists {
+				mismatches = append(mismatches, common.Mismatch{
+					Path:    childPath(path, key),
+					Actual:  reportedValue(a[key]),
+					Message: "unexpected key",
+				})
+			}
+		}
+		return mismatches
+	case []interface{}:
+		a, ok := actual.([]interface{})
+		if !ok {
+			return append(mismatches, typeMismatch(path, expected, actual))
+		}
+
+		if len(e) != len(a) {
+			mismatches = append(mismatches, common.Mismatch{
+				Path:     path,
+				Expected: len(e),
+				Actual:   len(a),
+				Message:  "array length differs",
+			})
+		}
+
+		for i := 0; i < len(e) && i < len(a); i++ {
+			mismatches = diffValues(mismatches, fmt.Sprintf("%s[%d]", path, i), e[i], a[i])
+		}
+		return mismatches
+	default:
+		if jsonType(expected) != jsonType(actual) {
+			return append(mismatches, typeMismatch(path, expected, actual))
+		}
+		if !reflect.DeepEqual(expected, actual) {
+			mismatches = append(mismatches, common.Mismatch{
+				Path:     path,
+				Expected: reportedValue(expected),
+				Actual:   reportedValue(actual),
+				Message:  "value differs",
+			})
+		}
+		return mismatches
+	}
+}
+
+func typeMismatch(path string, expected interface{}, actual interface{}) common.Mismatch {
+	return common.Mismatch{
+		Path:     path,
+		Expected: reportedValue(expected),
+		Actual:   reportedValue(actual),
+		Message:  fmt.Sprintf("expected %s, got %s", jsonType(expected), jsonType(actual)),
+	}
+}
+
+// jsonType returns the JSON type name of a decoded value
+func jsonType(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64, json.Number:
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	default:
+		return fmt.Sprintf("%T", value)
+	}
+}
+
+// normalizeJSON round trips a value through JSON so that numbers, maps and slices share the same Go types
+func normalizeJSON(value interface{}) interface{} {
+	marshaled, err := json.Marshal(value)
+	if err != nil {
+		return value
+	}
+
+	var normalized interface{}
+	if err := json.Unmarshal(marshaled, &normalized); err != nil {
+		return value
+	}
+	return normalized
+}
+
+func childPath(path string, key string) string {
+	if identifierRegex.MatchString(key) {
+		return path + "." + key
+	}
+	quoted, _ := json.Marshal(key)
+	return fmt.Sprintf("%s[%s]", path, quoted)
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,228 @@
+package testbeds
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type segmentKind int
+
+const (
+	keySegment segmentKind = iota
+	indexSegment
+	wildcardSegment
+)
+
+// pathSegment is one step of a parsed JSONPath expression
+type pathSegment struct {
+	kind      segmentKind
+	key       string
+	index     int
+	recursive bool
+}
+
+// pathMatch is a value selected by a JSONPath expression along with its concrete path
+type pathMatch struct {
+	Path  string
+	Value interface{}
+}
+
+// parseJSONPath parses the subset of JSONPath supported by the test assertions:
+// $ (root), .key, ['key'], [index] (negative counts from the end), .* / [*] (wildcard) and ..key (recursive descent).
+func parseJSONPath(expr string) ([]pathSegment, error) {
+	expr = strings.TrimSpace(expr)
+	if !strings.HasPrefix(expr, "$") {
+		return nil, fmt.Errorf("path %q must start with $", expr)
+	}
+
+	segments := make([]pathSegment, 0)
+	i := 1
+	for i < len(expr) {
+		switch expr[i] {
+		case '.':
+			recursive := false
+			i++
+			if i < len(expr) && expr[i] == '.' {
+				recursive = true
+				i++
+			}
+			if i < len(expr) && expr[i] == '[' {
+				if !recursive {
+					return nil, fmt.Errorf("unexpected '[' after '.' at position %d in %q", i, expr)
+				}
+				// ..[...] is handled by the bracket case below
+				segment, next, err := parseBracket(expr, i)
+				if err != nil {
+					return nil, err
+				}
+				segment.recursive = true
+				segments = append(segments, segment)
+				i = next
+				continue
+			}
+
+			start := i
+			for i < len(expr) && expr[i] != '.' && expr[i] != '[' {
+				i++
+			}
+			name := expr[start:i]
+			if name == "" {
+				return nil, fmt.Errorf("empty key at position %d in %q", start, expr)
+			}
+			if name == "*" {
+				segments = append(segments, pathSegment{kind: wildcardSegment, recursive: recursive})
+			} else {
+				segments = append(segments, pathSegment{kind: keySegment, key: name, recursive: recursive})
+			}
+		case '[':
+			segment, next, err := parseBracket(expr, i)
+			if err != nil {
+				return nil, err
+			}
+			segments = append(segments, segment)
+			i = next
+		default:
+			return nil, fmt.Errorf("unexpected character %q at position %d in %q", expr[i], i, expr)
+		}
+	}
+
+	return segments, nil
+}
+
+// parseBracket parses a [...] selector starting at expr[start] and returns the position right after it
+func parseBracket(expr string, start int) (pathSegment, int, error) {
+	end := start + 1
+	inQuote := byte(0)
+	for end < len(expr) {
+		c := expr[end]
+		if inQuote != 0 {
+			if c == '\\' {
+				end += 2
+				continue
+			}
+			if c == inQuote {
+				inQuote = 0
+			}
+		} else if c == '\'' || c == '"' {
+			inQuote = c
+		} else if c == ']' {
+			break
+		}
+		end++
+	}
+	if end >= len(expr) {
+		return pathSegment{}, 0, fmt.Errorf("unclosed '[' at position %d in %q", start, expr)
+	}
+
+	content := strings.TrimSpace(expr[start+1 : end])
+	next := end + 1
+
+	switch {
+	case content == "*":
+		return pathSegment{kind: wildcardSegment}, next, nil
+	case len(content) >= 2 && (content[0] == '\'' || content[0] == '"') && content[len(content)-1] == content[0]:
+		key := content[1 : len(content)-1]
+		if content[0] == '"' {
+			unquoted, err := strconv.Unquote(content)
+			if err != nil {
+				return pathSegment{}, 0, fmt.Errorf("invalid key %s in %q", content, expr)
+			}
+			key = unquoted
+		} else {
+			key = strings.ReplaceAll(key, `\'`, `'`)
+		}
+		return pathSegment{kind: keySegment, key: key}, next, nil
+	default:
+		index, err := strconv.Atoi(content)
+		if err != nil {
+			return pathSegment{}, 0, fmt.Errorf("invalid selector [%s] in %q", content, expr)
+		}
+		return pathSegment{kind: indexSegment, index: index}, next, nil
+	}
+}
+
+// evaluateJSONPath returns every value of root selected by expr
+func evaluateJSONPath(expr string, root interface{}) ([]pathMatch, error) {
+	segments, err := parseJSONPath(expr)
+	if err != nil {
+		return nil, err
+	}
+
+	current := []pathMatch{{Path: "$", Value: root}}
+	for _, segment := range segments {
+		next := make([]pathMatch, 0)
+		for _, match := range current {
+			if segment.recursive {
+				for _, descendant := range descendants(match) {
+					next = append(next, applySegment(segment, descendant)...)
+				}
+			} else {
+				next = append(next, applySegment(segment, match)...)
+			}
+		}
+		current = next
+	}
+
+	return current, nil
+}
+
+// applySegment selects the children of match described by segment
+func applySegment(segment pathSegment, match pathMatch) []pathMatch {
+	switch segment.kind {
+	case keySegment:
+		if object, ok := match.Value.(map[string]interface{}); ok {
+			if value, exists := object[segment.key]; exists {
+				return []pathMatch{{Path: childPath(match.Path, segment.key), Value: value}}
+			}
+		}
+	case indexSegment:
+		if array, ok := match.Value.([]interface{}); ok {
+			index := segment.index
+			if index < 0 {
+				index += len(array)
+			}
+			if index >= 0 && index < len(array) {
+				return []pathMatch{{Path: fmt.Sprintf("%s[%d]", match.Path, index), Value: array[index]}}
+			}
+		}
+	case wildcardSegment:
+		return children(match)
+	}
+	return nil
+}
+
+// children returns the direct children of an object or array
+func children(match pathMatch) []pathMatch {
+	switch value := match.Value.(type) {
+	case map[string]interface{}:
+		keys := make([]string, 0, len(value))
+		for key := range value {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		matches := make([]pathMatch, 0, len(keys))
+		for _, key := range keys {
+			matches = append(matches, pathMatch{Path: childPath(match.Path, key), Value: value[key]})
+		}
+		return matches
+	case []interface{}:
+		matches := make([]pathMatch, 0, len(value))
+		for i, item := range value {
+			matches = append(matches, pathMatch{Path: fmt.Sprintf("%s[%d]", match.Path, i), Value: item})
+		}
+		return matches
+	}
+	return nil
+}
+
+// descendants returns match itself followed by all of its nested values
+func descendants(match pathMatch) []pathMatch {
+	all := []pathMatch{match}
+	for _, child := range children(match) {
+		all = append(all, descendants(child)...)
+	}
+	return all
+}
@@ -0,0 +1,126 @@
+package testbeds
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const jsonPathDocument = `{
+	"output": {
+		"text": "hello",
+		"images": [{"url": "a.png", "size": 1}, {"url": "b.png", "size": 2}, {"url": "c.png", "size": 3}],
+		"meta": {"model": "base", "nested": {"url": "deep.png"}},
+		"odd key": "spaced",
+		"it's": "quoted"
+	},
+	"status": "COMPLETED"
+}`
+
+func TestEvaluateJSONPath(t *testing.T) {
+	var root interface{}
+	if err := json.Unmarshal([]byte(jsonPathDocument), &root); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		expr   string
+		paths  []string
+		values []interface{}
+	}{
+		{name: "root", expr: "$", paths: []string{"$"}},
+		{name: "dot key", expr: "$.status", paths: []string{"$.status"}, values: []interface{}{"COMPLETED"}},
+		{name: "nested key", expr: "$.output.meta.model", paths: []string{"$.output.meta.model"}, values: []interface{}{"base"}},
+		{name: "single quoted key", expr: "$['output']['odd key']", paths: []string{`$.output["odd key"]`}, values: []interface{}{"spaced"}},
+		{name: "double quoted key", expr: `$["output"]["text"]`, paths: []string{"$.output.text"}, values: []interface{}{"hello"}},
+		{name: "escaped quote", expr: `$.output['it\'s']`, paths: []string{`$.output["it's"]`}, values: []interface{}{"quoted"}},
+		{name: "index", expr: "$.output.images[1].url", paths: []string{"$.output.images[1].url"}, values: []interface{}{"b.png"}},
+		{name: "negative index", expr: "$.output.images[-1].size", paths: []string{"$.output.images[2].size"}, values: []interface{}{float64(3)}},
+		{name: "index out of range", expr: "$.output.images[3]"},
+		{name: "negative index out of range", expr: "$.output.images[-4]"},
+		{name: "index on an object", expr: "$.output[0]"},
+		{name: "missing key", expr: "$.output.missing"},
+		{name: "key on an array", expr: "$.output.images.url"},
+		{
+			name:   "bracket wildcard",
+			expr:   "$.output.images[*].url",
+			paths:  []string{"$.output.images[0].url", "$.output.images[1].url", "$.output.images[2].url"},
+			values: []interface{}{"a.png", "b.png", "c.png"},
+		},
+		{
+			name:   "dot wildcard on an object is sorted by key",
+			expr:   "$.output.meta.*",
+			paths:  []string{"$.output.meta.model", "$.output.meta.nested"},
+			values: []interface{}{"base", map[string]interface{}{"url": "deep.png"}},
+		},
+		{
+			name:   "recursive descent",
+			expr:   "$..url",
+			paths:  []string{"$.output.images[0].url", "$.output.images[1].url", "$.output.images[2].url", "$.output.meta.nested.url"},
+			values: []interface{}{"a.png", "b.png", "c.png", "deep.png"},
+		},
+		{
+			name:   "recursive descent with a bracket",
+			expr:   "$..['model']",
+			paths:  []string{"$.output.meta.model"},
+			values: []interface{}{"base"},
+		},
+		{name: "wildcard on a string", expr: "$.status.*"},
+		{name: "surrounding space", expr: "  $.status ", paths: []string{"$.status"}, values: []interface{}{"COMPLETED"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			matches, err := evaluateJSONPath(test.expr, root)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			paths := make([]string, 0, len(matches))
+			values := make([]interface{}, 0, len(matches))
+			for _, match := range matches {
+				paths = append(paths, match.Path)
+				values = append(values, match.Value)
+			}
+			if len(test.paths) == 0 && len(paths) == 0 {
+				return
+			}
+			if !reflect.DeepEqual(paths, test.paths) {
+				t.Errorf("paths = %v, want %v", paths, test.paths)
+			}
+			if test.values != nil && !reflect.DeepEqual(values, test.values) {
+				t.Errorf("values = %v, want %v", values, test.values)
+			}
+		})
+	}
+}
+
+func TestParseJSONPathErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		expr    string
+		wantErr string
+	}{
+		{name: "no root", expr: "output.text", wantErr: "must start with $"},
+		{name: "empty key", expr: "$.output..", wantErr: "empty key"},
+		{name: "trailing dot", expr: "$.output.", wantErr: "empty key"},
+		{name: "bracket after a single dot", expr: "$.['output']", wantErr: "unexpected '['"},
+		{name: "unclosed bracket", expr: "$.output[0", wantErr: "unclosed '['"},
+		{name: "unclosed quote", expr: "$['output]", wantErr: "unclosed '['"},
+		{name: "invalid selector", expr: "$.output[first]", wantErr: "invalid selector"},
+		{name: "slice", expr: "$.output[0:2]", wantErr: "invalid selector"},
+		{name: "invalid escape", expr: `$["\q"]`, wantErr: "invalid key"},
+		{name: "unexpected character", expr: "$output", wantErr: "unexpected character"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := parseJSONPath(test.expr)
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Fatalf("error = %v, want %q", err, test.wantErr)
+			}
+		})
+	}
+}
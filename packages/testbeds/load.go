@@ -0,0 +1,297 @@
+package testbeds
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"sls-local-server/packages/common"
+
+	"go.uber.org/zap"
+)
+
+// maxLoadInFlight caps the open requests of a rate based load test, requests over it count as errors
+const maxLoadInFlight = 1000
+
+// queueDelayBins are the upper bounds in milliseconds of the queue delay histogram
+var queueDelayBins = []int64{10, 50, 100, 250, 500, 1000, 2500, 5000, 10000, 30000, 60000}
+
+type loadSample struct {
+	latency    int64
+	queueDelay int64
+	failed     bool
+}
+
+// loadRecorder collects the samples of the load requests, it is safe for concurrent use
+type loadRecorder struct {
+	mutex   sync.Mutex
+	samples []loadSample
+}
+
+func (r *loadRecorder) add(sample loadSample) {
+	r.mutex.Lock()
+	r.samples = append(r.samples, sample)
+	r.mutex.Unlock()
+}
+
+// runLoad replays the inputs of the tests against the job API as described by the load section
+func runLoad(log *zap.Logger, load common.LoadConfig, id int) common.Result {
+	result := common.Result{
+		ID:     id,
+		Name:   "load",
+		Status: "COMPLETED",
+	}
+
+	pool, err := loadInputs(load)
+	if err == nil {
+		err = validateLoad(load)
+	}
+	if err != nil {
+		log.Error("Invalid load section", zap.Error(err))
+		result.Status = "FAILED"
+		result.Error = err.Error()
+		return result
+	}
+
+	// the load result has its own logs, keeping them for each of its many jobs would grow with the load
+	common.DiscardJobLogs(id)
+
+	// the inputs are used round robin so every test of the pool gets the same share of the load
+	var next uint64
+	pick := func() common.Test {
+		n := atomic.AddUint64(&next, 1) - 1
+		return pool[n%uint64(len(pool))]
+	}
+
+	report := &common.LoadReport{}
+	samples := make([]loadSample, 0)
+	var elapsed time.Duration
+
+	if len(load.Ramp) > 0 {
+		for _, stage := range load.Ramp {
+			log.Info("Starting load stage", zap.Int("concurrency", stage.Concurrency), zap.Int("duration", stage.Duration))
+			stageSamples, stageElapsed := runLoadStage(stage, pick, id)
+
+			stats := summarizeLoad(stageSamples, stageElapsed)
+			stats.Concurrency = stage.Concurrency
+			report.Stages = append(report.Stages, stats)
+
+			samples = append(samples, stageSamples...)
+			elapsed += stageElapsed
+		}
+		report.Total = summarizeLoad(samples, elapsed)
+	} else {
+		log.Info("Starting load test", zap.Float64("rps", load.RPS), zap.Int("duration", load.Duration))
+		samples, elapsed = runLoadRate(log, load, pick, id)
+		report.Total = summarizeLoad(samples, elapsed)
+		report.Total.TargetRPS = load.RPS
+	}
+	result.Load = report
+	result.ExecutionTime = elapsed.Milliseconds()
+
+	violations := make([]string, 0)
+	if load.MaxErrorRate != nil && report.Total.ErrorRate > *load.MaxErrorRate {
+		violations = append(violations, fmt.Sprintf("the error rate %.4f is above %.4f", report.Total.ErrorRate, *load.MaxErrorRate))
+	}
+	if load.MaxP99Latency != nil && report.Total.Latency.P99 > *load.MaxP99Latency {
+		violations = append(violations, fmt.Sprintf("the p99 latency %dms is above %dms", report.Total.Latency.P99, *load.MaxP99Latency))
+	}
+	if len(violations) > 0 {
+		result.Status = "FAILED"
+		result.Error = fmt.Sprintf("The load test failed: %s.", strings.Join(violations, ", "))
+	}
+
+	log.Info("Finished load test", zap.Any("report", report))
+	return result
+}
+
+// loadInputs returns the tests named in the load section, or every valid test
+func loadInputs(load common.LoadConfig) ([]common.Test, error) {
+	pool := make([]common.Test, 0)
+	if len(load.Tests) == 0 {
+		for _, test := range testConfig {
+			if !test.Invalid {
+				pool = append(pool, test)
+			}
+		}
+	} else {
+		for _, name := range load.Tests {
+			found := false
+			for _, test := range testConfig {
+				if test.Name != name {
+					continue
+				}
+				if test.Invalid {
+					return nil, fmt.Errorf("The load section uses the test %q which is not valid.", name)
+				}
+				pool = append(pool, test)
+				found = true
+				break
+			}
+			if !found {
+				return nil, fmt.Errorf("The load section uses the test %q which does not exist.", name)
+			}
+		}
+	}
+
+	if len(pool) == 0 {
+		return nil, fmt.Errorf("The load section has no valid test to take the inputs from.")
+	}
+	return pool, nil
+}
+
+func validateLoad(load common.LoadConfig) error {
+	if len(load.Ramp) == 0 {
+		if load.Duration <= 0 || load.RPS <= 0 {
+			return fmt.Errorf("The load section needs a duration and an rps, or a ramp.")
+		}
+		return nil
+	}
+
+	for k, stage := range load.Ramp {
+		if stage.Concurrency < 1 || stage.Duration < 1 {
+			return fmt.Errorf("The load stage ramp[%d] needs a concurrency and a duration of at least 1.", k)
+		}
+	}
+	return nil
+}
+
+// runLoadStage keeps stage.Concurrency requests in flight until the stage is over, then waits for the last ones
+func runLoadStage(stage common.LoadStage, pick func() common.Test, id int) ([]loadSample, time.Duration) {
+	recorder := &loadRecorder{}
+	start := time.Now()
+	deadline := start.Add(time.Duration(stage.Duration) * time.Second)
+
+	var wg sync.WaitGroup
+	for w := 0; w < stage.Concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for time.Now().Before(deadline) {
+				recorder.add(sendLoadRequest(pick(), id))
+			}
+		}()
+	}
+	wg.Wait()
+
+	return recorder.samples, time.Since(start)
+}
+
+// runLoadRate starts load.RPS requests per second for load.Duration seconds, whether the previous ones finished or not
+func runLoadRate(log *zap.Logger, load common.LoadConfig, pick func() common.Test, id int) ([]loadSample, time.Duration) {
+	recorder := &loadRecorder{}
+	start := time.Now()
+	deadline := start.Add(time.Duration(load.Duration) * time.Second)
+
+	ticker := time.NewTicker(time.Duration(float64(time.Second) / load.RPS))
+	defer ticker.Stop()
+
+	inFlight := make(chan struct{}, maxLoadInFlight)
+	var wg sync.WaitGroup
+	for time.Now().Before(deadline) {
+		select {
+		case inFlight <- struct{}{}:
+			wg.Add(1)
+			go func(test common.Test) {
+				defer wg.Done()
+				defer func() { <-inFlight }()
+				recorder.add(sendLoadRequest(test, id))
+			}(pick())
+		default:
+			log.Warn("Too many load requests in flight, skipping one", zap.Int("in_flight", maxLoadInFlight))
+			recorder.add(loadSample{failed: true})
+		}
+		<-ticker.C
+	}
+	wg.Wait()
+
+	return recorder.samples, time.Since(start)
+}
+
+// sendLoadRequest sends the input of the test through /runsync for the load result id and measures how long it took
+func sendLoadRequest(test common.Test, id int) loadSample {
+	test.Mode = ModeSync
+	wait := time.Duration(*test.Timeout)*time.Millisecond + jobStartGrace
+
+	started := time.Now()
+	responseData, _, err := sendTest(zap.NewNop(), test, id, wait)
+	sample := loadSample{
+		latency: time.Since(started).Milliseconds(),
+	}
+	if err != nil {
+		sample.failed = true
+		return sample
+	}
+
+	status, _ := responseData["status"].(string)
+	sample.failed = status != JobCompleted
+	if delayTime, delayTimeExists := responseData["delayTime"].(float64); delayTimeExists {
+		sample.queueDelay = int64(delayTime)
+	}
+	return sample
+}
+
+// summarizeLoad computes the stats of a set of samples. Throughput, latencies and queue delays only count
+// the successful requests, the failed ones are in the error rate.
+func summarizeLoad(samples []loadSample, elapsed time.Duration) common.LoadStats {
+	stats := common.LoadStats{
+		Duration:            elapsed.Milliseconds(),
+		Requests:            len(samples),
+		QueueDelayHistogram: make([]common.HistogramBin, len(queueDelayBins)+1),
+	}
+	for k, upTo := range queueDelayBins {
+		stats.QueueDelayHistogram[k].UpTo = upTo
+	}
+
+	latencies := make([]int64, 0, len(samples))
+	queueDelays := make([]int64, 0, len(samples))
+	for _, sample := range samples {
+		if sample.failed {
+			stats.Errors++
+			continue
+		}
+		latencies = append(latencies, sample.latency)
+		queueDelays = append(queueDelays, sample.queueDelay)
+
+		bin := sort.Search(len(queueDelayBins), func(k int) bool {
+			return sample.queueDelay <= queueDelayBins[k]
+		})
+		stats.QueueDelayHistogram[bin].Count++
+	}
+
+	if stats.Requests > 0 {
+		stats.ErrorRate = float64(stats.Errors) / float64(stats.Requests)
+	}
+	if elapsed > 0 {
+		stats.Throughput = float64(len(latencies)) / elapsed.Seconds()
+	}
+	stats.Latency = percentiles(latencies)
+	stats.QueueDelay = percentiles(queueDelays)
+	return stats
+}
+
+// percentiles returns the nearest rank percentiles of the values
+func percentiles(values []int64) common.Percentiles {
+	if len(values) == 0 {
+		return common.Percentiles{}
+	}
+
+	sorted := append([]int64(nil), values...)
+	sort.Slice(sorted, func(a, b int) bool {
+		return sorted[a] < sorted[b]
+	})
+	rank := func(p float64) int64 {
+		return sorted[int(math.Ceil(p*float64(len(sorted))))-1]
+	}
+
+	return common.Percentiles{
+		P50: rank(0.50),
+		P90: rank(0.90),
+		P99: rank(0.99),
+		Max: sorted[len(sorted)-1],
+	}
+}
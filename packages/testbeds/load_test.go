@@ -0,0 +1,165 @@
+package testbeds
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"sls-local-server/packages/common"
+)
+
+func TestPercentiles(t *testing.T) {
+	hundred := make([]int64, 0, 100)
+	for i := int64(100); i >= 1; i-- {
+		hundred = append(hundred, i)
+	}
+
+	tests := []struct {
+		name   string
+		values []int64
+		want   common.Percentiles
+	}{
+		{name: "no values", want: common.Percentiles{}},
+		{name: "one value", values: []int64{7}, want: common.Percentiles{P50: 7, P90: 7, P99: 7, Max: 7}},
+		{name: "nearest rank", values: []int64{40, 10, 30, 20}, want: common.Percentiles{P50: 20, P90: 40, P99: 40, Max: 40}},
+		{name: "hundred values", values: hundred, want: common.Percentiles{P50: 50, P90: 90, P99: 99, Max: 100}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := percentiles(test.values); got != test.want {
+				t.Fatalf("got %+v, want %+v", got, test.want)
+			}
+		})
+	}
+
+	if hundred[0] != 100 {
+		t.Error("percentiles sorted the values of the caller")
+	}
+}
+
+func TestSummarizeLoad(t *testing.T) {
+	samples := []loadSample{
+		{latency: 100, queueDelay: 5},
+		{latency: 200, queueDelay: 10},
+		{latency: 300, queueDelay: 11},
+		{latency: 400, queueDelay: 90000},
+		{latency: 5000, failed: true},
+	}
+	stats := summarizeLoad(samples, 2*time.Second)
+
+	if stats.Duration != 2000 || stats.Requests != 5 || stats.Errors != 1 || stats.ErrorRate != 0.2 {
+		t.Errorf("got %d ms, %d requests, %d errors, error rate %v", stats.Duration, stats.Requests, stats.Errors, stats.ErrorRate)
+	}
+	if stats.Throughput != 2 {
+		t.Errorf("throughput = %v, want the 4 successful requests over 2 seconds", stats.Throughput)
+	}
+	if want := (common.Percentiles{P50: 200, P90: 400, P99: 400, Max: 400}); stats.Latency != want {
+		t.Errorf("latency = %+v, want %+v without the failed request", stats.Latency, want)
+	}
+	if want := (common.Percentiles{P50: 10, P90: 90000, P99: 90000, Max: 90000}); stats.QueueDelay != want {
+		t.Errorf("queue delay = %+v, want %+v", stats.QueueDelay, want)
+	}
+
+	counts := make(map[int64]int)
+	for _, bin := range stats.QueueDelayHistogram {
+		if bin.Count > 0 {
+			counts[bin.UpTo] = bin.Count
+		}
+	}
+	// the bins include their upper bound, the last one has no bound
+	if want := map[int64]int{10: 2, 50: 1, 0: 1}; !reflect.DeepEqual(counts, want) {
+		t.Errorf("histogram counts = %v, want %v", counts, want)
+	}
+	if len(stats.QueueDelayHistogram) != len(queueDelayBins)+1 {
+		t.Errorf("%d bins, want %d", len(stats.QueueDelayHistogram), len(queueDelayBins)+1)
+	}
+
+	empty := summarizeLoad(nil, 0)
+	if empty.ErrorRate != 0 || empty.Throughput != 0 || empty.Latency != (common.Percentiles{}) {
+		t.Errorf("summary of no samples = %+v", empty)
+	}
+}
+
+func TestValidateLoad(t *testing.T) {
+	tests := []struct {
+		name string
+		load common.LoadConfig
+		want string
+	}{
+		{name: "rate", load: common.LoadConfig{Duration: 10, RPS: 0.5}},
+		{name: "ramp", load: common.LoadConfig{Ramp: []common.LoadStage{{Concurrency: 1, Duration: 5}, {Concurrency: 4, Duration: 5}}}},
+		{name: "nothing", want: "needs a duration and an rps, or a ramp"},
+		{name: "rate without duration", load: common.LoadConfig{RPS: 10}, want: "needs a duration and an rps"},
+		{name: "rate without rps", load: common.LoadConfig{Duration: 10}, want: "needs a duration and an rps"},
+		{name: "stage without concurrency", load: common.LoadConfig{Ramp: []common.LoadStage{{Concurrency: 1, Duration: 5}, {Duration: 5}}}, want: "ramp[1] needs a concurrency"},
+		{name: "stage without duration", load: common.LoadConfig{Ramp: []common.LoadStage{{Concurrency: 1}}}, want: "ramp[0] needs a concurrency and a duration"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := validateLoad(test.load)
+			if test.want == "" {
+				if err != nil {
+					t.Fatalf("got %v, want a valid load section", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Fatalf("got %v, want %q", err, test.want)
+			}
+		})
+	}
+}
+
+func TestLoadInputs(t *testing.T) {
+	previous := testConfig
+	testConfig = []common.Test{
+		{Name: "first", Input: map[string]interface{}{"n": 1}},
+		{Name: "broken", Invalid: true},
+		{Name: "second", Input: map[string]interface{}{"n": 2}},
+	}
+	t.Cleanup(func() {
+		testConfig = previous
+	})
+
+	tests := []struct {
+		name  string
+		names []string
+		want  []string
+		err   string
+	}{
+		{name: "every valid test", want: []string{"first", "second"}},
+		{name: "named tests", names: []string{"second", "first", "second"}, want: []string{"second", "first", "second"}},
+		{name: "invalid test", names: []string{"broken"}, err: `uses the test "broken" which is not valid`},
+		{name: "unknown test", names: []string{"third"}, err: `uses the test "third" which does not exist`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pool, err := loadInputs(common.LoadConfig{Tests: test.names})
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("got %v, want %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			names := make([]string, 0, len(pool))
+			for _, input := range pool {
+				names = append(names, input.Name)
+			}
+			if !reflect.DeepEqual(names, test.want) {
+				t.Fatalf("got %v, want %v", names, test.want)
+			}
+		})
+	}
+
+	testConfig = []common.Test{{Name: "broken", Invalid: true}}
+	if _, err := loadInputs(common.LoadConfig{}); err == nil || !strings.Contains(err.Error(), "no valid test") {
+		t.Fatalf("got %v, want an error without valid tests", err)
+	}
+}
@@ -1,108 +1,77 @@
 package testbeds
 
 import (
-	"bytes"
-	"encoding/base64"
 	"encoding/json"
 	"fmt"
-	"io"
 	"net/http"
 	"os"
-	"strings"
+	"sync"
 	"time"
 
 	"sls-local-server/packages/common"
-	"sls-local-server/packages/vars"
 
 	"github.com/gin-gonic/gin"
 	"go.uber.org/zap"
 )
 
+// jobStartGrace is how long a test waits on top of its timeout for the worker to pick up the job
+const jobStartGrace = 5 * time.Minute
+
 var (
-	testConfig        []common.Test
-	currentTestPtr    int = 0
-	results           []common.Result
-	testNumberChannel = make(chan int)
+	testConfig  []common.Test
+	suiteConfig common.TestConfig
+	loadConfig  *common.LoadConfig
 )
 
+// Result is a job in the shape returned by the runpod /run, /runsync and /status endpoints
 type Result struct {
-	DelayTime     int         `json:"delayTime"`
-	ExecutionTime int         `json:"executionTime"`
+	DelayTime     int64       `json:"delayTime"`
+	ExecutionTime int64       `json:"executionTime"`
 	ID            string      `json:"id"`
-	Output        *OutputData `json:"output,omitempty"`
+	Output        interface{} `json:"output,omitempty"`
+	Error         interface{} `json:"error,omitempty"`
 	Status        string      `json:"status"`
-	WorkerID      string      `json:"workerId"`
+	WorkerID      string      `json:"workerId,omitempty"`
+}
+
+// StreamResult is a job in the shape returned by the runpod /stream endpoint
+type StreamResult struct {
+	ID     string        `json:"id"`
+	Status string        `json:"status"`
+	Stream []StreamChunk `json:"stream"`
+	Error  interface{}   `json:"error,omitempty"`
 }
 
-// OutputData represents the optional output payload in the result
-type OutputData struct {
-	Payload string `json:"payload"`
+// StreamChunk is a partial output, ReceivedAt is when the worker streamed it and is not part of the runpod API
+type StreamChunk struct {
+	Output     interface{} `json:"output"`
+	ReceivedAt time.Time   `json:"receivedAt"`
 }
 
 func parseTestConfig(log *zap.Logger) {
 	if os.Getenv("RUNPOD_TEST") == "true" {
-		tests := os.Getenv("RUNPOD_TESTS")
-		isURL := strings.HasPrefix(tests, "URL:")
-		if isURL {
-			testURL := strings.TrimPrefix(tests, "URL:")
-			resp, err := http.Get(testURL)
-			if err != nil {
-				log.Error("Failed to get test URL", zap.Error(err))
-				results = append(results, common.Result{
-					ID:     0,
-					Status: "FAILED",
-					Error:  fmt.Sprintf("Could not parse the tests properly. %s", err.Error()),
-				})
-				common.SendResultsToGraphQL("FAILED", nil, log, results)
-				os.Exit(1)
-			}
-			defer resp.Body.Close()
-
-			decodedTestFromURL, err := io.ReadAll(resp.Body)
-			if err != nil {
-				log.Error("Failed to read test from URL", zap.Error(err))
-				results = append(results, common.Result{
-					ID:     0,
-					Status: "FAILED",
-					Error:  fmt.Sprintf("Could not download the tests from the URL. %s", err.Error()),
-				})
-				common.SendResultsToGraphQL("FAILED", nil, log, results)
-				os.Exit(1)
-			}
-
-			tests = string(decodedTestFromURL)
-		}
-
-		decoded, err := base64.StdEncoding.DecodeString(tests)
+		sources, err := readTestSources()
 		if err != nil {
-			results = append(results, common.Result{
-				ID:     0,
-				Status: "FAILED",
-				Error:  fmt.Sprintf("Could not parse the tests properly. %s", err.Error()),
-			})
-			common.SendResultsToGraphQL("SUCCESS", nil, log, results)
-			log.Fatal("Failed to decode base64 string",
-				zap.Error(err))
+			failTestParsing(log, fmt.Sprintf("Could not load the tests. %s", err.Error()))
 		}
 
-		// overwrite the same variable with the decoded string
-		tests = string(decoded)
+		// Parse every test file into testConfig
+		if err := parseTestSources(sources); err != nil {
+			failTestParsing(log, fmt.Sprintf("Could not parse the tests properly. %s", err.Error()))
+		}
 
-		// Parse JSON into testConfig
-		if err := json.Unmarshal([]byte(tests), &testConfig); err != nil {
-			results = append(results, common.Result{
-				ID:     0,
-				Status: "FAILED",
-				Error:  fmt.Sprintf("Could not parse the tests properly. %s", err.Error()),
-			})
-			common.SendResultsToGraphQL("FAILED", nil, log, results)
-			log.Fatal("Failed to parse runpod tests",
-				zap.Error(err))
+		// mask the secrets of the config before anything about the tests is logged or reported
+		for _, env := range suiteConfig.Env {
+			common.AddSecretEnv(env)
+		}
+		if err := common.AddRedactPatterns(suiteConfig.Redact...); err != nil {
+			failTestParsing(log, fmt.Sprintf("Could not parse the tests properly. %s", err.Error()))
 		}
 
 		log.Info("Parsed test config", zap.Any("testConfig", testConfig))
 		for i, test := range testConfig {
-			testConfig[i].ID = &i
+			id := i
+			testConfig[i].ID = &id
 
 			if test.Timeout == nil {
 				threeHundred := 30 * 1000
@@ -114,14 +83,73 @@ func parseTestConfig(log *zap.Logger) {
 			}
 
 			if test.Input == nil {
-				results = append(results, common.Result{
-					ID:     i,
+				testConfig[i].Invalid = true
+				run.record(common.Result{
+					ID:     i + 1,
+					Name:   testConfig[i].Name,
+					Source: test.Source,
+					Input:  test.Input,
 					Status: "FAILED",
-					Error:  fmt.Sprintf("You did not send the tests in a proper format. %s", err.Error()),
+					Error:  "You did not send the tests in a proper format. The test has no input.",
 				})
 				log.Error("Failed to parse test input",
+					zap.String("test_name", test.Name))
+				continue
+			}
+
+			if !isValidMode(test.Mode) {
+				testConfig[i].Invalid = true
+				run.record(common.Result{
+					ID:     i + 1,
+					Name:   testConfig[i].Name,
+					Source: test.Source,
+					Input:  test.Input,
+					Status: "FAILED",
+					Error:  fmt.Sprintf("Unknown test mode %q. The mode has to be %s, %s or %s.", test.Mode, ModeSync, ModeAsync, ModeStream),
+				})
+				log.Error("Unknown test mode",
+					zap.String("test_name", test.Name),
+					zap.String("mode", test.Mode))
+				continue
+			}
+
+			if invalid := validateAssertions(test.Assertions); len(invalid) > 0 {
+				testConfig[i].Invalid = true
+				run.record(common.Result{
+					ID:     i + 1,
+					Name:   testConfig[i].Name,
+					Source: test.Source,
+					Input:  test.Input,
+					Status: "FAILED",
+					Error: common.Failure{
+						Message:    "The assertions of the test are invalid.",
+						Mismatches: invalid,
+					},
+				})
+				log.Error("Invalid test assertions",
 					zap.String("test_name", test.Name),
-					zap.Error(err))
+					zap.Any("assertions", invalid))
+				continue
+			}
+
+			if test.InputSchema != nil {
+				if violations := validateSchema(test.InputSchema, test.Input, "$.input"); len(violations) > 0 {
+					testConfig[i].Invalid = true
+					run.record(common.Result{
+						ID:     i + 1,
+						Name:   testConfig[i].Name,
+						Source: test.Source,
+						Input:  test.Input,
+						Status: "FAILED",
+						Error: common.Failure{
+							Message:    "The input does not match the input schema.",
+							Mismatches: violations,
+						},
+					})
+					log.Error("Test input does not match the input schema",
+						zap.String("test_name", test.Name),
+						zap.Any("violations", violations))
+				}
 			}
 		}
 	} else {
@@ -131,6 +159,18 @@ func parseTestConfig(log *zap.Logger) {
 	}
 }
 
+// failTestParsing ends the run when the tests could not be loaded and stops the server
+func failTestParsing(log *zap.Logger, message string) {
+	log.Error("Failed to load runpod tests", zap.String("error", message))
+	run.record(common.Result{
+		ID:     0,
+		Status: "FAILED",
+		Error:  message,
+	})
+	run.finish(log, common.RunErrored, &message)
+	common.Exit(1, log)
+}
+
 type Handler struct {
 	log *zap.Logger
 }
@@ -176,138 +216,177 @@ func LoggerMiddleware(logger *zap.Logger) gin.HandlerFunc {
 	}
 }
 
+// startTests sends the tests to the job API, config.concurrency of them at once, then runs the load section.
+// The run is PASSED when every test passed and FAILED otherwise.
 func startTests(log *zap.Logger) {
-	for j, test := range testConfig {
-		i := j + 1
-		vars.CURRENT_TEST_ID = i
-		log.Info("Sending request to IDE runsync endpoint", zap.String("test_name", test.Name))
-		// Create HTTP client
-		client := &http.Client{
-			Timeout: time.Second * time.Duration(*test.Timeout),
-		}
+	run.start(log)
 
-		// Marshal back to JSON to ensure proper formatting
-		formattedInput, err := json.Marshal(map[string]any{
-			"input": test.Input,
-		})
-		if err != nil {
-			results = append(results, common.Result{
-				ID:     i,
-				Status: "FAILED",
-				Error:  fmt.Sprintf("You did not send the tests in a proper format. %s", err.Error()),
-			})
-			log.Error("Failed to marshal test input",
-				zap.String("test_name", test.Name),
-				zap.Error(err))
+	concurrency := suiteConfig.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	log.Info("Starting tests", zap.Int("concurrency", concurrency))
+
+	slots := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+
+	for j, test := range testConfig {
+		if test.Invalid {
 			continue
 		}
+		i := j + 1
 
-		fmt.Println("sending request to IDE runsync endpoint", formattedInput)
+		slots <- struct{}{}
+		wg.Add(1)
+		go func(i int, test common.Test) {
+			defer wg.Done()
+			defer func() { <-slots }()
 
-		// Send request to IDE runsync endpoint
-		resp, err := client.Post("http://localhost:80/v2/IDE/runsync", "application/json", bytes.NewBuffer(formattedInput))
-		if err != nil {
-			log.Error("Failed to send request to IDE runsync endpoint",
-				zap.String("test_name", test.Name),
-				zap.Error(err))
-			results = append(results, common.Result{
-				ID:     i,
-				Status: "FAILED",
-				Error:  fmt.Sprintf("Something went wrong when sending the request to AIAPI. %s", err.Error()),
-			})
-			continue
+			run.record(runTest(log, test, i))
+		}(i, test)
+	}
+	wg.Wait()
+
+	if loadConfig != nil {
+		run.record(runLoad(log, *loadConfig, len(testConfig)+1))
+	}
+
+	status, reason := run.outcome()
+	if !run.finish(log, status, reason) {
+		// the handler stopped before the tests were done and already ended the run
+		return
+	}
+
+	if common.LocalReporting() {
+		exitCode := 0
+		if status != common.RunPassed {
+			exitCode = 1
 		}
-		defer resp.Body.Close()
+		common.ExitLocalRun(exitCode, log)
+	}
+}
 
-		// Read and log response
-		body, err := io.ReadAll(resp.Body)
-		if err != nil {
-			log.Error("Failed to read response body",
-				zap.String("test_name", test.Name),
-				zap.Error(err))
-			results = append(results, common.Result{
-				ID:     i,
-				Status: "FAILED",
-				Error:  fmt.Sprintf("Could not read response body once test had already been completed. %s", err.Error()),
-			})
+// runTest sends a single test to the job API and checks the response against its expectations
+func runTest(log *zap.Logger, test common.Test, i int) common.Result {
+	log.Info("Sending test to the job API", zap.String("test_name", test.Name), zap.String("mode", test.Mode))
+	// the test timeout is the execution timeout of the job, the worker also needs time to pick it up
+	wait := time.Duration(*test.Timeout)*time.Millisecond + jobStartGrace
+
+	responseData, streamStats, err := sendTest(log, test, i, wait)
+	if err != nil {
+		log.Error("Failed to run test",
+			zap.String("test_name", test.Name),
+			zap.Error(err))
+		return common.Result{
+			ID:     i,
+			Name:   test.Name,
+			Source: test.Source,
+			Input:  test.Input,
+			Status: "FAILED",
+			Error:  err.Error(),
+			Stream: streamStats,
+		}
+	}
+	log.Info("Received response from the job API",
+		zap.String("test_name", test.Name),
+		zap.Any("response", responseData))
+
+	result := common.Result{
+		Name:   test.Name,
+		Source: test.Source,
+		Input:  test.Input,
+		Status: "COMPLETED",
+		ID:     i,
+	}
+	result.JobID, _ = responseData["id"].(string)
+
+	switch status, _ := responseData["status"].(string); status {
+	case JobCompleted:
+	case JobFailed, JobTimedOut, JobCancelled:
+		result.Status = "FAILED"
+		if errorPayload, exists := responseData["error"]; exists {
+			result.Error = errorPayload
 		} else {
-			log.Info("Received response from IDE runsync endpoint",
-				zap.String("test_name", test.Name),
-				zap.Int("status_code", resp.StatusCode),
-				zap.String("response_body", string(body)))
-			// Parse response body into a map
-			var responseData map[string]interface{}
-			if err := json.Unmarshal(body, &responseData); err != nil {
-				log.Error("Failed to unmarshal response body",
-					zap.String("test_name", test.Name),
-					zap.Error(err))
-				results = append(results, common.Result{
-					Status: "FAILED",
-					Error:  fmt.Sprintf("Failed to parse response from IDE. %s", err.Error()),
-				})
-			} else {
-				result := common.Result{
-					Name:   test.Name,
-					Status: "COMPLETED",
-					ID:     i,
-				}
-
-				if status, ok := responseData["status"].(string); ok && status == "FAILED" {
-					result.Status = "FAILED"
-					if errorPayload, exists := responseData["error"]; exists {
-						result.Error = errorPayload
-					}
-				}
+			result.Error = fmt.Sprintf("The job finished with status %s.", status)
+		}
+	default:
+		result.Status = "FAILED"
+		result.Error = fmt.Sprintf("The job did not finish in time, its last status was %s.", status)
+	}
 
-				if executionTime, executionTimeExists := responseData["executionTime"].(int64); executionTimeExists {
-					result.ExecutionTime = executionTime
-				}
+	if delayTime, delayTimeExists := responseData["delayTime"].(float64); delayTimeExists {
+		result.DelayTime = int64(delayTime)
+	}
+	if executionTime, executionTimeExists := responseData["executionTime"].(float64); executionTimeExists {
+		result.ExecutionTime = int64(executionTime)
+	}
 
-				if outputPayload, exists := responseData["output"]; exists {
-					// Marshal output to determine its size independently of its concrete type
-					if marshaled, err := json.Marshal(outputPayload); err == nil && len(marshaled) > 10_000 {
-						log.Warn("Output payload exceeded size limit; redacted",
-							zap.String("test_name", test.Name),
-							zap.Int("bytes", len(marshaled)))
-						result.Output = "REDACTED (payload exceeded size limit)"
-					} else {
-						result.Output = outputPayload
-					}
-				}
+	if outputPayload, exists := responseData["output"]; exists {
+		result.Output = redactOutput(log, test, outputPayload)
+	}
+	if streamStats != nil {
+		for k := range streamStats.Chunks {
+			streamStats.Chunks[k].Output = redactOutput(log, test, streamStats.Chunks[k].Output)
+		}
+		result.Stream = streamStats
+	}
 
-				results = append(results, result)
-			}
+	if mismatches := verifyResponse(test, responseData); len(mismatches) > 0 {
+		log.Error("Response did not satisfy the test expectations",
+			zap.String("test_name", test.Name),
+			zap.Any("mismatches", mismatches))
+		result.Status = "FAILED"
+		result.Error = common.Failure{
+			Message:    "The response did not satisfy the test expectations.",
+			Mismatches: mismatches,
 		}
+	} else if test.ExpectedOutput != nil && test.ExpectedOutput.Error != "" {
+		// the handler failed the way the test expected it to
+		result.Status = "COMPLETED"
 	}
 
-	common.SendResultsToGraphQL("SUCCESS", nil, log, results)
+	return result
+}
+
+// redactOutput replaces outputs over 10KB so the results stay small enough to be reported
+func redactOutput(log *zap.Logger, test common.Test, outputPayload interface{}) interface{} {
+	// Marshal output to determine its size independently of its concrete type
+	if marshaled, err := json.Marshal(outputPayload); err == nil && len(marshaled) > 10_000 {
+		log.Warn("Output payload exceeded size limit; redacted",
+			zap.String("test_name", test.Name),
+			zap.Int("bytes", len(marshaled)))
+		return "REDACTED (payload exceeded size limit)"
+	}
+	return outputPayload
 }
 
 func RunTests(log *zap.Logger) {
 	log.Info("Starting server")
+	common.CommandFailed = run.commandFailed
+	common.HandlerRestarting = requeueRunningJobs
 	parseTestConfig(log)
 	log.Info("Parsed test config")
 	gin.SetMode(gin.ReleaseMode)
-	common.InstallAndRunAiApi(log)
+	StartJobAPI(log)
 
 	startedAt := time.Now()
 	// kind of mandatory to wait for the aiapi to start
 	for {
 		time.Sleep(time.Duration(1) * time.Second)
-		aiApiStatus, err := http.Get("http://localhost:80/ping")
-		if err != nil {
-			continue
-		}
 		if time.Since(startedAt) > 8*time.Minute {
 			log.Error("Failed to start AI API after 8 minutes")
-			results = append(results, common.Result{
+			message := "Failed to start AI API after 8 minutes. This could be a network issue. Please restart the build and tests."
+			run.record(common.Result{
 				ID:     0,
 				Status: "FAILED",
-				Error:  "Failed to start AI API after 8 minutes. This could be a network issue. Please restart the build and tests.",
+				Error:  message,
 			})
-			common.SendResultsToGraphQL("FAILED", nil, log, results)
-			time.Sleep(time.Duration(10) * time.Second)
-			os.Exit(1)
+			run.finish(log, common.RunErrored, &message)
+			common.Exit(1, log)
+		}
+		aiApiStatus, err := http.Get("http://localhost:80/ping")
+		if err != nil {
+			continue
 		}
 		if aiApiStatus.StatusCode == 200 {
 			break
@@ -0,0 +1,314 @@
+package testbeds
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"sls-local-server/packages/common"
+
+	"gopkg.in/yaml.v3"
+)
+
+// decodeTestFile decodes a single test file. The file can be JSON with comments (JSONC) or YAML, and either a bare array
+// of tests or the wrapped {"tests": [...], "config": {...}} form shown in runpod.tests.template.json.
+func decodeTestFile(data []byte) (common.TestFile, error) {
+	cleaned := stripJSONComments(data)
+	trimmed := bytes.TrimSpace(cleaned)
+
+	if len(trimmed) > 0 && (trimmed[0] == '{' || trimmed[0] == '[') {
+		file, err := decodeJSONTestFile(cleaned)
+		if err == nil {
+			return file, nil
+		}
+
+		// flow style YAML such as {tests: [...]} also starts with a brace
+		var syntaxErr *json.SyntaxError
+		if errors.As(err, &syntaxErr) {
+			if yamlFile, yamlErr := decodeYAMLTestFile(data); yamlErr == nil {
+				return yamlFile, nil
+			}
+		}
+		return common.TestFile{}, describeJSONError(cleaned, err)
+	}
+
+	return decodeYAMLTestFile(data)
+}
+
+func decodeJSONTestFile(data []byte) (common.TestFile, error) {
+	trimmed := bytes.TrimSpace(data)
+	offset := int64(bytes.Index(data, trimmed))
+
+	if len(trimmed) > 0 && trimmed[0] == '[' {
+		var tests []common.Test
+		if err := json.Unmarshal(data, &tests); err != nil {
+			return common.TestFile{}, err
+		}
+		return common.TestFile{Tests: tests}, nil
+	}
+
+	var file common.TestFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return common.TestFile{}, err
+	}
+	if file.Tests == nil {
+		line, column := lineAndColumn(data, offset+1)
+		return common.TestFile{}, fmt.Errorf("line %d, column %d: the test file has no \"tests\" field", line, column)
+	}
+	return file, nil
+}
+
+func decodeYAMLTestFile(data []byte) (common.TestFile, error) {
+	var document yaml.Node
+	if err := yaml.Unmarshal(data, &document); err != nil {
+		return common.TestFile{}, fmt.Errorf("invalid YAML: %s", err.Error())
+	}
+
+	root := &document
+	if root.Kind == yaml.DocumentNode && len(root.Content) > 0 {
+		root = root.Content[0]
+	}
+	for root.Kind == yaml.AliasNode {
+		root = root.Alias
+	}
+
+	// the structs only carry json tags, so the YAML document goes through JSON. The offsets of the values in the JSON
+	// lead back to their lines in the YAML when a value has the wrong type.
+	converted := &yamlJSON{}
+	if err := converted.write(root); err != nil {
+		return common.TestFile{}, fmt.Errorf("invalid YAML: %s", err.Error())
+	}
+
+	switch root.Kind {
+	case yaml.SequenceNode:
+		var tests []common.Test
+		if err := json.Unmarshal(converted.Bytes(), &tests); err != nil {
+			return common.TestFile{}, converted.describeError(err)
+		}
+		return common.TestFile{Tests: tests}, nil
+	case yaml.MappingNode:
+		var file common.TestFile
+		if err := json.Unmarshal(converted.Bytes(), &file); err != nil {
+			return common.TestFile{}, converted.describeError(err)
+		}
+		if file.Tests == nil {
+			return common.TestFile{}, fmt.Errorf("invalid YAML: line %d, column %d: the document has no tests", root.Line, root.Column)
+		}
+		return file, nil
+	default:
+		if root.Line == 0 {
+			return common.TestFile{}, fmt.Errorf("invalid YAML: expected a list of tests or a mapping with tests and config")
+		}
+		return common.TestFile{}, fmt.Errorf("invalid YAML: line %d, column %d: expected a list of tests or a mapping with tests and config", root.Line, root.Column)
+	}
+}
+
+// yamlJSON is a YAML document written as JSON, along with where each value starts in the JSON and in the YAML
+type yamlJSON struct {
+	bytes.Buffer
+	positions []yamlPosition
+}
+
+type yamlPosition struct {
+	offset int64
+	line   int
+	column int
+}
+
+func (j *yamlJSON) write(node *yaml.Node) error {
+	for node.Kind == yaml.AliasNode {
+		node = node.Alias
+	}
+	j.positions = append(j.positions, yamlPosition{offset: int64(j.Len()), line: node.Line, column: node.Column})
+
+	switch node.Kind {
+	case yaml.MappingNode:
+		j.WriteByte('{')
+		if err := j.writePairs(node, j.Len()); err != nil {
+			return err
+		}
+		j.WriteByte('}')
+	case yaml.SequenceNode:
+		j.WriteByte('[')
+		for i, item := range node.Content {
+			if i > 0 {
+				j.WriteByte(',')
+			}
+			if err := j.write(item); err != nil {
+				return err
+			}
+		}
+		j.WriteByte(']')
+	default:
+		var value interface{}
+		if err := node.Decode(&value); err != nil {
+			return err
+		}
+		encoded, err := json.Marshal(value)
+		if err != nil {
+			return fmt.Errorf("line %d, column %d: %s", node.Line, node.Column, err.Error())
+		}
+		j.Write(encoded)
+	}
+	return nil
+}
+
+// writePairs writes the keys and values of a mapping opened at start. The keys merged with << come first so the keys of the mapping
+// itself override them, encoding/json keeps the last value of a repeated key.
+func (j *yamlJSON) writePairs(node *yaml.Node, start int) error {
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key, value := node.Content[i], node.Content[i+1]
+		if key.Kind == yaml.ScalarNode && key.Tag == "!!merge" {
+			for value.Kind == yaml.AliasNode {
+				value = value.Alias
+			}
+			merged := []*yaml.Node{value}
+			if value.Kind == yaml.SequenceNode {
+				merged = value.Content
+			}
+			for _, mapping := range merged {
+				for mapping.Kind == yaml.AliasNode {
+					mapping = mapping.Alias
+				}
+				if mapping.Kind != yaml.MappingNode {
+					return fmt.Errorf("line %d, column %d: only mappings can be merged", mapping.Line, mapping.Column)
+				}
+				if err := j.writePairs(mapping, start); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+
+		var name interface{}
+		if err := key.Decode(&name); err != nil {
+			return err
+		}
+		encoded, _ := json.Marshal(fmt.Sprintf("%v", name))
+		if j.Len() > start {
+			j.WriteByte(',')
+		}
+		j.Write(encoded)
+		j.WriteByte(':')
+		if err := j.write(value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// describeError adds the line and column of the YAML value to JSON decoding errors
+func (j *yamlJSON) describeError(err error) error {
+	var typeErr *json.UnmarshalTypeError
+	if !errors.As(err, &typeErr) {
+		return fmt.Errorf("invalid YAML: %s", err.Error())
+	}
+
+	// encoding/json reports the offset after the start of the value, the value is the last one starting before it
+	for i := len(j.positions) - 1; i >= 0; i-- {
+		if position := j.positions[i]; position.offset < typeErr.Offset {
+			return fmt.Errorf("invalid YAML: line %d, column %d: %q expects %s, got %s", position.line, position.column, typeErr.Field,
+				typeErr.Type.String(), typeErr.Value)
+		}
+	}
+	return fmt.Errorf("invalid YAML: %q expects %s, got %s", typeErr.Field, typeErr.Type.String(), typeErr.Value)
+}
+
+// stripJSONComments blanks out // and /* */ comments and trailing commas outside of strings.
+// Removed bytes are replaced with spaces so that offsets, lines and columns stay the same.
+func stripJSONComments(data []byte) []byte {
+	cleaned := make([]byte, len(data))
+	copy(cleaned, data)
+
+	inString := false
+	lastComma := -1
+	for i := 0; i < len(cleaned); i++ {
+		c := cleaned[i]
+
+		if inString {
+			if c == '\\' {
+				i++
+			} else if c == '"' {
+				inString = false
+			}
+			continue
+		}
+
+		switch {
+		case c == '"':
+			inString = true
+			lastComma = -1
+		case c == '/' && i+1 < len(cleaned) && cleaned[i+1] == '/':
+			for i < len(cleaned) && cleaned[i] != '\n' {
+				cleaned[i] = ' '
+				i++
+			}
+		case c == '/' && i+1 < len(cleaned) && cleaned[i+1] == '*':
+			cleaned[i], cleaned[i+1] = ' ', ' '
+			i += 2
+			for i < len(cleaned) && !(cleaned[i] == '*' && i+1 < len(cleaned) && cleaned[i+1] == '/') {
+				if cleaned[i] != '\n' {
+					cleaned[i] = ' '
+				}
+				i++
+			}
+			if i < len(cleaned) {
+				cleaned[i], cleaned[i+1] = ' ', ' '
+				i++
+			}
+		case c == ',':
+			lastComma = i
+		case c == '}' || c == ']':
+			if lastComma >= 0 {
+				cleaned[lastComma] = ' '
+			}
+			lastComma = -1
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+		default:
+			lastComma = -1
+		}
+	}
+
+	return cleaned
+}
+
+// describeJSONError adds the line and column to JSON decoding errors
+func describeJSONError(data []byte, err error) error {
+	var syntaxErr *json.SyntaxError
+	if errors.As(err, &syntaxErr) {
+		line, column := lineAndColumn(data, syntaxErr.Offset)
+		return fmt.Errorf("line %d, column %d: %s", line, column, syntaxErr.Error())
+	}
+
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) {
+		line, column := lineAndColumn(data, typeErr.Offset)
+		return fmt.Errorf("line %d, column %d: %q expects %s, got %s", line, column, typeErr.Field, typeErr.Type.String(), typeErr.Value)
+	}
+
+	return err
+}
+
+// lineAndColumn converts a byte offset reported by encoding/json into a 1 based line and column
+func lineAndColumn(data []byte, offset int64) (int, int) {
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+
+	line, column := 1, 1
+	for _, c := range data[:offset] {
+		if c == '\n' {
+			line++
+			column = 1
+		} else {
+			column++
+		}
+	}
+
+	// encoding/json reports the offset after the offending byte
+	if column > 1 {
+		column--
+	}
+	return line, column
+}
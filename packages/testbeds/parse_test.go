@@ -0,0 +1,231 @@
+package testbeds
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDecodeYAMLTestFile(t *testing.T) {
+	tests := []struct {
+		name      string
+		data      string
+		wantTests []string
+		wantErr   string
+	}{
+		{
+			name:      "list of tests",
+			data:      "- name: first\n  input: {prompt: hi}\n- name: second\n  input: {}\n",
+			wantTests: []string{"first", "second"},
+		},
+		{
+			name:      "wrapped form",
+			data:      "config:\n  mode: async\ntests:\n  - name: only\n    input: {}\n",
+			wantTests: []string{"only"},
+		},
+		{
+			name:      "flow style",
+			data:      "{tests: [{name: flow, input: {}}]}",
+			wantTests: []string{"flow"},
+		},
+		{
+			name:      "merge key",
+			data:      "defaults: &defaults\n  timeout: 5\ntests:\n  - <<: *defaults\n    name: merged\n    input: {}\n",
+			wantTests: []string{"merged"},
+		},
+		{
+			name:    "syntax error",
+			data:    "tests:\n  - name: a\n   input: {}\n",
+			wantErr: "invalid YAML: yaml: line ",
+		},
+		{
+			name:    "wrong type in the second test",
+			data:    "- name: first\n  timeout: 5\n- name: second\n  timeout: soon\n",
+			wantErr: "invalid YAML: line 4, column 12:",
+		},
+		{
+			name:    "wrong type in the wrapped form",
+			data:    "tests:\n  - name: a\n    input: {}\nconfig:\n  gpuCount: [1, 2]\n",
+			wantErr: `invalid YAML: line 5, column 13: "config.gpuCount" expects int, got array`,
+		},
+		{
+			name:    "wrong type of a nested mapping",
+			data:    "tests:\n  - name: a\n    assertions: {path: $.x}\n",
+			wantErr: "invalid YAML: line 3, column 17:",
+		},
+		{
+			name:    "mapping without tests",
+			data:    "\nconfig:\n  mode: sync\n",
+			wantErr: "invalid YAML: line 2, column 1: the document has no tests",
+		},
+		{
+			name:    "scalar document",
+			data:    "just text\n",
+			wantErr: "invalid YAML: line 1, column 1: expected a list of tests",
+		},
+		{
+			name:    "empty document",
+			data:    "",
+			wantErr: "invalid YAML: expected a list of tests",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			file, err := decodeYAMLTestFile([]byte(test.data))
+			if test.wantErr != "" {
+				if err == nil || !strings.HasPrefix(err.Error(), test.wantErr) {
+					t.Fatalf("error = %v, want prefix %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(file.Tests) != len(test.wantTests) {
+				t.Fatalf("got %d tests, want %d", len(file.Tests), len(test.wantTests))
+			}
+			for i, name := range test.wantTests {
+				if file.Tests[i].Name != name {
+					t.Errorf("test %d name = %q, want %q", i, file.Tests[i].Name, name)
+				}
+			}
+		})
+	}
+}
+
+func TestStripJSONComments(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want string
+	}{
+		{name: "no comments", data: `{"a": 1}`, want: `{"a": 1}`},
+		{name: "line comment", data: "{\"a\": 1 // one\n}", want: "{\"a\": 1       \n}"},
+		{name: "block comment", data: `{/* x */"a": 1}`, want: `{       "a": 1}`},
+		{name: "block comment keeps newlines", data: "[/* a\nb */1]", want: "[    \n    1]"},
+		{name: "unclosed block comment", data: "[1 /* a", want: "[1     "},
+		{name: "comment markers in a string", data: `{"url": "http://a/*b*/"}`, want: `{"url": "http://a/*b*/"}`},
+		{name: "escaped quote in a string", data: `["a\"//b"] // c`, want: `["a\"//b"]     `},
+		{name: "trailing comma in an object", data: `{"a": 1,}`, want: `{"a": 1 }`},
+		{name: "trailing comma in an array", data: "[1, 2,\n]", want: "[1, 2 \n]"},
+		{name: "trailing comma before a comment", data: "[1, // last\n]", want: "[1         \n]"},
+		{name: "comma in a string", data: `["a,"]`, want: `["a,"]`},
+		{name: "comma between values", data: `[1, 2]`, want: `[1, 2]`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := string(stripJSONComments([]byte(test.data)))
+			if got != test.want {
+				t.Fatalf("got %q, want %q", got, test.want)
+			}
+			if len(got) != len(test.data) {
+				t.Fatalf("length changed from %d to %d", len(test.data), len(got))
+			}
+		})
+	}
+}
+
+func TestDecodeTestFile(t *testing.T) {
+	tests := []struct {
+		name      string
+		data      string
+		wantTests []string
+		wantMode  string
+		wantLoad  bool
+		wantErr   string
+	}{
+		{
+			name:      "bare array",
+			data:      `[{"name": "a", "input": {}}, {"name": "b", "input": {}}]`,
+			wantTests: []string{"a", "b"},
+		},
+		{
+			name:      "wrapped form",
+			data:      `{"tests": [{"name": "a", "input": {}}], "config": {"mode": "async", "gpuCount": 1}}`,
+			wantTests: []string{"a"},
+			wantMode:  "async",
+		},
+		{
+			name:      "wrapped form with load",
+			data:      `{"tests": [{"name": "a", "input": {}}], "load": {"duration": 10, "rps": 2}}`,
+			wantTests: []string{"a"},
+			wantLoad:  true,
+		},
+		{
+			name: "JSONC",
+			data: `// smoke tests
+{
+	/* the handler echoes its input */
+	"tests": [
+		{"name": "a", "input": {"url": "https://example.com/a.png"},},
+	],
+}`,
+			wantTests: []string{"a"},
+		},
+		{
+			name:      "leading space before a bare array",
+			data:      "\n\n  [{\"name\": \"a\"}]",
+			wantTests: []string{"a"},
+		},
+		{
+			name:      "flow style YAML",
+			data:      "{tests: [{name: a, input: {}}]}",
+			wantTests: []string{"a"},
+		},
+		{
+			name:      "block YAML",
+			data:      "tests:\n  - name: a\n",
+			wantTests: []string{"a"},
+		},
+		{
+			name:    "wrapped form without tests",
+			data:    "\n  {\"config\": {}}",
+			wantErr: `line 2, column 3: the test file has no "tests" field`,
+		},
+		{
+			name:    "syntax error",
+			data:    "[\n  {\"name\": \"a\",, \"input\": {}}\n]",
+			wantErr: "line 2, column 16: invalid character ','",
+		},
+		{
+			name:    "wrong type",
+			data:    "{\n  \"tests\": [{\"name\": \"a\", \"timeout\": \"soon\"}]\n}",
+			wantErr: "line 2, column 43:",
+		},
+		{
+			name:    "wrong type after a comment keeps the position",
+			data:    "[ /* a\n comment */ {\"name\": 1}]",
+			wantErr: "line 2, column 22:",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			file, err := decodeTestFile([]byte(test.data))
+			if test.wantErr != "" {
+				if err == nil || !strings.HasPrefix(err.Error(), test.wantErr) {
+					t.Fatalf("error = %v, want prefix %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			names := make([]string, 0, len(file.Tests))
+			for _, parsed := range file.Tests {
+				names = append(names, parsed.Name)
+			}
+			if strings.Join(names, ",") != strings.Join(test.wantTests, ",") {
+				t.Errorf("tests = %v, want %v", names, test.wantTests)
+			}
+			if file.Config.Mode != test.wantMode {
+				t.Errorf("mode = %q, want %q", file.Config.Mode, test.wantMode)
+			}
+			if (file.Load != nil) != test.wantLoad {
+				t.Errorf("load = %+v, want it set %t", file.Load, test.wantLoad)
+			}
+		})
+	}
+}
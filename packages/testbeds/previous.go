@@ -1,72 +1,77 @@
 package testbeds
 
 import (
-	"fmt"
+	"encoding/json"
 	"net/http"
-	"sls-local-server/packages/common"
-	"time"
+	"strconv"
+	"strings"
 
 	"github.com/gin-gonic/gin"
 	"go.uber.org/zap"
 )
 
-// GetStatus returns the status of a job
+// JobTake hands the next queued job to the worker, it answers 204 when no job was queued in time
 func (h *Handler) JobTake(c *gin.Context) {
-	h.log.Info("Job take", zap.Int("current_test", currentTestPtr))
-	fmt.Println("Job take", currentTestPtr)
-
-	currentTestPtr++
-	if currentTestPtr >= len(testConfig) {
-		common.SendResultsToGraphQL("FAILED", nil, h.log, results)
-		h.log.Error("No more tests", zap.Int("current_test", currentTestPtr))
+	workerID := podID(c)
+	job := jobQueue.Take(c.Request.Context(), workerID, jobTakeWait)
+	if job == nil {
+		c.Status(http.StatusNoContent)
 		return
 	}
 
-	nextTestPayload := testConfig[currentTestPtr]
-	testConfig[currentTestPtr].StartedAt = time.Now().UTC()
-	h.log.Info("Job take", zap.Any("next_test_payload", nextTestPayload), zap.Any("current_test_ptr", currentTestPtr))
-
-	go cancelJob(*nextTestPayload.Timeout, currentTestPtr, h.log)
-
-	testNumberChannel <- currentTestPtr
-	fmt.Println("currentTestPtr added to channel", currentTestPtr)
-
+	h.log.Info("Job take", zap.String("job_id", job.ID), zap.String("worker_id", workerID), zap.Int("test_number", job.TestNumber))
 	c.JSON(http.StatusOK, gin.H{
-		"delayTime":     0,
-		"error":         "",
-		"executionTime": nextTestPayload.Timeout,
-		"id":            fmt.Sprintf("%d", currentTestPtr),
-		"input":         nextTestPayload.Input,
-		"retries":       0,
-		"status":        200,
+		"id":    job.ID,
+		"input": job.Input,
 	})
+	h.releaseUndelivered(c, []*Job{job}, workerID)
 }
 
-func cancelJob(timeout int, jobIndex int, log *zap.Logger) {
-	time.Sleep(time.Duration(timeout) * time.Millisecond)
-
-	common.Mutex.Lock()
-	defer common.Mutex.Unlock()
-	if testConfig[jobIndex].Completed {
+// releaseUndelivered queues the jobs again when the worker went away before the job-take response reached it,
+// they would otherwise stay in progress until their execution timeout, or forever without one
+func (h *Handler) releaseUndelivered(c *gin.Context, jobs []*Job, workerID string) {
+	c.Writer.Flush()
+	if c.Request.Context().Err() == nil && len(c.Errors) == 0 {
 		return
 	}
 
-	// send a request to graphql with the job index and execution timeout result
-	results = append(results, common.Result{
-		ID:            *testConfig[jobIndex].ID,
-		Name:          testConfig[jobIndex].Name,
-		Status:        "FAILED",
-		Error:         "Execution timeout exceeded",
-		ExecutionTime: time.Since(testConfig[jobIndex].StartedAt).Milliseconds(),
-	})
+	released := jobQueue.Release(jobs, workerID)
+	h.log.Warn("The job-take response was not delivered, the jobs are queued again", zap.String("worker_id", workerID),
+		zap.Int("released", released))
+}
+
+// JobTakeBatch hands up to batch_size queued jobs to the worker, the runpod SDK uses it when the
+// handler runs with a concurrency_modifier above 1. It answers 204 when no job was queued in time.
+func (h *Handler) JobTakeBatch(c *gin.Context) {
+	workerID := podID(c)
+	batchSize, err := strconv.Atoi(c.Query("batch_size"))
+	if err != nil || batchSize < 1 {
+		batchSize = 1
+	}
 
-	errorMsg := "Execution timeout exceeded"
-	common.SendResultsToGraphQL("FAILED", &errorMsg, log, results)
+	jobs := jobQueue.TakeBatch(c.Request.Context(), workerID, jobTakeWait, batchSize)
+	if len(jobs) == 0 {
+		c.Status(http.StatusNoContent)
+		return
+	}
+
+	batch := make([]gin.H, 0, len(jobs))
+	for _, job := range jobs {
+		h.log.Info("Job take", zap.String("job_id", job.ID), zap.String("worker_id", workerID), zap.Int("test_number", job.TestNumber))
+		batch = append(batch, gin.H{
+			"id":    job.ID,
+			"input": job.Input,
+		})
+	}
+	c.JSON(http.StatusOK, batch)
+	h.releaseUndelivered(c, jobs, workerID)
 }
 
+// JobDone stores the output or the error the worker reported for a job it took.
+// It answers 404 for unknown jobs and 409 when the job is not running on this worker.
 func (h *Handler) JobDone(c *gin.Context) {
-	lastTest := testConfig[currentTestPtr]
-	endTime := time.Now().UTC()
+	jobID := c.Param("jobId")
+	workerID := podID(c)
 
 	var payload map[string]interface{}
 	if err := c.BindJSON(&payload); err != nil {
@@ -76,44 +81,68 @@ func (h *Handler) JobDone(c *gin.Context) {
 		})
 		return
 	}
-	h.log.Info("Job done payload", zap.Any("payload", payload))
-
-	if payload["error"] != nil {
-		results = append(results, common.Result{
-			ID:            *lastTest.ID,
-			Name:          lastTest.Name,
-			Error:         payload["error"].(string),
-			ExecutionTime: endTime.Sub(testConfig[currentTestPtr].StartedAt).Milliseconds(),
-			Status:        "FAILED",
-		})
-		common.SendResultsToGraphQL("FAILED", nil, h.log, results)
+	h.log.Info("Job done payload", zap.String("job_id", jobID), zap.Any("payload", payload))
+
+	job, err := jobQueue.Complete(jobID, workerID, payload["output"], workerError(payload["error"]))
+	if err != nil {
+		h.log.Error("Failed to complete job", zap.String("job_id", jobID), zap.String("worker_id", workerID), zap.Error(err))
+		h.jobError(c, err)
+		return
+	}
 
-		h.log.Error("Error found in payload", zap.Any("payload", payload))
+	result := jobQueue.Response(job)
+	if result.Status == JobFailed {
+		h.log.Error("Job failed", zap.String("job_id", jobID), zap.Any("error", result.Error))
+	}
+
+	c.JSON(http.StatusOK, gin.H{})
+}
+
+// JobStream stores a partial output of a generator handler, the runpod SDK sends them as {"output": partial}
+func (h *Handler) JobStream(c *gin.Context) {
+	jobID := c.Param("jobId")
+	workerID := podID(c)
+
+	var payload map[string]interface{}
+	if err := c.BindJSON(&payload); err != nil {
+		h.log.Error("Failed to parse request body", zap.Error(err))
 		c.JSON(http.StatusBadRequest, gin.H{
-			"error": "Error found in payload",
+			"error": "Invalid request body",
 		})
 		return
 	}
 
-	results = append(results, common.Result{
-		ID:            currentTestPtr,
-		Name:          lastTest.Name,
-		Status:        "SUCCESS",
-		Error:         "",
-		ExecutionTime: endTime.Sub(testConfig[currentTestPtr].StartedAt).Milliseconds(),
-	})
-
-	h.log.Info("Job done", zap.Any("results", results), zap.Any("current_test_ptr", currentTestPtr), zap.Any("end_time", endTime), zap.Any("start_time", testConfig[currentTestPtr].StartedAt))
+	if err := jobQueue.AppendStream(jobID, workerID, payload["output"]); err != nil {
+		h.log.Error("Failed to stream job output", zap.String("job_id", jobID), zap.String("worker_id", workerID), zap.Error(err))
+		h.jobError(c, err)
+		return
+	}
 
-	testConfig[currentTestPtr].Completed = true
+	c.JSON(http.StatusOK, gin.H{})
+}
 
-	if currentTestPtr == len(testConfig)-1 {
-		common.SendResultsToGraphQL("PASSED", nil, h.log, results)
-		h.log.Error("No more tests", zap.Int("current_test", currentTestPtr))
+// workerError normalizes the error reported by the worker, nil means the job succeeded.
+// The runpod SDK sends its error details as a JSON encoded string, those are decoded into an object.
+func workerError(reported interface{}) interface{} {
+	switch e := reported.(type) {
+	case nil:
+		return nil
+	case string:
+		if strings.TrimSpace(e) == "" {
+			return nil
+		}
+		var details map[string]interface{}
+		if err := json.Unmarshal([]byte(e), &details); err == nil {
+			return details
+		}
+		return e
+	default:
+		return e
 	}
+}
 
-	c.JSON(http.StatusOK, gin.H{
-		"status":  "cancelled",
-		"message": "Job successfully cancelled",
-	})
+// podID returns the worker id of a webhook request. The runpod SDK appends its query
+// parameters with & so they can end up in the last path segment.
+func podID(c *gin.Context) string {
+	return strings.SplitN(c.Param("podId"), "&", 2)[0]
 }
@@ -0,0 +1,523 @@
+package testbeds
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"sls-local-server/packages/common"
+)
+
+const (
+	JobInQueue    = "IN_QUEUE"
+	JobInProgress = "IN_PROGRESS"
+	JobCompleted  = "COMPLETED"
+	JobFailed     = "FAILED"
+	JobCancelled  = "CANCELLED"
+	JobTimedOut   = "TIMED_OUT"
+)
+
+const (
+	// workerIdleAfter is how long a worker counts as alive after its last job-take request
+	workerIdleAfter = time.Minute
+	// jobRetention is how long a finished job can still be read from /status before it is forgotten
+	jobRetention = 5 * time.Minute
+	// maxJobRetries is how many times a job is queued again after the handler crashed while running it, a job
+	// that crashes the handler every time fails instead of crashing it forever
+	maxJobRetries = 1
+)
+
+var (
+	errJobNotFound   = errors.New("job not found")
+	errJobNotTaken   = errors.New("job has not been taken by a worker")
+	errJobOtherOwner = errors.New("job was taken by another worker")
+)
+
+// Job is a request submitted to the local job API
+type Job struct {
+	ID       string
+	Input    interface{}
+	Status   string
+	Output   interface{}
+	Error    interface{}
+	WorkerID string
+	// TestNumber is the test the job was submitted for, 0 for requests that do not come from a test
+	TestNumber int
+	// ExecutionTimeout fails the job with TIMED_OUT when the worker takes longer, 0 disables it
+	ExecutionTimeout time.Duration
+	CreatedAt        time.Time
+	StartedAt        time.Time
+	CompletedAt      time.Time
+	// Retries is how many times the job was queued again after the handler crashed while running it
+	Retries int
+	// Stream holds the partial outputs of generator handlers in the order the worker sent them
+	Stream []interface{}
+	// StreamTimes is when each chunk of Stream was received
+	StreamTimes []time.Time
+
+	// done is closed once the job reaches a terminal status
+	done chan struct{}
+	// streamRead is how many stream chunks were already returned by /stream
+	streamRead int
+	// streamNotify is closed and replaced every time the worker streams a chunk
+	streamNotify chan struct{}
+}
+
+// JobQueue is the in memory queue behind the local serverless job API, it is safe for concurrent use
+type JobQueue struct {
+	mutex   sync.Mutex
+	jobs    map[string]*Job
+	pending []*Job
+	workers map[string]time.Time
+	// evicted counts the finished jobs that were forgotten by status, for /health
+	evicted map[string]int
+	// retried counts the jobs queued again after the handler crashed, for /health
+	retried int
+	// notify is closed and replaced every time a job is queued to wake up waiting workers
+	notify chan struct{}
+}
+
+var jobQueue = NewJobQueue()
+
+func NewJobQueue() *JobQueue {
+	return &JobQueue{
+		jobs:    make(map[string]*Job),
+		pending: make([]*Job, 0),
+		workers: make(map[string]time.Time),
+		evicted: make(map[string]int),
+		notify:  make(chan struct{}),
+	}
+}
+
+// Submit queues a new job, sync jobs get the same sync- prefix as on runpod
+func (q *JobQueue) Submit(input interface{}, sync bool, testNumber int, executionTimeout time.Duration) *Job {
+	id := newJobID()
+	if sync {
+		id = "sync-" + id
+	}
+
+	job := &Job{
+		ID:               id,
+		Input:            input,
+		Status:           JobInQueue,
+		TestNumber:       testNumber,
+		ExecutionTimeout: executionTimeout,
+		CreatedAt:        time.Now().UTC(),
+		done:             make(chan struct{}),
+		streamNotify:     make(chan struct{}),
+	}
+
+	q.mutex.Lock()
+	q.jobs[job.ID] = job
+	q.pending = append(q.pending, job)
+	close(q.notify)
+	q.notify = make(chan struct{})
+	q.mutex.Unlock()
+
+	return job
+}
+
+// Take hands the oldest queued job to a worker, waiting up to wait for one to be submitted.
+// It returns nil when the queue stayed empty.
+func (q *JobQueue) Take(ctx context.Context, workerID string, wait time.Duration) *Job {
+	jobs := q.TakeBatch(ctx, workerID, wait, 1)
+	if len(jobs) == 0 {
+		return nil
+	}
+	return jobs[0]
+}
+
+// TakeBatch hands up to size of the oldest queued jobs to a worker, waiting up to wait for at least one to be submitted.
+// It returns an empty list when the queue stayed empty.
+func (q *JobQueue) TakeBatch(ctx context.Context, workerID string, wait time.Duration, size int) []*Job {
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	for {
+		q.mutex.Lock()
+		q.workers[workerID] = time.Now()
+		if len(q.pending) > 0 {
+			count := min(size, len(q.pending))
+			jobs := make([]*Job, count)
+			copy(jobs, q.pending[:count])
+			q.pending = q.pending[count:]
+
+			for _, job := range jobs {
+				job.Status = JobInProgress
+				job.WorkerID = workerID
+				job.StartedAt = time.Now().UTC()
+				common.JobStarted(job.ID, job.TestNumber, job.StartedAt)
+				if job.ExecutionTimeout > 0 {
+					expiring, startedAt := job, job.StartedAt
+					time.AfterFunc(job.ExecutionTimeout, func() {
+						q.expire(expiring, startedAt)
+					})
+				}
+			}
+			q.mutex.Unlock()
+			return jobs
+		}
+		notify := q.notify
+		q.mutex.Unlock()
+
+		select {
+		case <-notify:
+		case <-timer.C:
+			return nil
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// Complete stores the result reported by the worker that took the job.
+// Results for jobs that were already cancelled or timed out are ignored.
+func (q *JobQueue) Complete(jobID string, workerID string, output interface{}, jobError interface{}) (*Job, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	job, exists := q.jobs[jobID]
+	if !exists {
+		return nil, errJobNotFound
+	}
+	if isTerminal(job.Status) {
+		return job, nil
+	}
+	if job.Status != JobInProgress {
+		return job, errJobNotTaken
+	}
+	if job.WorkerID != workerID {
+		return job, errJobOtherOwner
+	}
+
+	job.Output = output
+	job.Error = jobError
+	if jobError != nil {
+		q.finish(job, JobFailed)
+	} else {
+		q.finish(job, JobCompleted)
+	}
+	return job, nil
+}
+
+// AppendStream stores a partial output streamed by the worker that took the job.
+// Chunks for jobs that were already cancelled or timed out are ignored.
+func (q *JobQueue) AppendStream(jobID string, workerID string, output interface{}) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	job, exists := q.jobs[jobID]
+	if !exists {
+		return errJobNotFound
+	}
+	if isTerminal(job.Status) {
+		return nil
+	}
+	if job.Status != JobInProgress {
+		return errJobNotTaken
+	}
+	if job.WorkerID != workerID {
+		return errJobOtherOwner
+	}
+
+	job.Stream = append(job.Stream, output)
+	job.StreamTimes = append(job.StreamTimes, time.Now().UTC())
+	close(job.streamNotify)
+	job.streamNotify = make(chan struct{})
+	return nil
+}
+
+// ReadStream returns the chunks streamed since the previous call, waiting up to wait for a new one.
+// It returns right away once the job finished.
+func (q *JobQueue) ReadStream(ctx context.Context, jobID string, wait time.Duration) (StreamResult, error) {
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	expired := false
+	for {
+		q.mutex.Lock()
+		job, exists := q.jobs[jobID]
+		if !exists {
+			q.mutex.Unlock()
+			return StreamResult{}, errJobNotFound
+		}
+		if expired || job.streamRead < len(job.Stream) || isTerminal(job.Status) {
+			result := StreamResult{
+				ID:     job.ID,
+				Status: job.Status,
+				Stream: make([]StreamChunk, 0, len(job.Stream)-job.streamRead),
+				Error:  job.Error,
+			}
+			for i := job.streamRead; i < len(job.Stream); i++ {
+				result.Stream = append(result.Stream, StreamChunk{Output: job.Stream[i], ReceivedAt: job.StreamTimes[i]})
+			}
+			job.streamRead = len(job.Stream)
+			q.mutex.Unlock()
+			return result, nil
+		}
+		notify := job.streamNotify
+		q.mutex.Unlock()
+
+		select {
+		case <-notify:
+		case <-job.done:
+		case <-timer.C:
+			expired = true
+		case <-ctx.Done():
+			expired = true
+		}
+	}
+}
+
+// expire fails a job that is still running once its execution timeout elapsed, startedAt tells the run of a
+// job that was queued again apart from the previous ones
+func (q *JobQueue) expire(job *Job, startedAt time.Time) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if job.Status != JobInProgress || !job.StartedAt.Equal(startedAt) {
+		return
+	}
+	job.Error = "Execution timeout exceeded"
+	q.finish(job, JobTimedOut)
+}
+
+// Cancel stops a job that has not finished yet
+func (q *JobQueue) Cancel(jobID string) (*Job, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	job, exists := q.jobs[jobID]
+	if !exists {
+		return nil, errJobNotFound
+	}
+	if isTerminal(job.Status) {
+		return job, nil
+	}
+
+	q.removePending(job)
+	q.finish(job, JobCancelled)
+	return job, nil
+}
+
+// RequeueRunning puts the jobs in progress back at the front of the queue once the handler crashed, they died
+// with it. The jobs already queued again maxJobRetries times fail with reason instead. It returns how many jobs
+// were queued again and how many failed.
+func (q *JobQueue) RequeueRunning(reason string) (int, int) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	running := make([]*Job, 0)
+	for _, job := range q.jobs {
+		if job.Status == JobInProgress {
+			running = append(running, job)
+		}
+	}
+	sort.Slice(running, func(a, b int) bool {
+		return running[a].CreatedAt.Before(running[b].CreatedAt)
+	})
+
+	requeued := make([]*Job, 0, len(running))
+	failed := 0
+	for _, job := range running {
+		if job.Retries >= maxJobRetries {
+			job.Error = reason
+			q.finish(job, JobFailed)
+			failed++
+			continue
+		}
+		job.Retries++
+		requeued = append(requeued, job)
+	}
+	q.retried += len(requeued)
+	q.requeue(requeued)
+	return len(requeued), failed
+}
+
+// Release puts jobs the worker took back at the front of the queue when the job-take response did not reach it.
+// The jobs that finished or were taken again since are left alone.
+func (q *JobQueue) Release(jobs []*Job, workerID string) int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	released := make([]*Job, 0, len(jobs))
+	for _, job := range jobs {
+		if job.Status == JobInProgress && job.WorkerID == workerID {
+			released = append(released, job)
+		}
+	}
+	q.requeue(released)
+	return len(released)
+}
+
+// requeue puts running jobs back at the front of the queue in the given order, the caller holds the mutex.
+// The execution timers of their previous run see the reset StartedAt and leave them alone.
+func (q *JobQueue) requeue(jobs []*Job) {
+	if len(jobs) == 0 {
+		return
+	}
+	for _, job := range jobs {
+		common.JobFinished(job.ID, time.Now().UTC())
+		job.Status = JobInQueue
+		job.WorkerID = ""
+		job.StartedAt = time.Time{}
+		job.Stream = nil
+		job.StreamTimes = nil
+		job.streamRead = 0
+	}
+	q.pending = append(append(make([]*Job, 0, len(jobs)+len(q.pending)), jobs...), q.pending...)
+	close(q.notify)
+	q.notify = make(chan struct{})
+}
+
+// Purge cancels every job that is still in the queue and returns how many were removed
+func (q *JobQueue) Purge() int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	removed := len(q.pending)
+	for _, job := range q.pending {
+		q.finish(job, JobCancelled)
+	}
+	q.pending = make([]*Job, 0)
+	return removed
+}
+
+// Wait blocks until the job is finished or the timeout elapsed
+func (q *JobQueue) Wait(ctx context.Context, job *Job, timeout time.Duration) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-job.done:
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+}
+
+// Get returns the current state of a job
+func (q *JobQueue) Get(jobID string) (Result, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	job, exists := q.jobs[jobID]
+	if !exists {
+		return Result{}, errJobNotFound
+	}
+	return q.response(job), nil
+}
+
+// Response returns the job in the shape of the runpod status endpoint
+func (q *JobQueue) Response(job *Job) Result {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.response(job)
+}
+
+// Health returns the job and worker counters of the /health endpoint
+func (q *JobQueue) Health() map[string]interface{} {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	counts := map[string]int{}
+	for status, count := range q.evicted {
+		counts[status] = count
+	}
+	running := map[string]bool{}
+	for _, job := range q.jobs {
+		counts[job.Status]++
+		if job.Status == JobInProgress {
+			running[job.WorkerID] = true
+		}
+	}
+
+	idle := 0
+	for workerID, lastSeen := range q.workers {
+		if !running[workerID] && time.Since(lastSeen) < workerIdleAfter {
+			idle++
+		}
+	}
+
+	return map[string]interface{}{
+		"jobs": map[string]int{
+			"completed":  counts[JobCompleted],
+			"failed":     counts[JobFailed] + counts[JobTimedOut],
+			"inProgress": counts[JobInProgress],
+			"inQueue":    counts[JobInQueue],
+			"retried":    q.retried,
+		},
+		"workers": map[string]int{
+			"idle":    idle,
+			"running": len(running),
+		},
+	}
+}
+
+func (q *JobQueue) response(job *Job) Result {
+	result := Result{
+		ID:       job.ID,
+		Status:   job.Status,
+		Output:   job.Output,
+		Error:    job.Error,
+		WorkerID: job.WorkerID,
+	}
+
+	if !job.StartedAt.IsZero() {
+		result.DelayTime = job.StartedAt.Sub(job.CreatedAt).Milliseconds()
+		if !job.CompletedAt.IsZero() {
+			result.ExecutionTime = job.CompletedAt.Sub(job.StartedAt).Milliseconds()
+		}
+	}
+	return result
+}
+
+// finish moves a job to a terminal status, the caller holds the mutex. The job is forgotten after jobRetention.
+func (q *JobQueue) finish(job *Job, status string) {
+	job.Status = status
+	job.CompletedAt = time.Now().UTC()
+	common.JobFinished(job.ID, job.CompletedAt)
+	close(job.done)
+	time.AfterFunc(jobRetention, func() {
+		q.evict(job)
+	})
+}
+
+// evict forgets a finished job
+func (q *JobQueue) evict(job *Job) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if q.jobs[job.ID] == job {
+		delete(q.jobs, job.ID)
+		q.evicted[job.Status]++
+	}
+}
+
+// removePending drops a job from the queue, the caller holds the mutex
+func (q *JobQueue) removePending(job *Job) {
+	for i, pending := range q.pending {
+		if pending == job {
+			q.pending = append(q.pending[:i], q.pending[i+1:]...)
+			return
+		}
+	}
+}
+
+func isTerminal(status string) bool {
+	return status == JobCompleted || status == JobFailed || status == JobCancelled || status == JobTimedOut
+}
+
+// newJobID returns a random UUID v4
+func newJobID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%d", time.Now().UnixNano())
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
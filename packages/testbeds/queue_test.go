@@ -0,0 +1,313 @@
+package testbeds
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+func TestJobQueueTake(t *testing.T) {
+	q := NewJobQueue()
+	first := q.Submit("a", true, 1, 0)
+	second := q.Submit("b", false, 2, 0)
+	third := q.Submit("c", false, 3, 0)
+
+	jobs := q.TakeBatch(context.Background(), "worker-1", time.Second, 2)
+	if len(jobs) != 2 || jobs[0] != first || jobs[1] != second {
+		t.Fatalf("took %v, want the two oldest jobs", jobs)
+	}
+	for _, job := range jobs {
+		if job.Status != JobInProgress || job.WorkerID != "worker-1" || job.StartedAt.IsZero() {
+			t.Errorf("taken job %s is %s on %q", job.ID, job.Status, job.WorkerID)
+		}
+	}
+	if job := q.Take(context.Background(), "worker-2", time.Second); job != third {
+		t.Fatalf("took %v, want the last job", job)
+	}
+
+	if job := q.Take(context.Background(), "worker-1", 10*time.Millisecond); job != nil {
+		t.Fatalf("took %s from an empty queue", job.ID)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if job := q.Take(ctx, "worker-1", time.Second); job != nil {
+		t.Fatalf("took %s after the request was cancelled", job.ID)
+	}
+
+	// a waiting worker gets the job as soon as it is submitted
+	taken := make(chan *Job)
+	go func() {
+		taken <- q.Take(context.Background(), "worker-1", time.Second)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	submitted := q.Submit("d", false, 4, 0)
+	if job := <-taken; job != submitted {
+		t.Fatalf("waiting worker took %v, want %s", job, submitted.ID)
+	}
+}
+
+func TestJobQueueTransitions(t *testing.T) {
+	tests := []struct {
+		name string
+		// run drives the queue and returns the job to check along with the error of the last call
+		run    func(q *JobQueue) (*Job, error)
+		status string
+		err    error
+	}{
+		{
+			name: "complete",
+			run: func(q *JobQueue) (*Job, error) {
+				q.Submit("a", false, 1, 0)
+				job := q.Take(context.Background(), "worker-1", time.Second)
+				return q.Complete(job.ID, "worker-1", "output", nil)
+			},
+			status: JobCompleted,
+		},
+		{
+			name: "complete with an error",
+			run: func(q *JobQueue) (*Job, error) {
+				q.Submit("a", false, 1, 0)
+				job := q.Take(context.Background(), "worker-1", time.Second)
+				return q.Complete(job.ID, "worker-1", nil, "boom")
+			},
+			status: JobFailed,
+		},
+		{
+			name: "complete from another worker",
+			run: func(q *JobQueue) (*Job, error) {
+				q.Submit("a", false, 1, 0)
+				job := q.Take(context.Background(), "worker-1", time.Second)
+				return q.Complete(job.ID, "worker-2", "output", nil)
+			},
+			status: JobInProgress,
+			err:    errJobOtherOwner,
+		},
+		{
+			name: "complete before the job was taken",
+			run: func(q *JobQueue) (*Job, error) {
+				job := q.Submit("a", false, 1, 0)
+				return q.Complete(job.ID, "worker-1", "output", nil)
+			},
+			status: JobInQueue,
+			err:    errJobNotTaken,
+		},
+		{
+			name: "complete an unknown job",
+			run: func(q *JobQueue) (*Job, error) {
+				return q.Complete("missing", "worker-1", "output", nil)
+			},
+			err: errJobNotFound,
+		},
+		{
+			name: "complete after cancel is ignored",
+			run: func(q *JobQueue) (*Job, error) {
+				q.Submit("a", false, 1, 0)
+				job := q.Take(context.Background(), "worker-1", time.Second)
+				q.Cancel(job.ID)
+				return q.Complete(job.ID, "worker-1", "output", nil)
+			},
+			status: JobCancelled,
+		},
+		{
+			name: "cancel a queued job",
+			run: func(q *JobQueue) (*Job, error) {
+				job := q.Submit("a", false, 1, 0)
+				q.Cancel(job.ID)
+				if taken := q.Take(context.Background(), "worker-1", 10*time.Millisecond); taken != nil {
+					return taken, errors.New("a cancelled job was taken")
+				}
+				return job, nil
+			},
+			status: JobCancelled,
+		},
+		{
+			name: "expire",
+			run: func(q *JobQueue) (*Job, error) {
+				q.Submit("a", false, 1, 20*time.Millisecond)
+				job := q.Take(context.Background(), "worker-1", time.Second)
+				q.Wait(context.Background(), job, time.Second)
+				return job, nil
+			},
+			status: JobTimedOut,
+		},
+		{
+			name: "expire after complete does nothing",
+			run: func(q *JobQueue) (*Job, error) {
+				q.Submit("a", false, 1, 20*time.Millisecond)
+				job := q.Take(context.Background(), "worker-1", time.Second)
+				q.Complete(job.ID, "worker-1", "output", nil)
+				time.Sleep(40 * time.Millisecond)
+				return job, nil
+			},
+			status: JobCompleted,
+		},
+		{
+			name: "the timer of a released job does not expire its next run",
+			run: func(q *JobQueue) (*Job, error) {
+				q.Submit("a", false, 1, 30*time.Millisecond)
+				job := q.Take(context.Background(), "worker-1", time.Second)
+				time.Sleep(20 * time.Millisecond)
+				q.Release([]*Job{job}, "worker-1")
+				q.Take(context.Background(), "worker-2", time.Second)
+				time.Sleep(20 * time.Millisecond)
+				return job, nil
+			},
+			status: JobInProgress,
+		},
+		{
+			name: "release puts the job back at the front",
+			run: func(q *JobQueue) (*Job, error) {
+				q.Submit("a", false, 1, 0)
+				job := q.Take(context.Background(), "worker-1", time.Second)
+				q.Submit("b", false, 2, 0)
+				if released := q.Release([]*Job{job}, "worker-1"); released != 1 {
+					return job, errors.New("the job was not released")
+				}
+				if taken := q.Take(context.Background(), "worker-2", time.Second); taken != job {
+					return taken, errors.New("the released job is not taken first")
+				}
+				return job, nil
+			},
+			status: JobInProgress,
+		},
+		{
+			name: "release of a finished job does nothing",
+			run: func(q *JobQueue) (*Job, error) {
+				q.Submit("a", false, 1, 0)
+				job := q.Take(context.Background(), "worker-1", time.Second)
+				q.Complete(job.ID, "worker-1", "output", nil)
+				if released := q.Release([]*Job{job}, "worker-1"); released != 0 {
+					return job, errors.New("a finished job was released")
+				}
+				return job, nil
+			},
+			status: JobCompleted,
+		},
+		{
+			name: "release by another worker does nothing",
+			run: func(q *JobQueue) (*Job, error) {
+				q.Submit("a", false, 1, 0)
+				job := q.Take(context.Background(), "worker-1", time.Second)
+				q.Release([]*Job{job}, "worker-2")
+				return job, nil
+			},
+			status: JobInProgress,
+		},
+		{
+			name: "requeue running jobs once",
+			run: func(q *JobQueue) (*Job, error) {
+				q.Submit("a", false, 1, 0)
+				job := q.Take(context.Background(), "worker-1", time.Second)
+				if requeued, failed := q.RequeueRunning("crashed"); requeued != 1 || failed != 0 {
+					return job, errors.New("the job was not requeued")
+				}
+				if job.Retries != 1 {
+					return job, errors.New("the retry was not counted")
+				}
+				return job, nil
+			},
+			status: JobInQueue,
+		},
+		{
+			name: "requeue fails a job that already crashed the handler",
+			run: func(q *JobQueue) (*Job, error) {
+				q.Submit("a", false, 1, 0)
+				job := q.Take(context.Background(), "worker-1", time.Second)
+				q.RequeueRunning("crashed")
+				q.Take(context.Background(), "worker-1", time.Second)
+				if requeued, failed := q.RequeueRunning("crashed"); requeued != 0 || failed != 1 {
+					return job, errors.New("the job was not failed")
+				}
+				return job, nil
+			},
+			status: JobFailed,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			job, err := test.run(NewJobQueue())
+			if !errors.Is(err, test.err) {
+				t.Fatalf("error = %v, want %v", err, test.err)
+			}
+			if test.status == "" {
+				return
+			}
+			if job == nil || job.Status != test.status {
+				t.Fatalf("job = %+v, want status %s", job, test.status)
+			}
+		})
+	}
+}
+
+func TestJobTakeReleasesUndeliveredJobs(t *testing.T) {
+	previous := jobQueue
+	jobQueue = NewJobQueue()
+	t.Cleanup(func() {
+		jobQueue = previous
+	})
+	gin.SetMode(gin.TestMode)
+	h := NewHandler(zap.NewNop())
+
+	tests := []struct {
+		name     string
+		handler  gin.HandlerFunc
+		url      string
+		cancel   bool
+		released bool
+	}{
+		{name: "delivered", handler: h.JobTake, url: "/job-take/worker-1"},
+		{name: "worker went away", handler: h.JobTake, url: "/job-take/worker-1", cancel: true, released: true},
+		{name: "batch delivered", handler: h.JobTakeBatch, url: "/job-take-batch/worker-1?batch_size=2"},
+		{name: "batch worker went away", handler: h.JobTakeBatch, url: "/job-take-batch/worker-1?batch_size=2", cancel: true, released: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			job := jobQueue.Submit("a", false, 1, 0)
+			defer jobQueue.Cancel(job.ID)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			request := httptest.NewRequest(http.MethodGet, test.url, nil).WithContext(ctx)
+			recorder := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(recorder)
+			c.Request = request
+			c.Params = gin.Params{{Key: "podId", Value: "worker-1"}}
+			if test.cancel {
+				// the worker gives up on the request once the job was taken
+				c.Writer = &cancellingWriter{ResponseWriter: c.Writer, cancel: cancel}
+			}
+
+			test.handler(c)
+			if recorder.Code != http.StatusOK {
+				t.Fatalf("status = %d, want 200", recorder.Code)
+			}
+			want := JobInProgress
+			if test.released {
+				want = JobInQueue
+			}
+			if result, _ := jobQueue.Get(job.ID); result.Status != want {
+				t.Fatalf("job is %s, want %s", result.Status, want)
+			}
+		})
+	}
+}
+
+// cancellingWriter cancels the request while the response is written, as when the worker disconnects
+type cancellingWriter struct {
+	gin.ResponseWriter
+	cancel context.CancelFunc
+}
+
+func (w *cancellingWriter) Write(data []byte) (int, error) {
+	w.cancel()
+	return w.ResponseWriter.Write(data)
+}
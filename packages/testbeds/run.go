@@ -0,0 +1,139 @@
+package testbeds
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"sls-local-server/packages/common"
+
+	"go.uber.org/zap"
+)
+
+// runTransitions lists the statuses a run can move to from each status, the final statuses have none
+var runTransitions = map[string][]string{
+	common.RunInitializing: {common.RunRunning, common.RunErrored},
+	common.RunRunning:      {common.RunPassed, common.RunFailed, common.RunErrored},
+}
+
+// testRun is the lifecycle of the test run, INITIALIZING -> RUNNING -> PASSED, FAILED or ERRORED.
+// It collects the results and makes sure exactly one final status is reported, whichever part of the
+// server finishes the run first.
+type testRun struct {
+	mutex   sync.Mutex
+	status  string
+	results []common.Result
+}
+
+var run = newTestRun()
+
+func newTestRun() *testRun {
+	return &testRun{
+		status:  common.RunInitializing,
+		results: make([]common.Result, 0),
+	}
+}
+
+// record adds the result of a test, it is safe to call from concurrent tests. The results that come in after the
+// run finished are dropped, the final status was already reported without them.
+func (r *testRun) record(result common.Result) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if common.IsFinalRunStatus(r.status) {
+		return
+	}
+	r.results = append(r.results, result)
+}
+
+// snapshot returns the results recorded so far in the order of the tests, with the handler logs and the
+// resource usage of each one
+func (r *testRun) snapshot() []common.Result {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	results := append([]common.Result(nil), r.results...)
+	sort.SliceStable(results, func(a, b int) bool {
+		return results[a].ID < results[b].ID
+	})
+	for i := range results {
+		if results[i].JobID != "" {
+			results[i].Logs = common.CapturedJobLogs(results[i].JobID)
+			results[i].Resources = common.JobResourceUsage(results[i].JobID)
+		} else {
+			results[i].Logs = common.CapturedLogs(results[i].ID)
+		}
+	}
+	return results
+}
+
+// transition moves the run to status, it fails when the lifecycle does not allow it
+func (r *testRun) transition(status string) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for _, allowed := range runTransitions[r.status] {
+		if allowed == status {
+			r.status = status
+			return nil
+		}
+	}
+	return fmt.Errorf("the run cannot go from %s to %s", r.status, status)
+}
+
+// start moves the run to RUNNING and sends a progress update with the results known so far
+func (r *testRun) start(log *zap.Logger) {
+	if err := r.transition(common.RunRunning); err != nil {
+		log.Error("Failed to start the test run", zap.Error(err))
+		return
+	}
+	common.ReportResults(common.RunRunning, nil, log, r.snapshot())
+}
+
+// finish moves the run to a final status and reports it. It returns false without reporting
+// when the run already finished.
+func (r *testRun) finish(log *zap.Logger, status string, errorReason *string) bool {
+	if err := r.transition(status); err != nil {
+		log.Warn("Ignoring the end of the test run", zap.String("status", status), zap.Error(err))
+		return false
+	}
+
+	log.Info("Test run finished", zap.String("status", status))
+	common.ReportResults(status, errorReason, log, r.snapshot())
+	return true
+}
+
+// outcome is PASSED when every result passed and FAILED otherwise. A run without any result is ERRORED with
+// the reason, so an empty test file does not pass.
+func (r *testRun) outcome() (string, *string) {
+	results := r.snapshot()
+	if len(results) == 0 {
+		reason := "No test was run, the test file has no tests."
+		return common.RunErrored, &reason
+	}
+	for _, result := range results {
+		if result.Status != "COMPLETED" {
+			return common.RunFailed, nil
+		}
+	}
+	return common.RunPassed, nil
+}
+
+// finished tells whether the run reached a final status
+func (r *testRun) finished() bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return common.IsFinalRunStatus(r.status)
+}
+
+// commandFailed ends the run when the handler stops or cannot start before the tests are done. The results of a
+// run that already finished were reported, the handler stopping afterwards does not change them.
+func (r *testRun) commandFailed(errorMsg string, results []common.Result, log *zap.Logger) {
+	if r.finished() {
+		log.Warn("Ignoring the handler failure after the end of the test run", zap.String("error", errorMsg))
+		return
+	}
+	for _, result := range results {
+		r.record(result)
+	}
+	r.finish(log, common.RunErrored, &errorMsg)
+}
@@ -0,0 +1,56 @@
+package testbeds
+
+import (
+	"testing"
+
+	"sls-local-server/packages/common"
+
+	"go.uber.org/zap"
+)
+
+func TestTestRunOutcome(t *testing.T) {
+	tests := []struct {
+		name     string
+		statuses []string
+		want     string
+		reason   bool
+	}{
+		{name: "no results", want: common.RunErrored, reason: true},
+		{name: "every test passed", statuses: []string{"COMPLETED", "COMPLETED"}, want: common.RunPassed},
+		{name: "a test failed", statuses: []string{"COMPLETED", "FAILED"}, want: common.RunFailed},
+		{name: "every test was invalid", statuses: []string{"FAILED", "FAILED"}, want: common.RunFailed},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := newTestRun()
+			for i, status := range test.statuses {
+				r.record(common.Result{ID: i + 1, Status: status})
+			}
+			status, reason := r.outcome()
+			if status != test.want || (reason != nil) != test.reason {
+				t.Fatalf("got %s with reason %v, want %s", status, reason, test.want)
+			}
+		})
+	}
+}
+
+func TestTestRunIgnoresResultsAfterTheEnd(t *testing.T) {
+	log := zap.NewNop()
+	r := newTestRun()
+	r.start(log)
+	r.record(common.Result{ID: 1, Status: "COMPLETED"})
+	if !r.finish(log, common.RunPassed, nil) {
+		t.Fatal("the run did not finish")
+	}
+
+	r.commandFailed("Command closed: killed by SIGKILL", []common.Result{{ID: 0, Name: "initialization", Status: "ERROR"}}, log)
+	r.record(common.Result{ID: 2, Status: "FAILED"})
+
+	if r.status != common.RunPassed {
+		t.Errorf("status = %s after a late handler failure, want %s", r.status, common.RunPassed)
+	}
+	if results := r.snapshot(); len(results) != 1 || results[0].ID != 1 {
+		t.Errorf("results = %+v, want only the result recorded before the end", results)
+	}
+}
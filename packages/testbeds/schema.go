@@ -0,0 +1,365 @@
+package testbeds
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"sls-local-server/packages/common"
+)
+
+// maxSchemaDepth stops recursive $ref definitions from looping forever
+const maxSchemaDepth = 64
+
+// schemaValidator validates values against the subset of JSON Schema (draft 7) used by the test files:
+// type, enum, const, properties, required, additionalProperties, patternProperties, items, min/maxItems, uniqueItems,
+// min/maxLength, pattern, minimum, maximum, exclusiveMinimum, exclusiveMaximum, multipleOf, min/maxProperties,
+// allOf, anyOf, oneOf, not and local $ref.
+type schemaValidator struct {
+	root       interface{}
+	violations []common.Mismatch
+}
+
+// validateSchema returns every violation of schema by instance, path is the location of instance in the response
+func validateSchema(schema interface{}, instance interface{}, path string) []common.Mismatch {
+	schema = normalizeJSON(schema)
+	v := &schemaValidator{root: schema}
+	v.validate(schema, "#", normalizeJSON(instance), path, 0)
+	return v.violations
+}
+
+// checkOutputSchema validates the output of a completed response
+func checkOutputSchema(test common.Test, responseData map[string]interface{}) []common.Mismatch {
+	if test.OutputSchema == nil {
+		return nil
+	}
+
+	if _, failed := responseError(responseData); failed {
+		return nil
+	}
+	return validateSchema(test.OutputSchema, responseData["output"], "$.output")
+}
+
+func (v *schemaValidator) fail(schemaPath string, path string, actual interface{}, message string) {
+	v.violations = append(v.violations, common.Mismatch{
+		Path:       path,
+		SchemaPath: schemaPath,
+		Operator:   "schema",
+		Actual:     reportedValue(actual),
+		Message:    message,
+	})
+}
+
+// matches validates instance against schema without recording the violations
+func (v *schemaValidator) matches(schema interface{}, schemaPath string, instance interface{}, path string, depth int) bool {
+	sub := &schemaValidator{root: v.root}
+	sub.validate(schema, schemaPath, instance, path, depth)
+	return len(sub.violations) == 0
+}
+
+func (v *schemaValidator) validate(schema interface{}, schemaPath string, instance interface{}, path string, depth int) {
+	if depth > maxSchemaDepth {
+		v.fail(schemaPath, path, nil, "schema is nested too deeply")
+		return
+	}
+
+	switch s := schema.(type) {
+	case bool:
+		if !s {
+			v.fail(schemaPath, path, instance, "no value is allowed here")
+		}
+		return
+	case map[string]interface{}:
+		v.validateObject(s, schemaPath, instance, path, depth)
+	default:
+		v.fail(schemaPath, path, nil, "invalid schema, expected an object or a boolean")
+	}
+}
+
+func (v *schemaValidator) validateObject(s map[string]interface{}, schemaPath string, instance interface{}, path string, depth int) {
+	if ref, ok := s["$ref"].(string); ok {
+		target, err := resolveRef(v.root, ref)
+		if err != nil {
+			v.fail(schemaPath+"/$ref", path, nil, err.Error())
+			return
+		}
+		v.validate(target, ref, instance, path, depth+1)
+		return
+	}
+
+	if typeValue, exists := s["type"]; exists && !matchesSchemaType(typeValue, instance) {
+		v.fail(schemaPath+"/type", path, instance, fmt.Sprintf("expected %s, got %s", describeSchemaType(typeValue), jsonType(instance)))
+		return
+	}
+
+	if enum, ok := s["enum"].([]interface{}); ok {
+		found := false
+		for _, option := range enum {
+			if reflect.DeepEqual(option, instance) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			v.fail(schemaPath+"/enum", path, instance, "value is not one of the allowed values")
+		}
+	}
+
+	if constValue, exists := s["const"]; exists && !reflect.DeepEqual(constValue, instance) {
+		v.fail(schemaPath+"/const", path, instance, "value is not equal to the constant")
+	}
+
+	switch value := instance.(type) {
+	case string:
+		v.validateString(s, schemaPath, value, path)
+	case float64:
+		v.validateNumber(s, schemaPath, value, path)
+	case []interface{}:
+		v.validateArray(s, schemaPath, value, path, depth)
+	case map[string]interface{}:
+		v.validateProperties(s, schemaPath, value, path, depth)
+	}
+
+	if allOf, ok := s["allOf"].([]interface{}); ok {
+		for i, sub := range allOf {
+			v.validate(sub, fmt.Sprintf("%s/allOf/%d", schemaPath, i), instance, path, depth+1)
+		}
+	}
+
+	if anyOf, ok := s["anyOf"].([]interface{}); ok {
+		matched := false
+		for i, sub := range anyOf {
+			if v.matches(sub, fmt.Sprintf("%s/anyOf/%d", schemaPath, i), instance, path, depth+1) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			v.fail(schemaPath+"/anyOf", path, instance, "value does not match any of the schemas")
+		}
+	}
+
+	if oneOf, ok := s["oneOf"].([]interface{}); ok {
+		matched := 0
+		for i, sub := range oneOf {
+			if v.matches(sub, fmt.Sprintf("%s/oneOf/%d", schemaPath, i), instance, path, depth+1) {
+				matched++
+			}
+		}
+		if matched != 1 {
+			v.fail(schemaPath+"/oneOf", path, instance, fmt.Sprintf("value matches %d schemas instead of exactly one", matched))
+		}
+	}
+
+	if not, exists := s["not"]; exists && v.matches(not, schemaPath+"/not", instance, path, depth+1) {
+		v.fail(schemaPath+"/not", path, instance, "value matches a schema it should not match")
+	}
+}
+
+func (v *schemaValidator) validateString(s map[string]interface{}, schemaPath string, value string, path string) {
+	length := float64(utf8.RuneCountInString(value))
+	if minLength, ok := s["minLength"].(float64); ok && length < minLength {
+		v.fail(schemaPath+"/minLength", path, value, fmt.Sprintf("string is shorter than %v characters", minLength))
+	}
+	if maxLength, ok := s["maxLength"].(float64); ok && length > maxLength {
+		v.fail(schemaPath+"/maxLength", path, value, fmt.Sprintf("string is longer than %v characters", maxLength))
+	}
+	if pattern, ok := s["pattern"].(string); ok {
+		regex, err := regexp.Compile(pattern)
+		if err != nil {
+			v.fail(schemaPath+"/pattern", path, nil, fmt.Sprintf("invalid pattern: %s", err.Error()))
+		} else if !regex.MatchString(value) {
+			v.fail(schemaPath+"/pattern", path, value, fmt.Sprintf("string does not match the pattern %q", pattern))
+		}
+	}
+}
+
+func (v *schemaValidator) validateNumber(s map[string]interface{}, schemaPath string, value float64, path string) {
+	if minimum, ok := s["minimum"].(float64); ok {
+		// draft 4 used a boolean exclusiveMinimum next to minimum
+		if exclusive, _ := s["exclusiveMinimum"].(bool); exclusive && value <= minimum {
+			v.fail(schemaPath+"/minimum", path, value, fmt.Sprintf("value must be greater than %v", minimum))
+		} else if value < minimum {
+			v.fail(schemaPath+"/minimum", path, value, fmt.Sprintf("value must be at least %v", minimum))
+		}
+	}
+	if maximum, ok := s["maximum"].(float64); ok {
+		if exclusive, _ := s["exclusiveMaximum"].(bool); exclusive && value >= maximum {
+			v.fail(schemaPath+"/maximum", path, value, fmt.Sprintf("value must be less than %v", maximum))
+		} else if value > maximum {
+			v.fail(schemaPath+"/maximum", path, value, fmt.Sprintf("value must be at most %v", maximum))
+		}
+	}
+	if exclusiveMinimum, ok := s["exclusiveMinimum"].(float64); ok && value <= exclusiveMinimum {
+		v.fail(schemaPath+"/exclusiveMinimum", path, value, fmt.Sprintf("value must be greater than %v", exclusiveMinimum))
+	}
+	if exclusiveMaximum, ok := s["exclusiveMaximum"].(float64); ok && value >= exclusiveMaximum {
+		v.fail(schemaPath+"/exclusiveMaximum", path, value, fmt.Sprintf("value must be less than %v", exclusiveMaximum))
+	}
+	if multipleOf, ok := s["multipleOf"].(float64); ok && multipleOf > 0 {
+		quotient := value / multipleOf
+		if math.Abs(quotient-math.Round(quotient)) > 1e-9 {
+			v.fail(schemaPath+"/multipleOf", path, value, fmt.Sprintf("value is not a multiple of %v", multipleOf))
+		}
+	}
+}
+
+func (v *schemaValidator) validateArray(s map[string]interface{}, schemaPath string, value []interface{}, path string, depth int) {
+	length := float64(len(value))
+	if minItems, ok := s["minItems"].(float64); ok && length < minItems {
+		v.fail(schemaPath+"/minItems", path, nil, fmt.Sprintf("array has %d items, expected at least %v", len(value), minItems))
+	}
+	if maxItems, ok := s["maxItems"].(float64); ok && length > maxItems {
+		v.fail(schemaPath+"/maxItems", path, nil, fmt.Sprintf("array has %d items, expected at most %v", len(value), maxItems))
+	}
+
+	if unique, _ := s["uniqueItems"].(bool); unique {
+		for i := 0; i < len(value); i++ {
+			for j := i + 1; j < len(value); j++ {
+				if reflect.DeepEqual(value[i], value[j]) {
+					v.fail(schemaPath+"/uniqueItems", fmt.Sprintf("%s[%d]", path, j), value[j], fmt.Sprintf("item is a duplicate of item %d", i))
+				}
+			}
+		}
+	}
+
+	switch items := s["items"].(type) {
+	case []interface{}:
+		// tuple validation, additionalItems applies to everything after the listed schemas
+		for i, item := range value {
+			if i < len(items) {
+				v.validate(items[i], fmt.Sprintf("%s/items/%d", schemaPath, i), item, fmt.Sprintf("%s[%d]", path, i), depth+1)
+			} else if additional, exists := s["additionalItems"]; exists {
+				v.validate(additional, schemaPath+"/additionalItems", item, fmt.Sprintf("%s[%d]", path, i), depth+1)
+			}
+		}
+	case nil:
+	default:
+		for i, item := range value {
+			v.validate(items, schemaPath+"/items", item, fmt.Sprintf("%s[%d]", path, i), depth+1)
+		}
+	}
+}
+
+func (v *schemaValidator) validateProperties(s map[string]interface{}, schemaPath string, value map[string]interface{}, path string, depth int) {
+	length := float64(len(value))
+	if minProperties, ok := s["minProperties"].(float64); ok && length < minProperties {
+		v.fail(schemaPath+"/minProperties", path, nil, fmt.Sprintf("object has %d properties, expected at least %v", len(value), minProperties))
+	}
+	if maxProperties, ok := s["maxProperties"].(float64); ok && length > maxProperties {
+		v.fail(schemaPath+"/maxProperties", path, nil, fmt.Sprintf("object has %d properties, expected at most %v", len(value), maxProperties))
+	}
+
+	if required, ok := s["required"].([]interface{}); ok {
+		for _, name := range required {
+			key, ok := name.(string)
+			if !ok {
+				continue
+			}
+			if _, exists := value[key]; !exists {
+				v.fail(schemaPath+"/required", childPath(path, key), nil, "required property is missing")
+			}
+		}
+	}
+
+	properties, _ := s["properties"].(map[string]interface{})
+	patternProperties, _ := s["patternProperties"].(map[string]interface{})
+	patterns := sortedKeys(patternProperties)
+
+	for _, key := range sortedKeys(value) {
+		matched := false
+		if propertySchema, exists := properties[key]; exists {
+			matched = true
+			v.validate(propertySchema, schemaPath+"/properties/"+escapePointer(key), value[key], childPath(path, key), depth+1)
+		}
+
+		for _, pattern := range patterns {
+			regex, err := regexp.Compile(pattern)
+			if err != nil || !regex.MatchString(key) {
+				continue
+			}
+			matched = true
+			v.validate(patternProperties[pattern], schemaPath+"/patternProperties/"+escapePointer(pattern), value[key], childPath(path, key), depth+1)
+		}
+
+		if matched {
+			continue
+		}
+		if additional, exists := s["additionalProperties"]; exists {
+			if allowed, ok := additional.(bool); ok && !allowed {
+				v.fail(schemaPath+"/additionalProperties", childPath(path, key), value[key], "additional property is not allowed")
+				continue
+			}
+			v.validate(additional, schemaPath+"/additionalProperties", value[key], childPath(path, key), depth+1)
+		}
+	}
+}
+
+func matchesSchemaType(typeValue interface{}, instance interface{}) bool {
+	switch t := typeValue.(type) {
+	case string:
+		return isType(instance, t)
+	case []interface{}:
+		for _, option := range t {
+			if name, ok := option.(string); ok && isType(instance, name) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func describeSchemaType(typeValue interface{}) string {
+	if options, ok := typeValue.([]interface{}); ok {
+		names := make([]string, 0, len(options))
+		for _, option := range options {
+			names = append(names, fmt.Sprintf("%v", option))
+		}
+		sort.Strings(names)
+		return strings.Join(names, " or ")
+	}
+	return fmt.Sprintf("%v", typeValue)
+}
+
+// resolveRef follows a local JSON pointer such as #/definitions/image
+func resolveRef(root interface{}, ref string) (interface{}, error) {
+	if !strings.HasPrefix(ref, "#") {
+		return nil, fmt.Errorf("only local references are supported, got %q", ref)
+	}
+
+	current := root
+	pointer := strings.TrimPrefix(ref, "#")
+	if pointer == "" {
+		return current, nil
+	}
+
+	for _, token := range strings.Split(strings.TrimPrefix(pointer, "/"), "/") {
+		token = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+		switch node := current.(type) {
+		case map[string]interface{}:
+			next, exists := node[token]
+			if !exists {
+				return nil, fmt.Errorf("reference %q not found", ref)
+			}
+			current = next
+		case []interface{}:
+			index, err := strconv.Atoi(token)
+			if err != nil || index < 0 || index >= len(node) {
+				return nil, fmt.Errorf("reference %q not found", ref)
+			}
+			current = node[index]
+		default:
+			return nil, fmt.Errorf("reference %q not found", ref)
+		}
+	}
+	return current, nil
+}
+
+func escapePointer(token string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(token, "~", "~0"), "/", "~1")
+}
@@ -0,0 +1,164 @@
+package testbeds
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"sls-local-server/packages/common"
+)
+
+func decodeJSON(t *testing.T, text string) interface{} {
+	t.Helper()
+	var value interface{}
+	if err := json.Unmarshal([]byte(text), &value); err != nil {
+		t.Fatalf("invalid JSON %s: %v", text, err)
+	}
+	return value
+}
+
+func TestValidateSchema(t *testing.T) {
+	tests := []struct {
+		name     string
+		schema   string
+		instance string
+		// want lists the path and the schema path of every violation, separated by a space
+		want []string
+	}{
+		{name: "true schema", schema: `true`, instance: `{"a": 1}`},
+		{name: "false schema", schema: `false`, instance: `1`, want: []string{"$ #"}},
+		{name: "invalid schema", schema: `"string"`, instance: `1`, want: []string{"$ #"}},
+
+		{name: "type", schema: `{"type": "string"}`, instance: `"a"`},
+		{name: "type mismatch", schema: `{"type": "string"}`, instance: `1`, want: []string{"$ #/type"}},
+		{name: "type list", schema: `{"type": ["string", "null"]}`, instance: `null`},
+		{name: "type list mismatch", schema: `{"type": ["string", "null"]}`, instance: `true`, want: []string{"$ #/type"}},
+		{name: "integer", schema: `{"type": "integer"}`, instance: `2.0`},
+		{name: "integer with a fraction", schema: `{"type": "integer"}`, instance: `2.5`, want: []string{"$ #/type"}},
+		{name: "type mismatch skips the other keywords", schema: `{"type": "string", "minLength": 3}`, instance: `1`, want: []string{"$ #/type"}},
+
+		{name: "enum", schema: `{"enum": ["a", {"b": 1}]}`, instance: `{"b": 1}`},
+		{name: "enum mismatch", schema: `{"enum": ["a", "b"]}`, instance: `"c"`, want: []string{"$ #/enum"}},
+		{name: "const", schema: `{"const": [1, 2]}`, instance: `[1, 2]`},
+		{name: "const mismatch", schema: `{"const": 1}`, instance: `1.5`, want: []string{"$ #/const"}},
+
+		{name: "string length counts runes", schema: `{"minLength": 2, "maxLength": 2}`, instance: `"hé"`},
+		{name: "string too short", schema: `{"minLength": 2}`, instance: `"a"`, want: []string{"$ #/minLength"}},
+		{name: "string too long", schema: `{"maxLength": 1}`, instance: `"ab"`, want: []string{"$ #/maxLength"}},
+		{name: "pattern", schema: `{"pattern": "^[a-z]+$"}`, instance: `"abc"`},
+		{name: "pattern mismatch", schema: `{"pattern": "^[a-z]+$"}`, instance: `"ab1"`, want: []string{"$ #/pattern"}},
+		{name: "invalid pattern", schema: `{"pattern": "("}`, instance: `"a"`, want: []string{"$ #/pattern"}},
+		{name: "string keywords ignore numbers", schema: `{"minLength": 2}`, instance: `1`},
+
+		{name: "minimum", schema: `{"minimum": 1}`, instance: `1`},
+		{name: "below minimum", schema: `{"minimum": 1}`, instance: `0.5`, want: []string{"$ #/minimum"}},
+		{name: "above maximum", schema: `{"maximum": 1}`, instance: `2`, want: []string{"$ #/maximum"}},
+		{name: "draft 4 exclusive minimum", schema: `{"minimum": 1, "exclusiveMinimum": true}`, instance: `1`, want: []string{"$ #/minimum"}},
+		{name: "draft 4 exclusive maximum", schema: `{"maximum": 1, "exclusiveMaximum": true}`, instance: `1`, want: []string{"$ #/maximum"}},
+		{name: "exclusive minimum", schema: `{"exclusiveMinimum": 1}`, instance: `1`, want: []string{"$ #/exclusiveMinimum"}},
+		{name: "exclusive maximum", schema: `{"exclusiveMaximum": 1}`, instance: `0.9`},
+		{name: "multipleOf", schema: `{"multipleOf": 0.1}`, instance: `0.3`},
+		{name: "not a multiple", schema: `{"multipleOf": 2}`, instance: `3`, want: []string{"$ #/multipleOf"}},
+
+		{name: "items", schema: `{"items": {"type": "number"}}`, instance: `[1, "a", 3, "b"]`, want: []string{"$[1] #/items/type", "$[3] #/items/type"}},
+		{name: "too few items", schema: `{"minItems": 2}`, instance: `[1]`, want: []string{"$ #/minItems"}},
+		{name: "too many items", schema: `{"maxItems": 1}`, instance: `[1, 2]`, want: []string{"$ #/maxItems"}},
+		{name: "unique items", schema: `{"uniqueItems": true}`, instance: `[1, {"a": 1}, 1, {"a": 1}]`, want: []string{"$[2] #/uniqueItems", "$[3] #/uniqueItems"}},
+		{
+			name:     "tuple with additional items",
+			schema:   `{"items": [{"type": "string"}, {"type": "number"}], "additionalItems": false}`,
+			instance: `["a", "b", true]`,
+			want:     []string{"$[1] #/items/1/type", "$[2] #/additionalItems"},
+		},
+		{name: "tuple without additional items", schema: `{"items": [{"type": "string"}]}`, instance: `["a", 1, 2]`},
+
+		{
+			name:     "required and properties",
+			schema:   `{"type": "object", "required": ["text", "images"], "properties": {"text": {"type": "string"}}}`,
+			instance: `{"text": 1}`,
+			want:     []string{"$.images #/required", "$.text #/properties/text/type"},
+		},
+		{
+			name:     "additional properties",
+			schema:   `{"properties": {"a": true}, "additionalProperties": false}`,
+			instance: `{"a": 1, "b": 2, "odd key": 3}`,
+			want:     []string{"$.b #/additionalProperties", `$["odd key"] #/additionalProperties`},
+		},
+		{
+			name:     "additional properties schema",
+			schema:   `{"additionalProperties": {"type": "number"}}`,
+			instance: `{"a": 1, "b": "x"}`,
+			want:     []string{"$.b #/additionalProperties/type"},
+		},
+		{
+			name:     "pattern properties",
+			schema:   `{"patternProperties": {"^x-": {"type": "string"}, "a/b": true}, "additionalProperties": false}`,
+			instance: `{"x-id": 1, "a/b": 1, "y": 1}`,
+			want:     []string{"$[\"x-id\"] #/patternProperties/^x-/type", "$.y #/additionalProperties"},
+		},
+		{name: "property count", schema: `{"minProperties": 2, "maxProperties": 1}`, instance: `{"a": 1}`, want: []string{"$ #/minProperties"}},
+
+		{name: "allOf", schema: `{"allOf": [{"type": "number"}, {"minimum": 2}]}`, instance: `1`, want: []string{"$ #/allOf/1/minimum"}},
+		{name: "anyOf", schema: `{"anyOf": [{"type": "string"}, {"minimum": 2}]}`, instance: `3`},
+		{name: "anyOf mismatch", schema: `{"anyOf": [{"type": "string"}, {"minimum": 2}]}`, instance: `1`, want: []string{"$ #/anyOf"}},
+		{name: "oneOf", schema: `{"oneOf": [{"type": "string"}, {"minimum": 2}]}`, instance: `3`},
+		{name: "oneOf matching two", schema: `{"oneOf": [{"type": "number"}, {"minimum": 2}]}`, instance: `3`, want: []string{"$ #/oneOf"}},
+		{name: "oneOf matching none", schema: `{"oneOf": [{"type": "string"}]}`, instance: `3`, want: []string{"$ #/oneOf"}},
+		{name: "not", schema: `{"not": {"type": "null"}}`, instance: `null`, want: []string{"$ #/not"}},
+
+		{
+			name:     "ref",
+			schema:   `{"definitions": {"image": {"type": "object", "required": ["url"]}}, "items": {"$ref": "#/definitions/image"}}`,
+			instance: `[{"url": "a"}, {}]`,
+			want:     []string{"$[1].url #/definitions/image/required"},
+		},
+		{name: "ref with an escaped pointer", schema: `{"defs": {"a/b": {"type": "string"}}, "$ref": "#/defs/a~1b"}`, instance: `1`, want: []string{"$ #/defs/a~1b/type"}},
+		{name: "ref into an array", schema: `{"anyOf": [{"type": "string"}], "not": {"$ref": "#/anyOf/0"}}`, instance: `"a"`, want: []string{"$ #/not"}},
+		{name: "missing ref", schema: `{"$ref": "#/definitions/missing"}`, instance: `1`, want: []string{"$ #/$ref"}},
+		{name: "remote ref", schema: `{"$ref": "https://example.com/schema.json"}`, instance: `1`, want: []string{"$ #/$ref"}},
+		{name: "recursive ref", schema: `{"$ref": "#"}`, instance: `1`, want: []string{"$ #"}},
+		{
+			name:     "recursive ref on nested data",
+			schema:   `{"type": "object", "properties": {"child": {"$ref": "#"}}, "additionalProperties": false}`,
+			instance: `{"child": {"child": {"other": 1}}}`,
+			want:     []string{"$.child.child.other #/additionalProperties"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			violations := validateSchema(decodeJSON(t, test.schema), decodeJSON(t, test.instance), "$")
+
+			got := make([]string, 0, len(violations))
+			for _, violation := range violations {
+				if violation.Operator != "schema" || violation.Message == "" {
+					t.Errorf("violation %+v has no operator or message", violation)
+				}
+				got = append(got, violation.Path+" "+violation.SchemaPath)
+			}
+			if strings.Join(got, "\n") != strings.Join(test.want, "\n") {
+				t.Errorf("violations = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestCheckOutputSchema(t *testing.T) {
+	test := common.Test{OutputSchema: decodeJSON(t, `{"type": "object", "required": ["text"]}`)}
+
+	if mismatches := checkOutputSchema(test, map[string]interface{}{"output": map[string]interface{}{"text": "a"}}); len(mismatches) != 0 {
+		t.Errorf("valid output has mismatches %+v", mismatches)
+	}
+
+	mismatches := checkOutputSchema(test, map[string]interface{}{"output": map[string]interface{}{}})
+	if len(mismatches) != 1 || mismatches[0].Path != "$.output.text" {
+		t.Errorf("missing property reported as %+v", mismatches)
+	}
+
+	if mismatches := checkOutputSchema(test, map[string]interface{}{"status": "FAILED", "error": "handler failed"}); len(mismatches) != 0 {
+		t.Errorf("failed job is validated against the output schema: %+v", mismatches)
+	}
+	if mismatches := checkOutputSchema(common.Test{}, map[string]interface{}{"output": 1}); len(mismatches) != 0 {
+		t.Errorf("test without an output schema has mismatches %+v", mismatches)
+	}
+}
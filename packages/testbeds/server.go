@@ -0,0 +1,221 @@
+package testbeds
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"sls-local-server/packages/common"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+const (
+	// runsyncWait is how long /runsync waits for a job before returning its current status, like on runpod
+	runsyncWait = 90 * time.Second
+	// streamWait is how long /stream waits for a new chunk before returning an empty one
+	streamWait = 10 * time.Second
+	// jobTakeWait is how long a worker request waits for a job before getting an empty response
+	jobTakeWait = 10 * time.Second
+)
+
+// testNumberHeader tells the job API which test a request was sent for
+const testNumberHeader = "X-Runpod-Test-Number"
+
+type runRequest struct {
+	Input  interface{} `json:"input"`
+	Policy *jobPolicy  `json:"policy,omitempty"`
+}
+
+type jobPolicy struct {
+	// ExecutionTimeout in milliseconds
+	ExecutionTimeout int `json:"executionTimeout,omitempty"`
+}
+
+// StartJobAPI serves the serverless job API on port 80.
+// The aiapi binary downloaded from S3 is used instead when RUNPOD_USE_AIAPI=true.
+func StartJobAPI(log *zap.Logger) error {
+	if os.Getenv("RUNPOD_USE_AIAPI") == "true" {
+		log.Info("Using the downloaded aiapi binary for the job API")
+		return common.InstallAndRunAiApi(log)
+	}
+
+	go RunJobServer(log)
+	return nil
+}
+
+// requeueRunningJobs queues the jobs the crashed handler was running again, or fails them when they already were
+func requeueRunningJobs(log *zap.Logger) {
+	requeued, failed := jobQueue.RequeueRunning("The handler exited while running the job")
+	if requeued > 0 || failed > 0 {
+		log.Warn("The handler exited with jobs in progress", zap.Int("requeued", requeued), zap.Int("failed", failed))
+	}
+}
+
+// RunJobServer serves the runpod job endpoints and the worker webhooks backed by jobQueue
+func RunJobServer(log *zap.Logger) {
+	gin.SetMode(gin.ReleaseMode)
+	h := NewHandler(log)
+
+	r := gin.New()
+	// Add recovery middleware
+	r.Use(gin.Recovery())
+	// Add logging middleware
+	r.Use(LoggerMiddleware(log))
+
+	r.GET("/ping", h.Ping)
+
+	v2 := r.Group("/v2/:endpoint")
+	v2.POST("/run", h.Run)
+	v2.POST("/runsync", h.RunSync)
+	v2.GET("/status/:jobId", h.Status)
+	v2.POST("/status/:jobId", h.Status)
+	v2.GET("/stream/:jobId", h.Stream)
+	v2.POST("/stream/:jobId", h.Stream)
+	v2.POST("/cancel/:jobId", h.Cancel)
+	v2.GET("/health", h.JobHealth)
+	v2.POST("/purge-queue", h.PurgeQueue)
+
+	// worker webhooks, see the RUNPOD_WEBHOOK_* variables set by common.RunCommand
+	v2.GET("/job-take/:podId", h.JobTake)
+	v2.GET("/job-take-batch/:podId", h.JobTakeBatch)
+	v2.POST("/job-done/:podId/:jobId", h.JobDone)
+	v2.POST("/job-stream/:podId/:jobId", h.JobStream)
+
+	if err := r.Run(":" + "80"); err != nil {
+		log.Fatal("Failed to start server", zap.Error(err))
+	}
+}
+
+// Ping is polled until the job API is ready
+func (h *Handler) Ping(c *gin.Context) {
+	c.String(http.StatusOK, "pong")
+}
+
+// Run queues a job and returns its id
+func (h *Handler) Run(c *gin.Context) {
+	job, ok := h.submit(c, false)
+	if !ok {
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"id":     job.ID,
+		"status": JobInQueue,
+	})
+}
+
+// RunSync queues a job and waits for it to finish, the wait query parameter overrides the wait in milliseconds
+func (h *Handler) RunSync(c *gin.Context) {
+	job, ok := h.submit(c, true)
+	if !ok {
+		return
+	}
+
+	wait := runsyncWait
+	if waitParam := c.Query("wait"); waitParam != "" {
+		if milliseconds, err := strconv.Atoi(waitParam); err == nil && milliseconds > 0 {
+			wait = time.Duration(milliseconds) * time.Millisecond
+		}
+	}
+
+	jobQueue.Wait(c.Request.Context(), job, wait)
+	c.JSON(http.StatusOK, jobQueue.Response(job))
+}
+
+// Status returns the current state of a job
+func (h *Handler) Status(c *gin.Context) {
+	result, err := jobQueue.Get(c.Param("jobId"))
+	if err != nil {
+		h.jobError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, result)
+}
+
+// Stream returns the partial outputs a generator handler produced since the previous call
+func (h *Handler) Stream(c *gin.Context) {
+	result, err := jobQueue.ReadStream(c.Request.Context(), c.Param("jobId"), streamWait)
+	if err != nil {
+		h.jobError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, result)
+}
+
+// Cancel stops a queued or running job
+func (h *Handler) Cancel(c *gin.Context) {
+	job, err := jobQueue.Cancel(c.Param("jobId"))
+	if err != nil {
+		h.jobError(c, err)
+		return
+	}
+
+	result := jobQueue.Response(job)
+	c.JSON(http.StatusOK, gin.H{
+		"id":     result.ID,
+		"status": result.Status,
+	})
+}
+
+// JobHealth returns the job and worker counters of the endpoint
+func (h *Handler) JobHealth(c *gin.Context) {
+	c.JSON(http.StatusOK, jobQueue.Health())
+}
+
+// PurgeQueue removes every job that has not been picked up by a worker yet
+func (h *Handler) PurgeQueue(c *gin.Context) {
+	removed := jobQueue.Purge()
+	h.log.Info("Purged queue", zap.Int("removed", removed))
+	c.JSON(http.StatusOK, gin.H{
+		"removed": removed,
+		"status":  "completed",
+	})
+}
+
+func (h *Handler) submit(c *gin.Context, sync bool) (*Job, bool) {
+	var request runRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid request body",
+		})
+		return nil, false
+	}
+	if request.Input == nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "The request has no input",
+		})
+		return nil, false
+	}
+
+	var executionTimeout time.Duration
+	if request.Policy != nil && request.Policy.ExecutionTimeout > 0 {
+		executionTimeout = time.Duration(request.Policy.ExecutionTimeout) * time.Millisecond
+	}
+	testNumber, _ := strconv.Atoi(c.GetHeader(testNumberHeader))
+
+	job := jobQueue.Submit(request.Input, sync, testNumber, executionTimeout)
+	h.log.Info("Job queued", zap.String("job_id", job.ID), zap.Int("test_number", testNumber))
+	return job, true
+}
+
+func (h *Handler) jobError(c *gin.Context, err error) {
+	if errors.Is(err, errJobNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	if errors.Is(err, errJobNotTaken) || errors.Is(err, errJobOtherOwner) {
+		c.JSON(http.StatusConflict, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	c.JSON(http.StatusInternalServerError, gin.H{
+		"error": err.Error(),
+	})
+}
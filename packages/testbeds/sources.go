@@ -0,0 +1,225 @@
+package testbeds
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"sls-local-server/packages/common"
+)
+
+// testFileSuffixes are the files picked up when RUNPOD_TEST_FILE points to a directory
+var testFileSuffixes = []string{".tests.json", ".tests.jsonc", ".tests.yaml", ".tests.yml"}
+
+// testSource is the raw content of a test file along with where it came from
+type testSource struct {
+	Origin string
+	Data   []byte
+}
+
+// readTestSources returns the test files to run.
+// RUNPOD_TEST_FILE takes precedence and can be a file, a directory of *.tests.json files, a glob or - for stdin.
+// Otherwise RUNPOD_TESTS holds the base64 encoded file, or URL:<url> to download the base64 encoded file.
+func readTestSources() ([]testSource, error) {
+	if path := os.Getenv("RUNPOD_TEST_FILE"); path != "" {
+		return readTestFiles(path)
+	}
+
+	source, err := readEncodedTests(os.Getenv("RUNPOD_TESTS"))
+	if err != nil {
+		return nil, err
+	}
+	return []testSource{source}, nil
+}
+
+func readEncodedTests(tests string) (testSource, error) {
+	origin := "RUNPOD_TESTS"
+
+	if strings.HasPrefix(tests, "URL:") {
+		testURL := strings.TrimPrefix(tests, "URL:")
+		origin = testURL
+
+		resp, err := http.Get(testURL)
+		if err != nil {
+			return testSource{}, fmt.Errorf("could not download the tests from %s: %s", testURL, err.Error())
+		}
+		defer resp.Body.Close()
+
+		downloaded, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return testSource{}, fmt.Errorf("could not download the tests from %s: %s", testURL, err.Error())
+		}
+		tests = string(downloaded)
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(tests))
+	if err != nil {
+		return testSource{}, fmt.Errorf("%s is not valid base64: %s", origin, err.Error())
+	}
+
+	return testSource{Origin: origin, Data: decoded}, nil
+}
+
+func readTestFiles(path string) ([]testSource, error) {
+	if path == "-" {
+		data, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			return nil, fmt.Errorf("could not read the tests from stdin: %s", err.Error())
+		}
+		return []testSource{{Origin: "stdin", Data: data}}, nil
+	}
+
+	paths, err := expandTestPath(path)
+	if err != nil {
+		return nil, err
+	}
+
+	sources := make([]testSource, 0, len(paths))
+	for _, file := range paths {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("could not read %s: %s", file, err.Error())
+		}
+		sources = append(sources, testSource{Origin: file, Data: data})
+	}
+	return sources, nil
+}
+
+// expandTestPath resolves a directory or a glob into the sorted list of test files it contains
+func expandTestPath(path string) ([]string, error) {
+	if strings.ContainsAny(path, "*?[") {
+		matches, err := filepath.Glob(path)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern %s: %s", path, err.Error())
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("no test files match %s", path)
+		}
+		sort.Strings(matches)
+		return matches, nil
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read %s: %s", path, err.Error())
+	}
+	if !info.IsDir() {
+		return []string{path}, nil
+	}
+
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read %s: %s", path, err.Error())
+	}
+
+	files := make([]string, 0)
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		for _, suffix := range testFileSuffixes {
+			if strings.HasSuffix(entry.Name(), suffix) {
+				files = append(files, filepath.Join(path, entry.Name()))
+				break
+			}
+		}
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no *.tests.json files found in %s", path)
+	}
+
+	sort.Strings(files)
+	return files, nil
+}
+
+// parseTestSources decodes every source in order and merges them into testConfig, suiteConfig and loadConfig.
+// The load section of a later file replaces the one of an earlier file. The schemas and the mode of a file are
+// copied to its tests instead of being merged, so they never apply to the tests of another file.
+func parseTestSources(sources []testSource) error {
+	tests := make([]common.Test, 0)
+	config := common.TestConfig{}
+	var load *common.LoadConfig
+
+	for _, source := range sources {
+		file, err := decodeTestFile(source.Data)
+		if err != nil {
+			return fmt.Errorf("%s: %s", source.Origin, err.Error())
+		}
+		fileTests, fileConfig := file.Tests, file.Config
+
+		for j := range fileTests {
+			fileTests[j].Source = fmt.Sprintf("%s#tests[%d]", source.Origin, j)
+
+			// the schemas and the mode of a file only apply to the tests defined in it, the tests run in sync mode by default
+			if fileTests[j].InputSchema == nil {
+				fileTests[j].InputSchema = fileConfig.InputSchema
+			}
+			if fileTests[j].OutputSchema == nil {
+				fileTests[j].OutputSchema = fileConfig.OutputSchema
+			}
+			if fileTests[j].Mode == "" {
+				fileTests[j].Mode = fileConfig.Mode
+			}
+			if fileTests[j].Mode == "" {
+				fileTests[j].Mode = ModeSync
+			}
+		}
+
+		tests = append(tests, fileTests...)
+		config = mergeTestConfig(config, fileConfig)
+		if file.Load != nil {
+			load = file.Load
+		}
+	}
+
+	testConfig = tests
+	suiteConfig = config
+	loadConfig = load
+	return nil
+}
+
+// mergeTestConfig applies the fields set in override on top of base, env variables are merged by key. The schemas
+// and the mode are left out, parseTestSources copies them to the tests of their file.
+func mergeTestConfig(base common.TestConfig, override common.TestConfig) common.TestConfig {
+	if override.RunsOn != "" {
+		base.RunsOn = override.RunsOn
+	}
+	if override.GpuTypeID != "" {
+		base.GpuTypeID = override.GpuTypeID
+	}
+	if override.GpuCount != 0 {
+		base.GpuCount = override.GpuCount
+	}
+	if override.CpuFlavor != "" {
+		base.CpuFlavor = override.CpuFlavor
+	}
+	if override.AllowedCudaVersions != nil {
+		base.AllowedCudaVersions = override.AllowedCudaVersions
+	}
+	if override.Concurrency != 0 {
+		base.Concurrency = override.Concurrency
+	}
+	base.Redact = append(base.Redact, override.Redact...)
+
+	for _, env := range override.Env {
+		replaced := false
+		for i := range base.Env {
+			if base.Env[i].Key == env.Key {
+				base.Env[i].Value = env.Value
+				base.Env[i].Secret = base.Env[i].Secret || env.Secret
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			base.Env = append(base.Env, env)
+		}
+	}
+
+	return base
+}
@@ -1,4 +1,3 @@
 package vars
 
-var CURRENT_TEST_ID = 0
 var INITIALIZED = false